@@ -3,7 +3,9 @@ module github.com/kiran-sama/ebpf-training
 go 1.16
 
 require (
+	github.com/andybalholm/brotli v1.0.4
 	github.com/gin-gonic/gin v1.7.7
 	github.com/iovisor/gobpf v0.2.1-0.20221005153822-16120a1bf4d4
 	golang.org/x/sys v0.0.0-20211214234402-4825e8c3871d
+	gopkg.in/yaml.v2 v2.2.8
 )
@@ -19,16 +19,19 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	bpfwrapper2 "github.com/kiran-sama/ebpf-training/workshop1/internal/bpfwrapper"
 	"github.com/kiran-sama/ebpf-training/workshop1/internal/connections"
 	"github.com/kiran-sama/ebpf-training/workshop1/internal/settings"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"os/user"
 	"runtime/debug"
+	"strings"
 	"syscall"
 	"time"
 
@@ -75,12 +78,52 @@ func updateAllowedPIDs(table *bcc.Table, pids []uint32) error {
 	return nil
 }
 
+// writeOpenAPISpec writes the api inventory as an OpenAPI specification, if a path was given.
+func writeOpenAPISpec(connectionFactory *connections.Factory, path string) {
+	if path == "" {
+		return
+	}
+	if err := connectionFactory.WriteOpenAPISpec(path); err != nil {
+		log.Printf("Failed writing the OpenAPI specification: %v", err)
+		return
+	}
+	log.Printf("OpenAPI specification written to %s", path)
+}
+
+// reloadPIIRules loads the PII rules again, if a path was given. The previous rules are kept if the rules are invalid.
+func reloadPIIRules(connectionFactory *connections.Factory, path string) {
+	if path == "" {
+		return
+	}
+	piiClassifier, err := connections.LoadPIIRules(path)
+	if err != nil {
+		log.Printf("Failed reloading the PII rules, keeping the previous rules: %v", err)
+		return
+	}
+	connectionFactory.SetPIIClassifier(piiClassifier)
+	log.Printf("PII rules reloaded from %s", path)
+}
+
 func main() {
-	if len(os.Args) != 2 {
-		fmt.Println("Usage: go run main.go <path to bpf source code>")
+	openAPIPath := flag.String("openapi", "", "path of the OpenAPI specification of the api inventory, written on SIGUSR1 and on termination")
+	referenceSpecPath := flag.String("reference-spec", "", "path of an OpenAPI specification (JSON or YAML) the captured traffic is compared to")
+	metricsAddress := flag.String("metrics", "", "address to serve the metrics of the api inventory on, such as :9090")
+	eventsPath := flag.String("events", "", "path of the file the structured events are appended to, instead of the stdout")
+	redactionMode := flag.String("redaction", connections.RedactionMask, "redaction of the printed payloads: none, mask, hash, drop-body or headers-only")
+	redactionSalt := flag.String("redaction-salt", "", "salt of the hashes of the redacted values, drawn at random if empty")
+	redactedHeaders := flag.String("redact-headers", "", "comma separated headers redacted on top of Authorization, Proxy-Authorization, Cookie and Set-Cookie")
+	piiRulesPath := flag.String("pii-rules", "", "path of the PII rules (JSON or YAML) evaluated on top of the built-in detectors, reloaded on SIGHUP")
+	authFailureThresholds := flag.String("auth-failure-thresholds", connections.DefaultAuthFailureThresholds, "comma separated <count>/<window> thresholds of the authentication failures of a peer to an endpoint, such as 10/1m")
+	flag.Usage = func() {
+		fmt.Println("Usage: go run main.go [-openapi <path to OpenAPI specification>] [-reference-spec <path to OpenAPI specification>] [-events <path to events file>] [-metrics <address>] [-pii-rules <path to PII rules>] [-redaction <mode>] [-redact-headers <headers>] [-auth-failure-thresholds <thresholds>] <path to bpf source code>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
 		os.Exit(1)
 	}
-	bpfSourceCodeFile := os.Args[1]
+	bpfSourceCodeFile := flag.Arg(0)
 	bpfSourceCodeContent, err := ioutil.ReadFile(bpfSourceCodeFile)
 	if err != nil {
 		log.Panic(err)
@@ -96,7 +139,13 @@ func main() {
 
 	// Catching all termination signals to perform a cleanup when being stopped.
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	// SIGUSR1 asks for the OpenAPI specification of what was captured so far.
+	dump := make(chan os.Signal, 1)
+	signal.Notify(dump, syscall.SIGUSR1)
+	// SIGHUP asks to reload the PII rules.
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
 
 	bpfModule := bcc.NewModule(string(bpfSourceCodeContent), nil)
 	if bpfModule == nil {
@@ -119,6 +168,47 @@ func main() {
 	}
 
 	connectionFactory := connections.NewFactory(time.Minute)
+	if *eventsPath != "" {
+		eventsFile, err := os.OpenFile(*eventsPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Panic(err)
+		}
+		defer eventsFile.Close()
+		connectionFactory.SetEventSink(connections.NewEventSink(eventsFile))
+	}
+	if *referenceSpecPath != "" {
+		referenceSpec, err := connections.LoadReferenceSpec(*referenceSpecPath)
+		if err != nil {
+			log.Panic(err)
+		}
+		connectionFactory.SetReferenceSpec(referenceSpec)
+	}
+	redactor, err := connections.NewRedactor(*redactionMode, *redactionSalt, strings.Split(*redactedHeaders, ","))
+	if err != nil {
+		log.Panic(err)
+	}
+	connectionFactory.SetRedactor(redactor)
+	thresholds, err := connections.ParseAuthFailureThresholds(*authFailureThresholds)
+	if err != nil {
+		log.Panic(err)
+	}
+	connectionFactory.SetAuthFailureThresholds(thresholds)
+	if *piiRulesPath != "" {
+		piiClassifier, err := connections.LoadPIIRules(*piiRulesPath)
+		if err != nil {
+			log.Panic(err)
+		}
+		connectionFactory.SetPIIClassifier(piiClassifier)
+	}
+	if *metricsAddress != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", connectionFactory.MetricsHandler())
+			if err := http.ListenAndServe(*metricsAddress, mux); err != nil {
+				log.Printf("Failed serving metrics: %v", err)
+			}
+		}()
+	}
 	go func() {
 		for {
 			connectionFactory.HandleReadyConnections()
@@ -134,6 +224,17 @@ func main() {
 		log.Panic(err)
 	}
 	log.Println("Sniffer is ready")
-	<-sig
-	log.Println("Signaled to terminate")
+	for {
+		select {
+		case <-dump:
+			writeOpenAPISpec(connectionFactory, *openAPIPath)
+		case <-reload:
+			reloadPIIRules(connectionFactory, *piiRulesPath)
+		case <-sig:
+			log.Println("Signaled to terminate")
+			writeOpenAPISpec(connectionFactory, *openAPIPath)
+			connectionFactory.ReportUnseenEndpoints()
+			return
+		}
+	}
 }
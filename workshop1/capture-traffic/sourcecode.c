@@ -18,8 +18,12 @@
  * SPDX-License-Identifier: Apache-2.0
  */
 
+#include <linux/errno.h>
+#include <linux/fdtable.h>
+#include <linux/fs.h>
 #include <linux/in6.h>
 #include <linux/net.h>
+#include <linux/sched.h>
 #include <linux/socket.h>
 #include <net/inet_sock.h>
 
@@ -36,6 +40,25 @@
 // and effectively makes the maximum message size to be CHUNK_LIMIT*MAX_MSG_SIZE.
 #define CHUNK_LIMIT 4
 
+// DNS message size we copy to the user mode. 1232 bytes is the EDNS buffer size recommended
+// by the DNS flag day 2020, so it covers practically every DNS message sent over UDP.
+#define MAX_DNS_MSG_SIZE 1232
+
+// The well known DNS port.
+#define DNS_PORT 53
+
+// The messages of a sendmmsg syscall we look at. glibc sends the A and AAAA queries of a lookup together.
+#define MAX_DNS_MMSG 2
+
+// MongoDB wire protocol opcodes we are interested in.
+#define MONGO_OP_REPLY 1
+#define MONGO_OP_QUERY 2004
+#define MONGO_OP_COMPRESSED 2012
+#define MONGO_OP_MSG 2013
+
+// The maximal size of a MongoDB message (48MB).
+#define MONGO_MAX_MSG_SIZE 50331648
+
 enum traffic_direction_t {
     kEgress,
     kIngress,
@@ -55,7 +78,7 @@ struct conn_id_t {
 };
 
 // This struct contains information collected when a connection is established,
-// via an accept4() syscall.
+// via an accept4() or a connect() syscall.
 struct conn_info_t {
     // Connection identifier.
     struct conn_id_t conn_id;
@@ -66,6 +89,13 @@ struct conn_info_t {
 
     // A flag indicating we identified the connection as HTTP.
     bool is_http;
+
+    // A flag indicating we identified the connection as MongoDB.
+    bool is_mongo;
+
+    // A flag indicating the connection was opened by the traced process (connect) rather than accepted. Only MongoDB
+    // is captured on those, as the HTTP parsing expects the traced process to be the server.
+    bool is_client;
 };
 
 // An helper struct that hold the addr argument of the syscall.
@@ -73,6 +103,14 @@ struct accept_args_t {
     struct sockaddr_in* addr;
 };
 
+// The standard header of every MongoDB wire protocol message.
+struct mongo_msg_header_t {
+    int32_t message_length;
+    int32_t request_id;
+    int32_t response_to;
+    int32_t op_code;
+};
+
 // An helper struct to cache input argument of read/write syscalls between the
 // entry hook and the exit hook.
 struct data_args_t {
@@ -80,11 +118,35 @@ struct data_args_t {
     const char* buf;
 };
 
+// An helper struct that hold the input arguments of the connect syscall.
+struct connect_args_t {
+    int32_t fd;
+    const struct sockaddr_in* addr;
+};
+
 // An helper struct that hold the input arguments of the close syscall.
 struct close_args_t {
     int32_t fd;
 };
 
+// An helper struct to cache input arguments of sendto/recvfrom/sendmsg syscalls between the
+// entry hook and the exit hook.
+struct dns_args_t {
+    int32_t fd;
+    const char* buf;
+    // The size of the buffer, zero if the syscall return code bounds it.
+    size_t buf_size;
+    // The address of the peer, for recvfrom it is filled by the kernel only when the syscall returns. Connected
+    // sockets are given no address, their peer is read from the socket.
+    struct sockaddr_in* addr;
+};
+
+// An helper struct to cache the input arguments of the sendmmsg syscall between the entry hook and the exit hook.
+struct dns_mmsg_args_t {
+    int32_t fd;
+    const struct mmsghdr* msgvec;
+};
+
 // A struct describing the event that we send to the user mode upon a new connection.
 struct socket_open_event_t {
     // The time of the event.
@@ -132,6 +194,25 @@ struct socket_data_event_t {
   char msg[MAX_MSG_SIZE];
 };
 
+// Struct describing a DNS message sent or received over UDP.
+struct dns_event_t {
+  struct dns_attr_t {
+    // The timestamp when syscall completed (return probe was triggered).
+    uint64_t timestamp_ns;
+    // The process that sent or received the message.
+    uint32_t pid;
+    // The file descriptor of the UDP socket.
+    int32_t fd;
+    // Whether the message was sent (kEgress) or received (kIngress).
+    enum traffic_direction_t direction;
+    // The amount of bytes copied into the msg field.
+    uint32_t msg_size;
+    // The address of the DNS peer.
+    struct sockaddr_in addr;
+  } attr;
+  char msg[MAX_DNS_MSG_SIZE];
+};
+
 // Maps
 
 // A map of the active connections. The name of the map is conn_info_map
@@ -141,6 +222,8 @@ BPF_HASH(conn_info_map, uint64_t, struct conn_info_t, 131072);
 // An helper map that will help us cache the input arguments of the accept syscall
 // between the entry hook and the return hook.
 BPF_HASH(active_accept_args_map, uint64_t, struct accept_args_t);
+// An helper map to store connect syscall arguments between entry and exit hooks.
+BPF_HASH(active_connect_args_map, uint64_t, struct connect_args_t);
 // Perf buffer to send to the user-mode the data events.
 BPF_PERF_OUTPUT(socket_data_events);
 // A perf buffer that allows us send events from kernel to user mode.
@@ -154,6 +237,16 @@ BPF_HASH(active_write_args_map, uint64_t, struct data_args_t);
 BPF_HASH(active_read_args_map, uint64_t, struct data_args_t);
 // An helper map to store close syscall arguments between entry and exit syscalls.
 BPF_HASH(active_close_args_map, uint64_t, struct close_args_t);
+// An helper map to store sendto/recvfrom/sendmsg syscall arguments between entry and exit hooks.
+BPF_HASH(active_dns_args_map, uint64_t, struct dns_args_t);
+// An helper map to store sendmmsg syscall arguments between entry and exit hooks.
+BPF_HASH(active_dns_mmsg_args_map, uint64_t, struct dns_mmsg_args_t);
+// A map of the UDP sockets connected to a DNS server, to their peer. It is filled when the sockets are connected, so
+// the read and write syscalls of other files are not inspected.
+BPF_HASH(dns_socket_map, uint64_t, struct sockaddr_in, 16384);
+// Perf buffer to send to the user-mode the DNS messages.
+BPF_PERF_OUTPUT(dns_events);
+BPF_PERCPU_ARRAY(dns_event_buffer_heap, struct dns_event_t, 1);
 
 // A map to store allowed PIDs, updated periodically from Go userspace.
 BPF_HASH(allowed_pids, uint32_t, uint8_t, 1024);
@@ -207,6 +300,103 @@ static __inline void process_syscall_accept(struct pt_regs* ctx, uint64_t id, co
     socket_open_events.perf_submit(ctx, &open_event, sizeof(struct socket_open_event_t));
 }
 
+// Checks whether a file descriptor of the current process is a UDP socket. It walks the file table of the process, so
+// it is only called when sockets are connected rather than on every read and write.
+static inline __attribute__((__always_inline__)) bool is_udp_socket(int32_t fd) {
+    struct task_struct* task = (struct task_struct*)bpf_get_current_task();
+    struct files_struct* files = NULL;
+    bpf_probe_read(&files, sizeof(files), &task->files);
+    if (files == NULL) {
+        return false;
+    }
+    struct fdtable* fdt = NULL;
+    bpf_probe_read(&fdt, sizeof(fdt), &files->fdt);
+    if (fdt == NULL) {
+        return false;
+    }
+    struct file** fds = NULL;
+    bpf_probe_read(&fds, sizeof(fds), &fdt->fd);
+    if (fds == NULL) {
+        return false;
+    }
+    struct file* file = NULL;
+    bpf_probe_read(&file, sizeof(file), &fds[fd]);
+    if (file == NULL) {
+        return false;
+    }
+
+    // Only the private data of sockets holds a struct socket.
+    struct inode* inode = NULL;
+    bpf_probe_read(&inode, sizeof(inode), &file->f_inode);
+    if (inode == NULL) {
+        return false;
+    }
+    umode_t mode = 0;
+    bpf_probe_read(&mode, sizeof(mode), &inode->i_mode);
+    if ((mode & S_IFMT) != S_IFSOCK) {
+        return false;
+    }
+    struct socket* sock = NULL;
+    bpf_probe_read(&sock, sizeof(sock), &file->private_data);
+    if (sock == NULL) {
+        return false;
+    }
+    short type = 0;
+    bpf_probe_read(&type, sizeof(type), &sock->type);
+    return type == SOCK_DGRAM;
+}
+
+// An helper function that checks if the connect syscall of the traced process succeeded (or is in progress for
+// non-blocking sockets), and if it did saves the new outbound connection in the map of connections.
+static __inline void process_syscall_connect(struct pt_regs* ctx, uint64_t id, const struct connect_args_t* args) {
+    int ret_val = PT_REGS_RC(ctx);
+    if (ret_val < 0 && ret_val != -EINPROGRESS) {
+        return;
+    }
+    if (args->addr == NULL) {
+        return;
+    }
+
+    uint32_t pid = id >> 32;
+    // Check if the PID is allowed.
+    if (!is_pid_allowed(pid)) {
+        return;
+    }
+
+    uint64_t pid_fd = gen_tgid_fd(pid, args->fd);
+    // A UDP socket can be connected again, to another peer or to none.
+    dns_socket_map.delete(&pid_fd);
+
+    struct sockaddr_in addr = {};
+    bpf_probe_read(&addr, sizeof(addr), args->addr);
+    if (addr.sin_family != AF_INET) {
+        // Only IPv4 peers are tracked, as for the accepted connections.
+        return;
+    }
+    if (addr.sin_port == bpf_htons(DNS_PORT)) {
+        // Connected UDP sockets of the resolvers are left to the DNS hooks. DNS over TCP is not decoded.
+        if (is_udp_socket(args->fd)) {
+            dns_socket_map.update(&pid_fd, &addr);
+        }
+        return;
+    }
+
+    struct conn_info_t conn_info = {};
+    conn_info.conn_id.pid = pid;
+    conn_info.conn_id.fd = args->fd;
+    conn_info.conn_id.tsid = bpf_ktime_get_ns();
+    conn_info.is_client = true;
+    conn_info_map.update(&pid_fd, &conn_info);
+
+    // The address of an outbound connection is the server it connected to.
+    struct socket_open_event_t open_event = {};
+    open_event.timestamp_ns = bpf_ktime_get_ns();
+    open_event.conn_id = conn_info.conn_id;
+    open_event.addr = addr;
+
+    socket_open_events.perf_submit(ctx, &open_event, sizeof(struct socket_open_event_t));
+}
+
 static inline __attribute__((__always_inline__)) void process_syscall_close(struct pt_regs* ctx, uint64_t id,
                                                                             const struct close_args_t* close_args) {
     int ret_val = PT_REGS_RC(ctx);
@@ -216,6 +406,7 @@ static inline __attribute__((__always_inline__)) void process_syscall_close(stru
 
     uint32_t tgid = id >> 32;
     uint64_t tgid_fd = gen_tgid_fd(tgid, close_args->fd);
+    dns_socket_map.delete(&tgid_fd);
     struct conn_info_t* conn_info = conn_info_map.lookup(&tgid_fd);
     if (conn_info == NULL) {
         // The FD being closed does not represent an IPv4 socket FD.
@@ -267,6 +458,40 @@ static inline __attribute__((__always_inline__)) bool is_http_connection(struct
     return res;
 }
 
+static inline __attribute__((__always_inline__)) bool is_mongo_connection(struct conn_info_t* conn_info, const char* buf, size_t count) {
+    // If the connection was already identified as MongoDB connection, no need to re-check it.
+    if (conn_info->is_mongo) {
+        return true;
+    }
+
+    // Every MongoDB message starts with a 16 bytes header.
+    if (count < sizeof(struct mongo_msg_header_t)) {
+        return false;
+    }
+
+    struct mongo_msg_header_t header = {};
+    bpf_probe_read(&header, sizeof(header), buf);
+    if (header.message_length < (int32_t)sizeof(struct mongo_msg_header_t) || header.message_length > MONGO_MAX_MSG_SIZE) {
+        return false;
+    }
+
+    bool res = false;
+    switch (header.op_code) {
+        case MONGO_OP_REPLY:
+        case MONGO_OP_QUERY:
+        case MONGO_OP_COMPRESSED:
+        case MONGO_OP_MSG:
+            res = true;
+            break;
+    }
+
+    if (res) {
+        conn_info->is_mongo = true;
+    }
+
+    return res;
+}
+
 static __inline void perf_submit_buf(struct pt_regs* ctx, const enum traffic_direction_t direction,
                                      const char* buf, size_t buf_size, size_t offset,
                                      struct conn_info_t* conn_info,
@@ -355,8 +580,10 @@ static inline __attribute__((__always_inline__)) void process_data(struct pt_reg
         return;
     }
 
-    // Check if the connection is already HTTP, or check if that's a new connection, check protocol and return true if that's HTTP.
-    if (is_http_connection(conn_info, args->buf, bytes_count)) {
+    // Check if the connection is already HTTP (or MongoDB), or check if that's a new connection, check protocol and return
+    // true if that's HTTP (or MongoDB). Outbound connections are only checked for MongoDB.
+    if ((!conn_info->is_client && is_http_connection(conn_info, args->buf, bytes_count)) ||
+        is_mongo_connection(conn_info, args->buf, bytes_count)) {
         // allocate new event.
         uint32_t kZero = 0;
         struct socket_data_event_t* event = socket_data_event_buffer_heap.lookup(&kZero);
@@ -383,6 +610,87 @@ static inline __attribute__((__always_inline__)) void process_data(struct pt_reg
     }
 }
 
+// Submits the message of a sendto/recvfrom/sendmsg/sendmmsg syscall if the peer is a DNS server (or client) on port
+// 53. When the syscall is given no address, the socket must be a UDP socket connected to a DNS server.
+static inline __attribute__((__always_inline__)) void process_dns(struct pt_regs* ctx, uint64_t id,
+                                                                  enum traffic_direction_t direction,
+                                                                  const struct dns_args_t* args, ssize_t bytes_count) {
+    if (args->buf == NULL) {
+        return;
+    }
+
+    if (bytes_count <= 0) {
+        return;
+    }
+
+    uint32_t pid = id >> 32;
+    // Check if the PID is allowed.
+    if (!is_pid_allowed(pid)) {
+        return;
+    }
+
+    struct sockaddr_in addr = {};
+    if (args->addr != NULL) {
+        bpf_probe_read(&addr, sizeof(addr), args->addr);
+    } else {
+        uint64_t pid_fd = gen_tgid_fd(pid, args->fd);
+        struct sockaddr_in* peer = dns_socket_map.lookup(&pid_fd);
+        if (peer == NULL) {
+            return;
+        }
+        addr = *peer;
+    }
+    if (addr.sin_family != AF_INET || addr.sin_port != bpf_htons(DNS_PORT)) {
+        return;
+    }
+
+    // sendmsg returns the total size of all the iovecs, while we only hold the first one.
+    if (args->buf_size > 0 && bytes_count > args->buf_size) {
+        bytes_count = args->buf_size;
+    }
+
+    uint32_t kZero = 0;
+    struct dns_event_t* event = dns_event_buffer_heap.lookup(&kZero);
+    if (event == NULL) {
+        return;
+    }
+
+    event->attr.timestamp_ns = bpf_ktime_get_ns();
+    event->attr.pid = pid;
+    event->attr.fd = args->fd;
+    event->attr.direction = direction;
+    event->attr.addr = addr;
+
+    // Same verifier hints as in perf_submit_buf.
+    size_t size_minus_1 = bytes_count - 1;
+    asm volatile("" : "+r"(size_minus_1) :);
+
+    size_t amount_copied = 0;
+    if (size_minus_1 < MAX_DNS_MSG_SIZE) {
+        bpf_probe_read(&event->msg, size_minus_1 + 1, args->buf);
+        amount_copied = size_minus_1 + 1;
+    } else {
+        bpf_probe_read(&event->msg, MAX_DNS_MSG_SIZE, args->buf);
+        amount_copied = MAX_DNS_MSG_SIZE;
+    }
+
+    if (amount_copied > 0) {
+        event->attr.msg_size = amount_copied;
+        dns_events.perf_submit(ctx, event, sizeof(event->attr) + amount_copied);
+    }
+}
+
+// Submits the message of a read/write syscall on a UDP socket connected to a DNS server, such as the ones of the Go
+// resolver. Other files are told apart by a lookup in the map of the DNS sockets.
+static inline __attribute__((__always_inline__)) void process_dns_data(struct pt_regs* ctx, uint64_t id,
+                                                                       enum traffic_direction_t direction,
+                                                                       const struct data_args_t* args, ssize_t bytes_count) {
+    struct dns_args_t dns_args = {};
+    dns_args.fd = args->fd;
+    dns_args.buf = args->buf;
+    process_dns(ctx, id, direction, &dns_args, bytes_count);
+}
+
 // Hooks
 int syscall__probe_entry_accept(struct pt_regs* ctx, int sockfd, struct sockaddr* addr, socklen_t* addrlen) {
     uint64_t id = bpf_get_current_pid_tgid();
@@ -441,6 +749,30 @@ int syscall__probe_ret_accept4(struct pt_regs* ctx) {
     return 0;
 }
 
+// original signature: int connect(int sockfd, const struct sockaddr *addr, socklen_t addrlen);
+int syscall__probe_entry_connect(struct pt_regs* ctx, int sockfd, struct sockaddr* addr, socklen_t addrlen) {
+    uint64_t id = bpf_get_current_pid_tgid();
+
+    struct connect_args_t connect_args = {};
+    connect_args.fd = sockfd;
+    connect_args.addr = (struct sockaddr_in *)addr;
+    active_connect_args_map.update(&id, &connect_args);
+
+    return 0;
+}
+
+int syscall__probe_ret_connect(struct pt_regs* ctx) {
+    uint64_t id = bpf_get_current_pid_tgid();
+
+    struct connect_args_t* connect_args = active_connect_args_map.lookup(&id);
+    if (connect_args != NULL) {
+        process_syscall_connect(ctx, id, connect_args);
+    }
+
+    active_connect_args_map.delete(&id);
+    return 0;
+}
+
 // original signature: ssize_t write(int fd, const void *buf, size_t count);
 int syscall__probe_entry_write(struct pt_regs* ctx, int fd, char* buf, size_t count) {
     uint64_t id = bpf_get_current_pid_tgid();
@@ -461,6 +793,7 @@ int syscall__probe_ret_write(struct pt_regs* ctx) {
     struct data_args_t* write_args = active_write_args_map.lookup(&id);
     if (write_args != NULL) {
         process_data(ctx, id, kEgress, write_args, bytes_count);
+        process_dns_data(ctx, id, kEgress, write_args, bytes_count);
     }
 
     active_write_args_map.delete(&id);
@@ -490,6 +823,7 @@ int syscall__probe_ret_read(struct pt_regs* ctx) {
         // kIngress is an enum value that let's the process_data function
         // to know whether the input buffer is incoming or outgoing.
         process_data(ctx, id, kIngress, read_args, bytes_count);
+        process_dns_data(ctx, id, kIngress, read_args, bytes_count);
     }
 
     active_read_args_map.delete(&id);
@@ -515,3 +849,144 @@ int syscall__probe_ret_close(struct pt_regs* ctx) {
     active_close_args_map.delete(&id);
     return 0;
 }
+
+// original signature: ssize_t sendto(int sockfd, const void *buf, size_t len, int flags,
+//                                    const struct sockaddr *dest_addr, socklen_t addrlen);
+int syscall__probe_entry_sendto(struct pt_regs* ctx, int sockfd, char* buf, size_t len, int flags,
+                                struct sockaddr* dest_addr, socklen_t addrlen) {
+    uint64_t id = bpf_get_current_pid_tgid();
+
+    struct dns_args_t dns_args = {};
+    dns_args.fd = sockfd;
+    dns_args.buf = buf;
+    dns_args.addr = (struct sockaddr_in *)dest_addr;
+    active_dns_args_map.update(&id, &dns_args);
+
+    return 0;
+}
+
+int syscall__probe_ret_sendto(struct pt_regs* ctx) {
+    uint64_t id = bpf_get_current_pid_tgid();
+    ssize_t bytes_count = PT_REGS_RC(ctx);
+
+    struct dns_args_t* dns_args = active_dns_args_map.lookup(&id);
+    if (dns_args != NULL) {
+        process_dns(ctx, id, kEgress, dns_args, bytes_count);
+    }
+
+    active_dns_args_map.delete(&id);
+    return 0;
+}
+
+// original signature: ssize_t recvfrom(int sockfd, void *buf, size_t len, int flags,
+//                                      struct sockaddr *src_addr, socklen_t *addrlen);
+int syscall__probe_entry_recvfrom(struct pt_regs* ctx, int sockfd, char* buf, size_t len, int flags,
+                                  struct sockaddr* src_addr, socklen_t* addrlen) {
+    uint64_t id = bpf_get_current_pid_tgid();
+
+    struct dns_args_t dns_args = {};
+    dns_args.fd = sockfd;
+    dns_args.buf = buf;
+    dns_args.addr = (struct sockaddr_in *)src_addr;
+    active_dns_args_map.update(&id, &dns_args);
+
+    return 0;
+}
+
+int syscall__probe_ret_recvfrom(struct pt_regs* ctx) {
+    uint64_t id = bpf_get_current_pid_tgid();
+    ssize_t bytes_count = PT_REGS_RC(ctx);
+
+    struct dns_args_t* dns_args = active_dns_args_map.lookup(&id);
+    if (dns_args != NULL) {
+        process_dns(ctx, id, kIngress, dns_args, bytes_count);
+    }
+
+    active_dns_args_map.delete(&id);
+    return 0;
+}
+
+// original signature: ssize_t sendmsg(int sockfd, const struct msghdr *msg, int flags);
+int syscall__probe_entry_sendmsg(struct pt_regs* ctx, int sockfd, const struct user_msghdr* msg, int flags) {
+    uint64_t id = bpf_get_current_pid_tgid();
+
+    struct user_msghdr msghdr = {};
+    bpf_probe_read(&msghdr, sizeof(msghdr), msg);
+    // Connected sockets have no destination address, their peer is read from the socket on exit.
+    if (msghdr.msg_iov == NULL) {
+        return 0;
+    }
+
+    // DNS clients send a single message per sendmsg, so the first iovec is enough.
+    struct iovec iov = {};
+    bpf_probe_read(&iov, sizeof(iov), msghdr.msg_iov);
+
+    struct dns_args_t dns_args = {};
+    dns_args.fd = sockfd;
+    dns_args.buf = iov.iov_base;
+    dns_args.buf_size = iov.iov_len;
+    dns_args.addr = (struct sockaddr_in *)msghdr.msg_name;
+    active_dns_args_map.update(&id, &dns_args);
+
+    return 0;
+}
+
+int syscall__probe_ret_sendmsg(struct pt_regs* ctx) {
+    uint64_t id = bpf_get_current_pid_tgid();
+    ssize_t bytes_count = PT_REGS_RC(ctx);
+
+    struct dns_args_t* dns_args = active_dns_args_map.lookup(&id);
+    if (dns_args != NULL) {
+        process_dns(ctx, id, kEgress, dns_args, bytes_count);
+    }
+
+    active_dns_args_map.delete(&id);
+    return 0;
+}
+
+// original signature: int sendmmsg(int sockfd, struct mmsghdr *msgvec, unsigned int vlen, int flags);
+int syscall__probe_entry_sendmmsg(struct pt_regs* ctx, int sockfd, struct mmsghdr* msgvec, unsigned int vlen, int flags) {
+    uint64_t id = bpf_get_current_pid_tgid();
+
+    struct dns_mmsg_args_t mmsg_args = {};
+    mmsg_args.fd = sockfd;
+    mmsg_args.msgvec = msgvec;
+    active_dns_mmsg_args_map.update(&id, &mmsg_args);
+
+    return 0;
+}
+
+int syscall__probe_ret_sendmmsg(struct pt_regs* ctx) {
+    uint64_t id = bpf_get_current_pid_tgid();
+    // The return code is the number of messages sent, the kernel sets the size of each in its msg_len.
+    int sent = PT_REGS_RC(ctx);
+
+    struct dns_mmsg_args_t* mmsg_args = active_dns_mmsg_args_map.lookup(&id);
+    if (mmsg_args != NULL && mmsg_args->msgvec != NULL) {
+        int i;
+#pragma unroll
+        for (i = 0; i < MAX_DNS_MMSG; ++i) {
+            if (i >= sent) {
+                break;
+            }
+            struct mmsghdr mmsg = {};
+            bpf_probe_read(&mmsg, sizeof(mmsg), &mmsg_args->msgvec[i]);
+            if (mmsg.msg_hdr.msg_iov == NULL) {
+                continue;
+            }
+            // DNS clients send a single iovec per message.
+            struct iovec iov = {};
+            bpf_probe_read(&iov, sizeof(iov), mmsg.msg_hdr.msg_iov);
+
+            struct dns_args_t dns_args = {};
+            dns_args.fd = mmsg_args->fd;
+            dns_args.buf = iov.iov_base;
+            dns_args.buf_size = iov.iov_len;
+            dns_args.addr = (struct sockaddr_in *)mmsg.msg_hdr.msg_name;
+            process_dns(ctx, id, kEgress, &dns_args, mmsg.msg_len);
+        }
+    }
+
+    active_dns_mmsg_args_map.delete(&id);
+    return 0;
+}
@@ -106,6 +106,18 @@ var (
 			Type:           ReturnType,
 			IsSyscall:      true,
 		},
+		{
+			FunctionToHook: "connect",
+			HookName:       "syscall__probe_entry_connect",
+			Type:           EntryType,
+			IsSyscall:      true,
+		},
+		{
+			FunctionToHook: "connect",
+			HookName:       "syscall__probe_ret_connect",
+			Type:           ReturnType,
+			IsSyscall:      true,
+		},
 		{
 			FunctionToHook: "write",
 			HookName:       "syscall__probe_entry_write",
@@ -142,5 +154,53 @@ var (
 			Type:           ReturnType,
 			IsSyscall:      true,
 		},
+		{
+			FunctionToHook: "sendto",
+			HookName:       "syscall__probe_entry_sendto",
+			Type:           EntryType,
+			IsSyscall:      true,
+		},
+		{
+			FunctionToHook: "sendto",
+			HookName:       "syscall__probe_ret_sendto",
+			Type:           ReturnType,
+			IsSyscall:      true,
+		},
+		{
+			FunctionToHook: "recvfrom",
+			HookName:       "syscall__probe_entry_recvfrom",
+			Type:           EntryType,
+			IsSyscall:      true,
+		},
+		{
+			FunctionToHook: "recvfrom",
+			HookName:       "syscall__probe_ret_recvfrom",
+			Type:           ReturnType,
+			IsSyscall:      true,
+		},
+		{
+			FunctionToHook: "sendmsg",
+			HookName:       "syscall__probe_entry_sendmsg",
+			Type:           EntryType,
+			IsSyscall:      true,
+		},
+		{
+			FunctionToHook: "sendmsg",
+			HookName:       "syscall__probe_ret_sendmsg",
+			Type:           ReturnType,
+			IsSyscall:      true,
+		},
+		{
+			FunctionToHook: "sendmmsg",
+			HookName:       "syscall__probe_entry_sendmmsg",
+			Type:           EntryType,
+			IsSyscall:      true,
+		},
+		{
+			FunctionToHook: "sendmmsg",
+			HookName:       "syscall__probe_ret_sendmmsg",
+			Type:           ReturnType,
+			IsSyscall:      true,
+		},
 	}
-)
\ No newline at end of file
+)
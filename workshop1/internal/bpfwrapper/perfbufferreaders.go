@@ -97,9 +97,11 @@ var (
 		NewProbeChannel("socket_data_events", socketDataEventCallback),
 		NewProbeChannel("socket_open_events", socketOpenEventCallback),
 		NewProbeChannel("socket_close_events", socketCloseEventCallback),
+		NewProbeChannel("dns_events", dnsEventCallback),
 	}
 
 	eventAttributesSize = int(unsafe.Sizeof(structs.SocketDataEventAttr{}))
+	dnsAttributesSize   = int(unsafe.Sizeof(structs.DNSEventAttr{}))
 )
 
 func socketDataEventCallback(inputChan chan []byte, connectionFactory *connections.Factory) {
@@ -163,3 +165,32 @@ func socketCloseEventCallback(inputChan chan []byte, connectionFactory *connecti
 		connectionFactory.GetOrCreate(event.ConnID).AddCloseEvent(event)
 	}
 }
+
+func dnsEventCallback(inputChan chan []byte, connectionFactory *connections.Factory) {
+	for data := range inputChan {
+		if data == nil {
+			return
+		}
+		if len(data) < dnsAttributesSize {
+			log.Printf("Buffer's for DNSEvent is smaller (%d) than the minimum required (%d)", len(data), dnsAttributesSize)
+			continue
+		} else if len(data) > structs.DNSMessageMaxSize+dnsAttributesSize {
+			log.Printf("Buffer's for DNSEvent is bigger (%d) than the maximum for the struct (%d)", len(data), structs.DNSMessageMaxSize+dnsAttributesSize)
+			continue
+		}
+		var event structs.DNSEvent
+
+		// Same as the data events, the message is mostly empty so we load the attributes separately.
+		if err := binary.Read(bytes.NewReader(data[:dnsAttributesSize]), bpf.GetHostByteOrder(), &event.Attr); err != nil {
+			log.Printf("Failed to decode received data: %+v", err)
+			continue
+		}
+		if dnsAttributesSize+int(event.Attr.MsgSize) > len(data) {
+			log.Printf("DNSEvent message size (%d) exceeds the received buffer (%d)", event.Attr.MsgSize, len(data))
+			continue
+		}
+		copy(event.Msg[:], data[dnsAttributesSize:dnsAttributesSize+int(event.Attr.MsgSize)])
+		event.Attr.TimestampNano += settings.GetRealTimeOffset()
+		connectionFactory.AddDNSEvent(event)
+	}
+}
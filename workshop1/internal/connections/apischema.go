@@ -1,26 +1,246 @@
 package connections
 
 import (
+	"net/http"
 	"sync"
 )
 
 type ApiSchema struct {
-	method         string
+	method string
+	// uri is the templated path of the endpoint.
 	uri            string
-	requestSchema  string
-	responseSchema string
-	containsPII    bool
+	pathParameters []PathParameter
+	// queryParameters, headers and cookies are keyed by their name.
+	queryParameters map[string]*ParameterStats
+	headers         map[string]*ParameterStats
+	responseHeaders map[string]*ParameterStats
+	cookies         map[string]*CookieStats
+	// operation distinguishes the entries that share a path, such as GraphQL operations and JSON-RPC methods.
+	operation string
+	// requestSchemas describes the request bodies by their media type, so bodies of different types are not blended.
+	// Bodies without a media type, such as GraphQL variables and JSON-RPC params, are kept under an empty one.
+	requestSchemas map[string]*Schema
+	// requestContentTypes counts the media types of the request bodies.
+	requestContentTypes map[string]uint64
+	// responseSchema describes the JSON bodies of the successful (2xx) responses.
+	responseSchema *Schema
+	// errorSchemas describes the JSON bodies of the error (4xx and 5xx) responses, per status code.
+	errorSchemas map[int]*Schema
+	statusCodes  map[int]uint64
+	// contentTypes counts the media types of the responses, per status code.
+	contentTypes map[int]map[string]uint64
+	// latency is the histogram of the time from the last byte of the requests to the first byte of the responses.
+	latency *LatencyHistogram
+	// containsPII is set once a field of the endpoint is classified as PII, piiFindings holds the fields by location,
+	// field and category.
+	containsPII bool
+	piiFindings map[string]*PIIFinding
+	// auth is the profile of the credentials the requests were authenticated with.
+	auth *AuthProfile
+	// hygiene holds the security header and cookie issues of the endpoint, by type and subject.
+	hygiene map[string]*HygieneFinding
+	// secrets holds the secrets that leaked in the transactions, by direction, location, field and type.
+	secrets map[string]*SecretFinding
+	// objects tracks which caller identities read which objects, by the templated segments of the path.
+	objects *ObjectAccess
+	// authFailures counts the authentication failures of the endpoint, by peer address.
+	authFailures map[string]*AuthFailureCounter
+	// samples is the number of transactions merged into the schemas.
+	samples uint64
+	// requests is the number of requests the parameters were recorded from, including the WebSocket handshakes that
+	// have no schemas to merge.
+	requests uint64
+	// graphql is set for the entries of GraphQL operations.
+	graphql *GraphQLOperation
+	// jsonRPC is set for the entries of JSON-RPC methods.
+	jsonRPC *JSONRPCMethod
+	// websocket is set for endpoints that upgrade the connection to WebSocket.
+	websocket *WebSocketStats
 
 	mutex sync.RWMutex
 }
 
-func NewApiSchema(method string, uri string, requestSchema string, responseSchema string, containsPII bool) *ApiSchema {
-	return &ApiSchema{
-		method:         method,
-		uri:            uri,
-		requestSchema:  requestSchema,
-		responseSchema: responseSchema,
-		containsPII:    containsPII,
-		mutex:          sync.RWMutex{},
+func NewApiSchema(method string, uri string, requestSchema *Schema, responseSchema *Schema, containsPII bool) *ApiSchema {
+	schema := &ApiSchema{
+		method:              method,
+		uri:                 uri,
+		requestSchemas:      make(map[string]*Schema),
+		responseSchema:      responseSchema,
+		containsPII:         containsPII,
+		requestContentTypes: make(map[string]uint64),
+		errorSchemas:        make(map[int]*Schema),
+		statusCodes:         make(map[int]uint64),
+		contentTypes:        make(map[int]map[string]uint64),
+		latency:             NewLatencyHistogram(),
+		queryParameters:     make(map[string]*ParameterStats),
+		headers:             make(map[string]*ParameterStats),
+		responseHeaders:     make(map[string]*ParameterStats),
+		cookies:             make(map[string]*CookieStats),
+		piiFindings:         make(map[string]*PIIFinding),
+		secrets:             make(map[string]*SecretFinding),
+		auth:                NewAuthProfile(),
+		hygiene:             make(map[string]*HygieneFinding),
+		objects:             NewObjectAccess(),
+		authFailures:        make(map[string]*AuthFailureCounter),
+		mutex:               sync.RWMutex{},
+	}
+	if requestSchema != nil {
+		schema.requestSchemas[""] = requestSchema
+	}
+	return schema
+}
+
+// addSample merges the schemas of another transaction into the schemas of the endpoint. The request schema is merged
+// with the bodies of the same media type.
+func (schema *ApiSchema) addSample(requestType string, requestSchema *Schema, responseSchema *Schema) {
+	schema.mutex.Lock()
+	defer schema.mutex.Unlock()
+	schema.samples++
+	if requestSchema != nil {
+		schema.requestSchemas[requestType] = mergeSchemas(schema.requestSchemas[requestType], requestSchema)
+	}
+	schema.responseSchema = mergeSchemas(schema.responseSchema, responseSchema)
+}
+
+// addOperationSample adds the sample of a single operation of a request, such as a GraphQL operation, whose bodies
+// carry no media type of their own. Like the samples of the endpoints, only the successful responses take part in the
+// response schema, and the rejected requests do not take part in the request schema.
+func (schema *ApiSchema) addOperationSample(res *http.Response, requestSchema *Schema, responseSchema *Schema) {
+	switch {
+	case res.StatusCode >= http.StatusBadRequest:
+		schema.addSample("", nil, nil)
+	case res.StatusCode < http.StatusOK || res.StatusCode >= http.StatusMultipleChoices:
+		schema.addSample("", requestSchema, nil)
+	default:
+		schema.addSample("", requestSchema, responseSchema)
+	}
+}
+
+// jsonRequestSchema returns the schema of the JSON request bodies of the endpoint, including the bodies without a
+// media type.
+func (schema *ApiSchema) jsonRequestSchema() *Schema {
+	var merged *Schema
+	for mediaType, requestSchema := range schema.requestSchemas {
+		if mediaType == "" || isJSONMediaType(mediaType) {
+			merged = mergeSchemas(merged, requestSchema.clone())
+		}
+	}
+	return merged
+}
+
+// addResponse records the status code, media type, headers and cookies of another response of the endpoint. The
+// schema of the body, if any, is kept for error responses.
+func (schema *ApiSchema) addResponse(res *http.Response, bodySchema *Schema) {
+	schema.addResponseHeaders(res)
+	statusCode := res.StatusCode
+	contentType := responseMediaType(res)
+
+	schema.mutex.Lock()
+	defer schema.mutex.Unlock()
+	schema.statusCodes[statusCode]++
+	if contentType != "" {
+		if _, ok := schema.contentTypes[statusCode]; !ok {
+			schema.contentTypes[statusCode] = make(map[string]uint64)
+		}
+		schema.contentTypes[statusCode][contentType]++
+	}
+	if statusCode >= http.StatusBadRequest && bodySchema != nil {
+		schema.errorSchemas[statusCode] = mergeSchemas(schema.errorSchemas[statusCode], bodySchema)
+	}
+}
+
+// addRequestContentType records the media type of another request body of the endpoint.
+func (schema *ApiSchema) addRequestContentType(contentType string) {
+	if contentType == "" {
+		return
+	}
+	schema.mutex.Lock()
+	defer schema.mutex.Unlock()
+	schema.requestContentTypes[contentType]++
+}
+
+// addLatency adds the server latency of another transaction of the endpoint, if it could be timed.
+func (schema *ApiSchema) addLatency(timing transactionTiming) {
+	latency, ok := timing.serverLatency()
+	if !ok {
+		return
+	}
+	schema.mutex.Lock()
+	defer schema.mutex.Unlock()
+	schema.latency.add(latency)
+}
+
+// inventoryKey returns the key of the endpoint in the api inventory.
+func (schema *ApiSchema) inventoryKey() string {
+	key := schema.method + "_" + schema.uri
+	if schema.operation != "" {
+		key += "#" + schema.operation
+	}
+	return key
+}
+
+// addPathParameters merges the path parameters of another transaction into the parameters of the endpoint.
+func (schema *ApiSchema) addPathParameters(parameters []PathParameter) {
+	schema.mutex.Lock()
+	defer schema.mutex.Unlock()
+	if schema.pathParameters == nil {
+		schema.pathParameters = parameters
+		return
+	}
+	schema.pathParameters = mergePathParameters(schema.pathParameters, parameters)
+}
+
+// merge merges another entry of the same endpoint, such as an entry recorded before its path was templated.
+func (schema *ApiSchema) merge(other *ApiSchema) {
+	schema.mutex.Lock()
+	defer schema.mutex.Unlock()
+	schema.samples += other.samples
+	schema.requests += other.requests
+	for mediaType, requestSchema := range other.requestSchemas {
+		schema.requestSchemas[mediaType] = mergeSchemas(schema.requestSchemas[mediaType], requestSchema)
+	}
+	schema.responseSchema = mergeSchemas(schema.responseSchema, other.responseSchema)
+	schema.containsPII = schema.containsPII || other.containsPII
+	mergePIIFindings(schema.piiFindings, sortedPIIFindings(other.piiFindings))
+	mergeSecretFindings(schema.secrets, other.secrets)
+	schema.auth.merge(other.auth)
+	mergeHygieneFindings(schema.hygiene, other.hygiene)
+	schema.objects.merge(other.objects)
+	mergeAuthFailures(schema.authFailures, other.authFailures)
+	for contentType, count := range other.requestContentTypes {
+		schema.requestContentTypes[contentType] += count
+	}
+	for statusCode, errorSchema := range other.errorSchemas {
+		schema.errorSchemas[statusCode] = mergeSchemas(schema.errorSchemas[statusCode], errorSchema)
+	}
+	for statusCode, count := range other.statusCodes {
+		schema.statusCodes[statusCode] += count
+	}
+	for statusCode, contentTypes := range other.contentTypes {
+		if _, ok := schema.contentTypes[statusCode]; !ok {
+			schema.contentTypes[statusCode] = make(map[string]uint64)
+		}
+		for contentType, count := range contentTypes {
+			schema.contentTypes[statusCode][contentType] += count
+		}
+	}
+	schema.latency.merge(other.latency)
+	schema.pathParameters = mergePathParameters(schema.pathParameters, other.pathParameters)
+	mergeParameters(schema.queryParameters, other.queryParameters)
+	mergeParameters(schema.headers, other.headers)
+	mergeParameters(schema.responseHeaders, other.responseHeaders)
+	mergeCookies(schema.cookies, other.cookies)
+	if schema.graphql == nil {
+		schema.graphql = other.graphql
+	}
+	if schema.jsonRPC == nil {
+		schema.jsonRPC = other.jsonRPC
+	} else if other.jsonRPC != nil {
+		schema.jsonRPC.merge(other.jsonRPC)
+	}
+	if schema.websocket == nil {
+		schema.websocket = other.websocket
+	} else if other.websocket != nil {
+		schema.websocket.merge(other.websocket)
 	}
 }
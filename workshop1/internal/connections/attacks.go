@@ -0,0 +1,241 @@
+package connections
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	attackEventCategory = "attack"
+
+	attackSQLInjection     = "sql_injection"
+	attackXSS              = "xss"
+	attackPathTraversal    = "path_traversal"
+	attackCommandInjection = "command_injection"
+	attackSSRF             = "ssrf"
+	attackLog4Shell        = "log4shell"
+
+	attackLocationPath   = "path"
+	attackLocationQuery  = "query"
+	attackLocationHeader = "header"
+	attackLocationCookie = "cookie"
+	attackLocationBody   = "body"
+
+	// maxAttackScanSize bounds the size of the request bodies we scan.
+	maxAttackScanSize = 256 * 1024
+	// maxAttackEvidenceLength bounds the length of the matched text reported with an event.
+	maxAttackEvidenceLength = 128
+	// maxURLDecodings bounds the rounds of URL decoding of a value, to uncover doubly encoded payloads.
+	maxURLDecodings = 3
+)
+
+// attackSignature detects an attack technique in a decoded value.
+type attackSignature struct {
+	attackType string
+	severity   string
+	pattern    *regexp.Regexp
+}
+
+var attackSignatures = []attackSignature{
+	{attackSQLInjection, eventSeverityWarning, regexp.MustCompile(`(?i)\bunion\b(?:\s|/\*.*?\*/)+(?:all\s+|distinct\s+)?select\b`)},
+	{attackSQLInjection, eventSeverityWarning, regexp.MustCompile(`(?i)['"]\s*(?:or|and)\s+['"]?\w+['"]?\s*(?:=|like)\s*['"]?\w+`)},
+	{attackSQLInjection, eventSeverityWarning, regexp.MustCompile(`(?i);\s*(?:drop|truncate|alter)\s+table\b|;\s*(?:delete\s+from|insert\s+into|update\s+\w+\s+set)\b`)},
+	{attackSQLInjection, eventSeverityWarning, regexp.MustCompile(`(?i)\b(?:sleep|benchmark|pg_sleep)\s*\(\s*\d|\bwaitfor\s+delay\b|\binformation_schema\b`)},
+	{attackXSS, eventSeverityWarning, regexp.MustCompile(`(?i)<\s*script\b|\bjavascript\s*:`)},
+	{attackXSS, eventSeverityWarning, regexp.MustCompile(`(?i)<\s*(?:img|svg|iframe|body|input|a|div)\b[^>]*\bon[a-z]+\s*=`)},
+	{attackPathTraversal, eventSeverityWarning, regexp.MustCompile(`(?:^|[/\\])\.\.[/\\]`)},
+	{attackPathTraversal, eventSeverityWarning, regexp.MustCompile(`(?i)/etc/(?:passwd|shadow)\b|/proc/self/|\bc:\\windows\\|\bboot\.ini\b`)},
+	{attackCommandInjection, eventSeverityHigh, regexp.MustCompile("(?i)(?:;|\\|\\|?|&&|\\$\\(|`)\\s*(?:cat|ls|id|whoami|uname|wget|curl|nc|ncat|bash|sh|python[0-9.]*|perl|ping|nslookup|powershell)\\b")},
+	{attackSSRF, eventSeverityHigh, regexp.MustCompile(`(?i)\b(?:https?|gopher|dict|ftp|ldap)://(?:[^/@\s]*@)?(?:localhost|127(?:\.\d{1,3}){3}|0\.0\.0\.0|0x7f[0-9a-f]*|10(?:\.\d{1,3}){3}|192\.168(?:\.\d{1,3}){2}|172\.(?:1[6-9]|2\d|3[01])(?:\.\d{1,3}){2}|169\.254\.169\.254|metadata\.google\.internal|\[::1?\])(?:[:/?#]|$)`)},
+	{attackSSRF, eventSeverityHigh, regexp.MustCompile(`(?i)\bfile:///`)},
+	{attackLog4Shell, eventSeverityHigh, regexp.MustCompile(`(?i)\$\{jndi:(?:ldaps?|rmi|dns|iiop|https?|nis|nds|corba)\b`)},
+}
+
+// log4ShellLookup matches the nested lookups attackers use to hide ${jndi:, such as ${${::-j}ndi: or ${lower:J}.
+var log4ShellLookup = regexp.MustCompile(`(?i)\$\{(?:::-|lower:|upper:|env:[^:}]*:-|sys:[^:}]*:-)([^${}]*)\}`)
+
+// decodedVariants returns the forms of a value the signatures are evaluated on: the value as is, URL decoded as long
+// as decoding changes it, and with the nested Log4j lookups resolved.
+func decodedVariants(value string) []string {
+	variants := []string{value}
+	for i := 0; i < maxURLDecodings; i++ {
+		decoded, err := url.QueryUnescape(value)
+		if err != nil || decoded == value {
+			break
+		}
+		value = decoded
+		variants = append(variants, value)
+	}
+	if strings.Contains(value, "${") {
+		for i := 0; i < maxSchemaDepth && log4ShellLookup.MatchString(value); i++ {
+			value = log4ShellLookup.ReplaceAllString(value, "$1")
+		}
+		variants = append(variants, value)
+	}
+	return variants
+}
+
+// attackMatch is a signature matched in a part of a request.
+type attackMatch struct {
+	attackType string
+	severity   string
+	location   string
+	field      string
+	evidence   string
+}
+
+// attackScanner gathers the attacks of a request, one match per attack type and field.
+type attackScanner struct {
+	matches map[string]*attackMatch
+}
+
+func (scanner *attackScanner) scan(location string, field string, value string) {
+	if value == "" {
+		return
+	}
+	for _, variant := range decodedVariants(value) {
+		for _, signature := range attackSignatures {
+			key := signature.attackType + "|" + location + "|" + field
+			if _, ok := scanner.matches[key]; ok {
+				continue
+			}
+			evidence := signature.pattern.FindString(variant)
+			if evidence == "" {
+				continue
+			}
+			if len(evidence) > maxAttackEvidenceLength {
+				evidence = evidence[:maxAttackEvidenceLength]
+			}
+			scanner.matches[key] = &attackMatch{
+				attackType: signature.attackType,
+				severity:   signature.severity,
+				location:   location,
+				field:      field,
+				evidence:   evidence,
+			}
+		}
+	}
+}
+
+func (scanner *attackScanner) scanJSONValue(field string, value interface{}, depth int) {
+	if depth > maxSchemaDepth {
+		return
+	}
+	switch typedValue := value.(type) {
+	case string:
+		scanner.scan(attackLocationBody, field, typedValue)
+	case []interface{}:
+		for _, item := range typedValue {
+			scanner.scanJSONValue(field+"[]", item, depth+1)
+		}
+	case map[string]interface{}:
+		for key, property := range typedValue {
+			// Attackers inject into the names of the fields as well.
+			scanner.scan(attackLocationBody, field+"."+key, key)
+			scanner.scanJSONValue(field+"."+key, property, depth+1)
+		}
+	}
+}
+
+// scanBody scans the values of JSON and URL encoded bodies, and the text of the other bodies.
+func (scanner *attackScanner) scanBody(mediaType string, body []byte) {
+	if len(body) == 0 || len(body) > maxAttackScanSize {
+		return
+	}
+	switch {
+	case mediaType == "" || isJSONMediaType(mediaType):
+		var value interface{}
+		if err := json.NewDecoder(bytes.NewReader(body)).Decode(&value); err == nil {
+			scanner.scanJSONValue("$", value, 0)
+			return
+		}
+	case mediaType == mediaTypeForm:
+		if form, err := url.ParseQuery(string(bytes.TrimSpace(body))); err == nil {
+			for name, values := range form {
+				for _, value := range values {
+					scanner.scan(attackLocationBody, "$."+name, value)
+				}
+			}
+			return
+		}
+	}
+	if bytes.IndexByte(body, 0) != -1 {
+		// Binary bodies, such as uploaded files.
+		return
+	}
+	scanner.scan(attackLocationBody, "", string(body))
+}
+
+// scanTransaction scans the path, the query parameters, the headers, the cookies and the body of a request.
+func scanTransaction(transaction *httpTransaction) []*attackMatch {
+	req := transaction.req
+	scanner := &attackScanner{matches: make(map[string]*attackMatch)}
+	scanner.scan(attackLocationPath, "", req.URL.EscapedPath())
+	if req.URL.RawQuery != "" {
+		for _, pair := range strings.Split(req.URL.RawQuery, "&") {
+			name, value := pair, ""
+			if index := strings.IndexByte(pair, '='); index != -1 {
+				name, value = pair[:index], pair[index+1:]
+			}
+			scanner.scan(attackLocationQuery, name, name)
+			scanner.scan(attackLocationQuery, name, value)
+		}
+	}
+	for name, values := range req.Header {
+		if name == "Cookie" {
+			continue
+		}
+		for _, value := range values {
+			scanner.scan(attackLocationHeader, name, value)
+		}
+	}
+	for _, cookie := range req.Cookies() {
+		scanner.scan(attackLocationCookie, cookie.Name, cookie.Value)
+	}
+	requestType, _ := parseContentType(req.Header)
+	scanner.scanBody(requestType, transaction.requestBody)
+
+	matches := make([]*attackMatch, 0, len(scanner.matches))
+	for _, match := range scanner.matches {
+		matches = append(matches, match)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].attackType != matches[j].attackType {
+			return matches[i].attackType < matches[j].attackType
+		}
+		return matches[i].location+matches[i].field < matches[j].location+matches[j].field
+	})
+	return matches
+}
+
+// detectAttacks evaluates a request against the attack signatures, and reports every match with the process that
+// served the request and the peer that sent it. The matched text is reported with its sensitive values redacted.
+func (factory *Factory) detectAttacks(transaction *httpTransaction) {
+	matches := scanTransaction(transaction)
+	if len(matches) == 0 {
+		return
+	}
+	path, _ := factory.paths.Template(transaction.req.URL.Path)
+	for _, match := range matches {
+		factory.events.Emit(Event{
+			Category: attackEventCategory,
+			Type:     match.attackType,
+			Severity: match.severity,
+			Method:   transaction.req.Method,
+			Path:     path,
+			Message:  "request matches " + strings.Replace(match.attackType, "_", " ", -1) + " signatures",
+			Details: map[string]interface{}{
+				"pid":      transaction.pid,
+				"peer":     factory.peerName(transaction.peer),
+				"location": match.location,
+				"field":    match.field,
+				"evidence": factory.redactor.redactText(factory.pii, match.evidence),
+				"status":   transaction.res.StatusCode,
+			},
+		})
+	}
+}
@@ -0,0 +1,396 @@
+package connections
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	authSchemeJWT           = "bearer_jwt"
+	authSchemeOpaqueBearer  = "bearer_opaque"
+	authSchemeBasic         = "basic"
+	authSchemeAPIKey        = "api_key"
+	authSchemeSessionCookie = "session_cookie"
+	authSchemeMTLS          = "mtls"
+	authSchemeNone          = "none"
+
+	authEventCategory          = "auth"
+	authFindingAlgNone         = "jwt_alg_none"
+	authFindingWeakKey         = "jwt_weak_key"
+	authFindingMissingExpiry   = "jwt_missing_expiry"
+	authFindingLongLived       = "jwt_long_lived"
+	authFindingExpiredAccepted = "jwt_expired_accepted"
+	authFindingUnauthenticated = "unauthenticated_access"
+
+	// maxJWTLifetime is the lifetime from which tokens are reported as long lived.
+	maxJWTLifetime = 24 * time.Hour
+	// maxAuthValuesPerEndpoint bounds the distinct algorithms, issuers, audiences and scopes we keep per endpoint.
+	maxAuthValuesPerEndpoint = 64
+)
+
+var (
+	// weakJWTSecrets are the secrets HMAC signed tokens are checked against, the defaults of frameworks and tutorials.
+	weakJWTSecrets = []string{"", "secret", "secretkey", "secret-key", "your-256-bit-secret", "your-secret-key",
+		"jwt_secret", "jwtsecret", "changeme", "password", "123456", "key", "test", "admin", "default", "shhhhh"}
+	jwtHashes = map[string]func() hash.Hash{"HS256": sha256.New, "HS384": sha512.New384, "HS512": sha512.New}
+
+	// apiKeyNames and bearerParameterNames are the normalized names of the headers and query parameters that carry
+	// credentials.
+	apiKeyNames          = map[string]struct{}{"apikey": {}, "xapikey": {}, "apitoken": {}, "xapitoken": {}, "xauthtoken": {}, "xaccesstoken": {}}
+	bearerParameterNames = map[string]struct{}{"accesstoken": {}, "token": {}, "idtoken": {}}
+	// mtlsHeaders are set by the proxies that terminate mutual TLS, to pass the client certificate on.
+	mtlsHeaders = []string{"X-Client-Cert", "X-Ssl-Client-Cert", "X-Forwarded-Client-Cert", "Ssl-Client-Cert", "X-Client-Dn"}
+)
+
+// jwtToken is a decoded, unverified JSON web token.
+type jwtToken struct {
+	header map[string]interface{}
+	claims map[string]interface{}
+	// signingInput is the part of the token the signature is computed on.
+	signingInput string
+	signature    []byte
+}
+
+func decodeJWTSegment(segment string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+}
+
+// parseJWT decodes the header and the claims of a token, without verifying its signature. It returns false if the
+// value is not a JWT.
+func parseJWT(value string) (*jwtToken, bool) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	token := &jwtToken{signingInput: parts[0] + "." + parts[1]}
+	for i, target := range []*map[string]interface{}{&token.header, &token.claims} {
+		decoded, err := decodeJWTSegment(parts[i])
+		if err != nil || json.Unmarshal(decoded, target) != nil || *target == nil {
+			return nil, false
+		}
+	}
+	token.signature, _ = decodeJWTSegment(parts[2])
+	return token, true
+}
+
+func (token *jwtToken) algorithm() string {
+	algorithm, _ := token.header["alg"].(string)
+	return algorithm
+}
+
+func (token *jwtToken) stringClaim(name string) string {
+	value, _ := token.claims[name].(string)
+	return value
+}
+
+// stringsClaim returns a claim that holds either a string or an array of strings, such as aud.
+func (token *jwtToken) stringsClaim(name string) []string {
+	switch value := token.claims[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, item := range value {
+			if text, ok := item.(string); ok {
+				values = append(values, text)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// scopes returns the scopes of the token, from the space separated scope claim (RFC 8693) or the scp claim.
+func (token *jwtToken) scopes() []string {
+	if scope := token.stringClaim("scope"); scope != "" {
+		return strings.Fields(scope)
+	}
+	if scp := token.stringsClaim("scp"); len(scp) == 1 {
+		return strings.Fields(scp[0])
+	} else if len(scp) > 1 {
+		return scp
+	}
+	return token.stringsClaim("scopes")
+}
+
+func (token *jwtToken) timeClaim(name string) (time.Time, bool) {
+	seconds, ok := token.claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// weakKey returns the secret an HMAC signed token was signed with, if it is one of the weak secrets.
+func (token *jwtToken) weakKey() (string, bool) {
+	newHash, ok := jwtHashes[token.algorithm()]
+	if !ok {
+		return "", false
+	}
+	for _, secret := range weakJWTSecrets {
+		mac := hmac.New(newHash, []byte(secret))
+		mac.Write([]byte(token.signingInput))
+		if hmac.Equal(mac.Sum(nil), token.signature) {
+			return secret, true
+		}
+	}
+	return "", false
+}
+
+// findings returns the hygiene issues of a token, observed at the given time in a transaction that was answered with
+// the given status code.
+func (token *jwtToken) findings(now time.Time, statusCode int) []string {
+	findings := make([]string, 0)
+	if strings.EqualFold(token.algorithm(), "none") {
+		findings = append(findings, authFindingAlgNone)
+	}
+	if _, ok := token.weakKey(); ok {
+		findings = append(findings, authFindingWeakKey)
+	}
+	expiry, ok := token.timeClaim("exp")
+	if !ok {
+		return append(findings, authFindingMissingExpiry)
+	}
+	issuedAt, ok := token.timeClaim("iat")
+	if !ok {
+		issuedAt = now
+	}
+	if expiry.Sub(issuedAt) > maxJWTLifetime {
+		findings = append(findings, authFindingLongLived)
+	}
+	if expiry.Before(now) && statusCode >= http.StatusOK && statusCode < http.StatusMultipleChoices {
+		findings = append(findings, authFindingExpiredAccepted)
+	}
+	return findings
+}
+
+// requestCredentials holds the authentication schemes of a request, and the JWTs it carries.
+type requestCredentials struct {
+	schemes []string
+	tokens  []*jwtToken
+}
+
+func (credentials *requestCredentials) add(scheme string) {
+	for _, existing := range credentials.schemes {
+		if existing == scheme {
+			return
+		}
+	}
+	credentials.schemes = append(credentials.schemes, scheme)
+}
+
+// addBearer adds a bearer token, which is either a JWT or an opaque token.
+func (credentials *requestCredentials) addBearer(value string) {
+	if token, ok := parseJWT(value); ok {
+		credentials.add(authSchemeJWT)
+		credentials.tokens = append(credentials.tokens, token)
+		return
+	}
+	credentials.add(authSchemeOpaqueBearer)
+}
+
+func isSessionCookieName(name string) bool {
+	normalizedName := normalizeFieldName(name)
+	return strings.Contains(normalizedName, "session") || normalizedName == "sid" ||
+		strings.HasSuffix(normalizedName, "sid") || strings.HasSuffix(normalizedName, "token")
+}
+
+// extractCredentials detects how a request is authenticated, by its headers, query parameters and cookies.
+func extractCredentials(req *http.Request) *requestCredentials {
+	credentials := &requestCredentials{}
+	for _, name := range []string{"Authorization", "Proxy-Authorization"} {
+		value := strings.TrimSpace(req.Header.Get(name))
+		if value == "" {
+			continue
+		}
+		scheme, parameter := value, ""
+		if index := strings.IndexByte(value, ' '); index != -1 {
+			scheme, parameter = value[:index], strings.TrimSpace(value[index+1:])
+		}
+		switch strings.ToLower(scheme) {
+		case "bearer":
+			credentials.addBearer(parameter)
+		case "basic":
+			credentials.add(authSchemeBasic)
+		default:
+			credentials.add(strings.ToLower(scheme))
+		}
+	}
+	for name := range req.Header {
+		if _, ok := apiKeyNames[normalizeFieldName(name)]; ok {
+			credentials.add(authSchemeAPIKey)
+		}
+	}
+	for name, values := range req.URL.Query() {
+		normalizedName := normalizeFieldName(name)
+		if _, ok := apiKeyNames[normalizedName]; ok {
+			credentials.add(authSchemeAPIKey)
+		} else if _, ok := bearerParameterNames[normalizedName]; ok && len(values) > 0 {
+			credentials.addBearer(values[0])
+		}
+	}
+	for _, cookie := range req.Cookies() {
+		if token, ok := parseJWT(cookie.Value); ok {
+			credentials.add(authSchemeSessionCookie)
+			credentials.tokens = append(credentials.tokens, token)
+		} else if isSessionCookieName(cookie.Name) {
+			credentials.add(authSchemeSessionCookie)
+		}
+	}
+	for _, name := range mtlsHeaders {
+		if req.Header.Get(name) != "" {
+			credentials.add(authSchemeMTLS)
+		}
+	}
+	if len(credentials.schemes) == 0 {
+		credentials.add(authSchemeNone)
+	}
+	return credentials
+}
+
+// AuthProfile aggregates how the requests of an endpoint are authenticated, and the JWTs they carry.
+type AuthProfile struct {
+	schemes    map[string]uint64
+	algorithms map[string]uint64
+	issuers    map[string]uint64
+	audiences  map[string]uint64
+	scopes     map[string]uint64
+	// findings counts the token hygiene issues, by type.
+	findings map[string]uint64
+}
+
+// NewAuthProfile creates a new instance of the auth profile.
+func NewAuthProfile() *AuthProfile {
+	return &AuthProfile{
+		schemes:    make(map[string]uint64),
+		algorithms: make(map[string]uint64),
+		issuers:    make(map[string]uint64),
+		audiences:  make(map[string]uint64),
+		scopes:     make(map[string]uint64),
+		findings:   make(map[string]uint64),
+	}
+}
+
+func countAuthValue(values map[string]uint64, value string, count uint64) {
+	if _, ok := values[value]; ok || len(values) < maxAuthValuesPerEndpoint {
+		values[value] += count
+	}
+}
+
+func mergeAuthValues(current map[string]uint64, other map[string]uint64) {
+	for value, count := range other {
+		countAuthValue(current, value, count)
+	}
+}
+
+func (profile *AuthProfile) merge(other *AuthProfile) {
+	mergeAuthValues(profile.schemes, other.schemes)
+	mergeAuthValues(profile.algorithms, other.algorithms)
+	mergeAuthValues(profile.issuers, other.issuers)
+	mergeAuthValues(profile.audiences, other.audiences)
+	mergeAuthValues(profile.scopes, other.scopes)
+	mergeAuthValues(profile.findings, other.findings)
+}
+
+func (profile *AuthProfile) String() string {
+	parts := []string{fmt.Sprintf("schemes=%v", profile.schemes)}
+	for _, values := range []struct {
+		name   string
+		values map[string]uint64
+	}{
+		{"algorithms", profile.algorithms},
+		{"issuers", profile.issuers},
+		{"audiences", profile.audiences},
+		{"scopes", profile.scopes},
+		{"findings", profile.findings},
+	} {
+		if len(values.values) > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%v", values.name, values.values))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// addCredentials records the credentials of another request of the endpoint. It returns the findings that were not
+// recorded for the endpoint before.
+func (schema *ApiSchema) addCredentials(credentials *requestCredentials, now time.Time, statusCode int) []string {
+	schema.mutex.Lock()
+	defer schema.mutex.Unlock()
+	profile := schema.auth
+	for _, scheme := range credentials.schemes {
+		countAuthValue(profile.schemes, scheme, 1)
+	}
+	added := make([]string, 0)
+	for _, token := range credentials.tokens {
+		countAuthValue(profile.algorithms, token.algorithm(), 1)
+		if issuer := token.stringClaim("iss"); issuer != "" {
+			countAuthValue(profile.issuers, issuer, 1)
+		}
+		for _, audience := range token.stringsClaim("aud") {
+			countAuthValue(profile.audiences, audience, 1)
+		}
+		for _, scope := range token.scopes() {
+			countAuthValue(profile.scopes, scope, 1)
+		}
+		for _, finding := range token.findings(now, statusCode) {
+			if profile.findings[finding] == 0 {
+				added = append(added, finding)
+			}
+			profile.findings[finding]++
+		}
+	}
+	successful := statusCode >= http.StatusOK && statusCode < http.StatusMultipleChoices
+	if credentials.schemes[0] == authSchemeNone && successful {
+		if profile.findings[authFindingUnauthenticated] == 0 {
+			added = append(added, authFindingUnauthenticated)
+		}
+		profile.findings[authFindingUnauthenticated]++
+	}
+	return added
+}
+
+var authFindingSeverities = map[string]string{
+	authFindingAlgNone:         eventSeverityHigh,
+	authFindingWeakKey:         eventSeverityHigh,
+	authFindingExpiredAccepted: eventSeverityHigh,
+	authFindingMissingExpiry:   eventSeverityWarning,
+	authFindingLongLived:       eventSeverityWarning,
+	authFindingUnauthenticated: eventSeverityInfo,
+}
+
+var authFindingMessages = map[string]string{
+	authFindingAlgNone:         "JWT sent with the none algorithm",
+	authFindingWeakKey:         "JWT signed with a weak, well known secret",
+	authFindingExpiredAccepted: "expired JWT accepted",
+	authFindingMissingExpiry:   "JWT without expiry",
+	authFindingLongLived:       fmt.Sprintf("JWT valid for more than %v", maxJWTLifetime),
+	authFindingUnauthenticated: "endpoint served a request without credentials",
+}
+
+// inspectAuth records how a request of the endpoint is authenticated, and reports the token hygiene issues once per
+// endpoint. The expiry of the tokens is checked at the time the transaction was captured at.
+func (factory *Factory) inspectAuth(schema *ApiSchema, req *http.Request, res *http.Response, capturedAt time.Time) {
+	credentials := extractCredentials(req)
+	added := schema.addCredentials(credentials, capturedAt, res.StatusCode)
+	sort.Strings(added)
+	for _, finding := range added {
+		factory.events.Emit(Event{
+			Category: authEventCategory,
+			Type:     finding,
+			Severity: authFindingSeverities[finding],
+			Method:   schema.method,
+			Path:     schema.uri,
+			Message:  authFindingMessages[finding],
+			Details:  map[string]interface{}{"schemes": credentials.schemes},
+		})
+	}
+}
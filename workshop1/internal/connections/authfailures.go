@@ -0,0 +1,314 @@
+package connections
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	authFindingFailuresExceeded = "auth_failures_exceeded"
+
+	authFailureUnauthorized = "unauthorized"
+	authFailureForbidden    = "forbidden"
+	authFailureLogin        = "login_error"
+
+	// maxAuthFailurePeersPerEndpoint bounds the peers we count the authentication failures of per endpoint.
+	maxAuthFailurePeersPerEndpoint = 1024
+	// maxAuthFailureTimestamps bounds the failures we keep per peer, in the longest window.
+	maxAuthFailureTimestamps = 4096
+)
+
+// DefaultAuthFailureThresholds alert on 10 failures of a peer in a minute, or 100 in an hour.
+const DefaultAuthFailureThresholds = "10/1m,100/1h"
+
+// loginSegments are the normalized path segments of the endpoints credentials are submitted to.
+var loginSegments = map[string]struct{}{
+	"login": {}, "signin": {}, "logon": {}, "authenticate": {}, "auth": {}, "token": {}, "session": {}, "sessions": {},
+}
+
+// loginErrorPattern matches the messages login endpoints reject credentials with.
+var loginErrorPattern = regexp.MustCompile(`(?i)invalid (?:credentials|password|username|login)|incorrect (?:password|username)|(?:authentication|login) failed|wrong password`)
+
+// AuthFailureThreshold alerts when a peer fails to authenticate to an endpoint Count times within Window.
+type AuthFailureThreshold struct {
+	Count  int
+	Window time.Duration
+}
+
+func (threshold AuthFailureThreshold) String() string {
+	return fmt.Sprintf("%d/%v", threshold.Count, threshold.Window)
+}
+
+// ParseAuthFailureThresholds parses comma separated thresholds, each a count of failures and a window, such as
+// "10/1m,100/1h".
+func ParseAuthFailureThresholds(spec string) ([]AuthFailureThreshold, error) {
+	thresholds := make([]AuthFailureThreshold, 0)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		index := strings.IndexByte(part, '/')
+		if index == -1 {
+			return nil, fmt.Errorf("authentication failure threshold %q is not <count>/<window>", part)
+		}
+		count, err := strconv.Atoi(part[:index])
+		if err != nil || count <= 0 {
+			return nil, fmt.Errorf("authentication failure threshold %q has an invalid count", part)
+		}
+		window, err := time.ParseDuration(part[index+1:])
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("authentication failure threshold %q has an invalid window", part)
+		}
+		thresholds = append(thresholds, AuthFailureThreshold{Count: count, Window: window})
+	}
+	return thresholds, nil
+}
+
+// isLoginEndpoint checks whether credentials are submitted to an endpoint, by the last segment of its path, so the
+// endpoints nested under an authentication resource such as /auth/users/{id} are not login endpoints.
+func isLoginEndpoint(method string, path string) bool {
+	if method != http.MethodPost {
+		return false
+	}
+	path = strings.TrimRight(path, "/")
+	_, ok := loginSegments[normalizeFieldName(path[strings.LastIndexByte(path, '/')+1:])]
+	return ok
+}
+
+// hasLoginError checks whether a response of a login endpoint rejects the credentials, by an error field
+// or a false success flag of its JSON body, or by its error message.
+func hasLoginError(mediaType string, body []byte) bool {
+	if len(body) == 0 {
+		return false
+	}
+	if mediaType == "" || isJSONMediaType(mediaType) {
+		var value map[string]interface{}
+		if err := json.NewDecoder(bytes.NewReader(body)).Decode(&value); err == nil {
+			for _, name := range []string{"error", "errors"} {
+				switch field := value[name].(type) {
+				case string:
+					if field != "" {
+						return true
+					}
+				case []interface{}:
+					if len(field) > 0 {
+						return true
+					}
+				case map[string]interface{}:
+					return true
+				}
+			}
+			for _, name := range []string{"success", "ok", "authenticated"} {
+				if flag, ok := value[name].(bool); ok && !flag {
+					return true
+				}
+			}
+		}
+	}
+	return loginErrorPattern.Match(body)
+}
+
+// authFailureReason returns why a transaction failed to authenticate, or an empty string if it did not. Other client
+// errors of login endpoints, such as malformed requests or rate limiting, are not authentication failures unless their
+// body rejects the credentials.
+func authFailureReason(transaction *httpTransaction, template string) string {
+	req, res := transaction.req, transaction.res
+	switch {
+	case res.StatusCode == http.StatusUnauthorized:
+		return authFailureUnauthorized
+	case res.StatusCode == http.StatusForbidden:
+		return authFailureForbidden
+	case !isLoginEndpoint(req.Method, template):
+		return ""
+	case (res.StatusCode >= http.StatusOK && res.StatusCode < http.StatusMultipleChoices) ||
+		(res.StatusCode >= http.StatusBadRequest && res.StatusCode < http.StatusInternalServerError):
+		if hasLoginError(responseMediaType(res), transaction.responseBody) {
+			return authFailureLogin
+		}
+	}
+	return ""
+}
+
+// AuthFailureCounter counts the authentication failures of a peer to an endpoint, keeping the times of the recent ones
+// to evaluate the thresholds over sliding windows.
+type AuthFailureCounter struct {
+	reasons    map[string]uint64
+	total      uint64
+	timestamps []time.Time
+	// alerting holds the thresholds the peer is above, so each is alerted once until the peer falls below it again.
+	alerting map[string]bool
+}
+
+// NewAuthFailureCounter creates a new instance of the authentication failure counter.
+func NewAuthFailureCounter() *AuthFailureCounter {
+	return &AuthFailureCounter{reasons: make(map[string]uint64), alerting: make(map[string]bool)}
+}
+
+// prune drops the failures that happened before the given time.
+func (counter *AuthFailureCounter) prune(since time.Time) {
+	index := sort.Search(len(counter.timestamps), func(i int) bool { return !counter.timestamps[i].Before(since) })
+	counter.timestamps = counter.timestamps[index:]
+}
+
+// countSince returns the number of failures that happened at or after the given time.
+func (counter *AuthFailureCounter) countSince(since time.Time) int {
+	index := sort.Search(len(counter.timestamps), func(i int) bool { return !counter.timestamps[i].Before(since) })
+	return len(counter.timestamps) - index
+}
+
+func (counter *AuthFailureCounter) merge(other *AuthFailureCounter) {
+	for reason, count := range other.reasons {
+		counter.reasons[reason] += count
+	}
+	counter.total += other.total
+	counter.timestamps = append(counter.timestamps, other.timestamps...)
+	sort.Slice(counter.timestamps, func(i, j int) bool { return counter.timestamps[i].Before(counter.timestamps[j]) })
+	if len(counter.timestamps) > maxAuthFailureTimestamps {
+		counter.timestamps = counter.timestamps[len(counter.timestamps)-maxAuthFailureTimestamps:]
+	}
+	for threshold, alerting := range other.alerting {
+		counter.alerting[threshold] = counter.alerting[threshold] || alerting
+	}
+}
+
+func (counter *AuthFailureCounter) String() string {
+	reasons := make([]string, 0, len(counter.reasons))
+	for reason := range counter.reasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	parts := make([]string, 0, len(reasons))
+	for _, reason := range reasons {
+		parts = append(parts, fmt.Sprintf("%s=%d", reason, counter.reasons[reason]))
+	}
+	return fmt.Sprintf("total=%d(%s)", counter.total, strings.Join(parts, " "))
+}
+
+func mergeAuthFailures(current map[string]*AuthFailureCounter, other map[string]*AuthFailureCounter) {
+	for peer, counter := range other {
+		if existing, ok := current[peer]; ok {
+			existing.merge(counter)
+		} else if len(current) < maxAuthFailurePeersPerEndpoint {
+			copied := NewAuthFailureCounter()
+			copied.merge(counter)
+			current[peer] = copied
+		}
+	}
+}
+
+// longestWindow returns the longest window of the thresholds.
+func longestWindow(thresholds []AuthFailureThreshold) time.Duration {
+	longest := time.Duration(0)
+	for _, threshold := range thresholds {
+		if threshold.Window > longest {
+			longest = threshold.Window
+		}
+	}
+	return longest
+}
+
+// addAuthFailure records an authentication failure of a peer to the endpoint. It returns the thresholds the peer went
+// above, along with its failures within their windows.
+func (schema *ApiSchema) addAuthFailure(peer string, reason string, now time.Time, thresholds []AuthFailureThreshold) ([]AuthFailureThreshold, []int) {
+	schema.mutex.Lock()
+	defer schema.mutex.Unlock()
+	since := now.Add(-longestWindow(thresholds))
+	counter, ok := schema.authFailures[peer]
+	if !ok {
+		if len(schema.authFailures) >= maxAuthFailurePeersPerEndpoint {
+			// Peers that have not failed within the windows make room for the new peer.
+			for existingPeer, existing := range schema.authFailures {
+				if existing.countSince(since) == 0 {
+					delete(schema.authFailures, existingPeer)
+				}
+			}
+			if len(schema.authFailures) >= maxAuthFailurePeersPerEndpoint {
+				return nil, nil
+			}
+		}
+		counter = NewAuthFailureCounter()
+		schema.authFailures[peer] = counter
+	}
+	counter.reasons[reason]++
+	counter.total++
+	// Transactions are handled in batches, so the failures are kept in order of their times.
+	index := sort.Search(len(counter.timestamps), func(i int) bool { return counter.timestamps[i].After(now) })
+	counter.timestamps = append(counter.timestamps, time.Time{})
+	copy(counter.timestamps[index+1:], counter.timestamps[index:])
+	counter.timestamps[index] = now
+	counter.prune(since)
+	if len(counter.timestamps) > maxAuthFailureTimestamps {
+		counter.timestamps = counter.timestamps[len(counter.timestamps)-maxAuthFailureTimestamps:]
+	}
+
+	exceeded := make([]AuthFailureThreshold, 0)
+	failures := make([]int, 0)
+	for _, threshold := range thresholds {
+		count := counter.countSince(now.Add(-threshold.Window))
+		if count < threshold.Count {
+			counter.alerting[threshold.String()] = false
+			continue
+		}
+		if !counter.alerting[threshold.String()] {
+			counter.alerting[threshold.String()] = true
+			exceeded = append(exceeded, threshold)
+			failures = append(failures, count)
+		}
+	}
+	return exceeded, failures
+}
+
+// sortedAuthFailures returns the authentication failure counters of an endpoint formatted by peer, ordered by peer.
+func sortedAuthFailures(counters map[string]*AuthFailureCounter) []string {
+	sorted := make([]string, 0, len(counters))
+	for peer, counter := range counters {
+		sorted = append(sorted, peer+":"+counter.String())
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// countAuthFailures counts the authentication failures of the peer of a transaction to the endpoint: 401 and 403
+// responses, and login endpoints that reject the credentials. A peer that fails more than a threshold within its
+// window is alerted once, until it falls below the threshold again.
+func (factory *Factory) countAuthFailures(schema *ApiSchema, transaction *httpTransaction) {
+	reason := authFailureReason(transaction, schema.uri)
+	if reason == "" || len(factory.failureThresholds) == 0 {
+		return
+	}
+	// The failures are counted at the wall-clock time the transaction was captured at, so the windows do not depend on
+	// when it is analyzed. The kernel timestamps of the data events are on another clock, and only measure latencies.
+	now := transaction.timing.capturedAt
+	if now.IsZero() {
+		now = time.Now()
+	}
+	// The port of the peer changes with every connection, so failures are counted per address.
+	peer := transaction.peer.IP().String()
+	exceeded, failures := schema.addAuthFailure(peer, reason, now, factory.failureThresholds)
+	for i, threshold := range exceeded {
+		factory.events.Emit(Event{
+			Category: authEventCategory,
+			Type:     authFindingFailuresExceeded,
+			Severity: eventSeverityHigh,
+			Method:   schema.method,
+			Path:     schema.uri,
+			Message:  fmt.Sprintf("%d authentication failures within %v", failures[i], threshold.Window),
+			Details: map[string]interface{}{
+				"peer":      factory.peerName(transaction.peer),
+				"pid":       transaction.pid,
+				"failures":  failures[i],
+				"threshold": threshold.Count,
+				"window":    threshold.Window.String(),
+				"reason":    reason,
+			},
+		})
+	}
+}
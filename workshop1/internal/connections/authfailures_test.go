@@ -0,0 +1,90 @@
+package connections
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAuthFailureReason(t *testing.T) {
+	tests := []struct {
+		name        string
+		transaction *httpTransaction
+		template    string
+		want        string
+	}{
+		{"unauthorized", newTestTransaction("GET", "/orders/1", "", http.StatusUnauthorized, "", ""), "/orders/{id}",
+			authFailureUnauthorized},
+		{"forbidden", newTestTransaction("DELETE", "/orders/1", "", http.StatusForbidden, "", ""), "/orders/{id}",
+			authFailureForbidden},
+		{"other client error", newTestTransaction("GET", "/orders/1", "", http.StatusNotFound, "", ""), "/orders/{id}",
+			""},
+		{"rejected credentials", newTestTransaction("POST", "/auth/login", "{}", http.StatusBadRequest, "application/json",
+			`{"error":"invalid_grant"}`), "/auth/login", authFailureLogin},
+		{"rejected credentials with a success", newTestTransaction("POST", "/api/sessions/", "{}", http.StatusOK, "",
+			`{"success":false}`), "/api/sessions/", authFailureLogin},
+		{"rejected credentials message", newTestTransaction("POST", "/oauth/token", "{}", http.StatusOK, "text/html",
+			`<p>Invalid password</p>`), "/oauth/token", authFailureLogin},
+		{"malformed login", newTestTransaction("POST", "/login", "{}", http.StatusBadRequest, "", ""), "/login", ""},
+		{"rate limited login", newTestTransaction("POST", "/login", "{}", http.StatusTooManyRequests, "", ""), "/login", ""},
+		{"logged in", newTestTransaction("POST", "/login", "{}", http.StatusOK, "application/json", `{"token":"abc"}`),
+			"/login", ""},
+		{"login server error", newTestTransaction("POST", "/login", "{}", http.StatusInternalServerError, "",
+			`{"error":"database down"}`), "/login", ""},
+		{"not a login method", newTestTransaction("GET", "/login", "", http.StatusBadRequest, "",
+			`{"error":"invalid credentials"}`), "/login", ""},
+		{"nested under an authentication resource", newTestTransaction("POST", "/auth/users", "{}", http.StatusConflict,
+			"application/json", `{"error":"exists"}`), "/auth/users", ""},
+		{"nested under a session", newTestTransaction("POST", "/sessions/1/messages", "{}", http.StatusUnprocessableEntity,
+			"application/json", `{"errors":["too long"]}`), "/sessions/{id}/messages", ""},
+	}
+	for _, test := range tests {
+		if got := authFailureReason(test.transaction, test.template); got != test.want {
+			t.Errorf("%s: authFailureReason() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAddAuthFailure(t *testing.T) {
+	thresholds := []AuthFailureThreshold{{Count: 3, Window: time.Minute}, {Count: 5, Window: time.Hour}}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		peer     string
+		offset   time.Duration
+		exceeded []AuthFailureThreshold
+		failures []int
+	}{
+		{"first", "10.0.0.1", 0, nil, nil},
+		{"second", "10.0.0.1", 10 * time.Second, nil, nil},
+		{"another peer", "10.0.0.2", 15 * time.Second, nil, nil},
+		{"third within the minute", "10.0.0.1", 20 * time.Second, thresholds[:1], []int{3}},
+		{"still above", "10.0.0.1", 30 * time.Second, nil, nil},
+		// The first failures leave the window of a minute, and the peer falls below its threshold.
+		{"fifth within the hour", "10.0.0.1", 85 * time.Second, thresholds[1:], []int{5}},
+		{"above again", "10.0.0.1", 90 * time.Second, thresholds[:1], []int{3}},
+		{"long after", "10.0.0.1", 2 * time.Hour, nil, nil},
+	}
+	schema := NewApiSchema("POST", "/login", nil, nil, false)
+	for _, test := range tests {
+		exceeded, failures := schema.addAuthFailure(test.peer, authFailureLogin, start.Add(test.offset), thresholds)
+		if len(exceeded) != len(test.exceeded) || len(failures) != len(test.failures) {
+			t.Errorf("%s: addAuthFailure() = %v %v, want %v %v", test.name, exceeded, failures, test.exceeded,
+				test.failures)
+			continue
+		}
+		for i := range exceeded {
+			if exceeded[i] != test.exceeded[i] || failures[i] != test.failures[i] {
+				t.Errorf("%s: addAuthFailure() = %v %v, want %v %v", test.name, exceeded, failures, test.exceeded,
+					test.failures)
+			}
+		}
+	}
+	counter := schema.authFailures["10.0.0.1"]
+	if counter.total != 7 || counter.reasons[authFailureLogin] != 7 || len(counter.timestamps) != 1 {
+		t.Errorf("addAuthFailure() = %s with %d failures kept, want total=7 with 1 kept", counter, len(counter.timestamps))
+	}
+	if counter.alerting[thresholds[0].String()] || counter.alerting[thresholds[1].String()] {
+		t.Errorf("addAuthFailure() kept alerting %v after the windows passed", counter.alerting)
+	}
+}
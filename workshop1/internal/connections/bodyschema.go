@@ -0,0 +1,274 @@
+package connections
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	mediaTypeForm      = "application/x-www-form-urlencoded"
+	mediaTypeMultipart = "multipart/form-data"
+
+	schemaFormatBinary = "binary"
+	// xmlTextProperty and xmlAttributePrefix name the text and the attributes of XML elements that hold other nodes.
+	xmlTextProperty    = "#text"
+	xmlAttributePrefix = "@"
+	// maxMultipartValueSize bounds the size of the (non-file) multipart values we infer the type of.
+	maxMultipartValueSize = 64 * 1024
+)
+
+// parseContentType returns the media type of a body, without its parameters, and the parameters.
+func parseContentType(header http.Header) (string, map[string]string) {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		return "", nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0])), nil
+	}
+	return mediaType, params
+}
+
+func isXMLMediaType(mediaType string) bool {
+	return mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml")
+}
+
+// isStructuredMediaType checks whether we infer the schema of bodies of the media type.
+func isStructuredMediaType(mediaType string) bool {
+	return isJSONMediaType(mediaType) || isXMLMediaType(mediaType) || mediaType == mediaTypeForm ||
+		mediaType == mediaTypeMultipart
+}
+
+// inferBodySchema infers the schema of a body by its media type. Bodies without a media type are inferred as JSON, if
+// they are valid JSON. It returns nil for empty bodies and media types we do not infer.
+func inferBodySchema(mediaType string, params map[string]string, body []byte) *Schema {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	switch {
+	case mediaType == "" || isJSONMediaType(mediaType):
+		return inferSchema(body)
+	case mediaType == mediaTypeForm:
+		return inferFormSchema(body)
+	case mediaType == mediaTypeMultipart:
+		return inferMultipartSchema(params["boundary"], body)
+	case isXMLMediaType(mediaType):
+		return inferXMLSchema(body)
+	default:
+		return nil
+	}
+}
+
+// inferScalarSchema infers the type of a value sent as text, such as a form field or the text of an XML element.
+func inferScalarSchema(value string) *Schema {
+	schema := &Schema{Type: schemaTypeString, SampleCount: 1}
+	switch {
+	// Numbers with leading zeros, such as zip codes, are strings.
+	case integerPattern.MatchString(value) && (len(value) == 1 || value[0] != '0'):
+		schema.Type = schemaTypeInteger
+	case value == "true" || value == "false":
+		schema.Type = schemaTypeBoolean
+	case strings.Contains(value, ".") && isNumber(value):
+		schema.Type = schemaTypeNumber
+	default:
+		schema.Format = inferStringFormat(value)
+	}
+	return schema
+}
+
+func isNumber(value string) bool {
+	_, err := strconv.ParseFloat(value, 64)
+	return err == nil
+}
+
+// objectSchema builds the schema of an object from the values of its properties. Properties with several values are
+// described as arrays.
+func objectSchema(values map[string][]*Schema) *Schema {
+	schema := &Schema{Type: schemaTypeObject, SampleCount: 1, Properties: make(map[string]*Schema, len(values))}
+	for name, propertyValues := range values {
+		if len(propertyValues) == 1 {
+			schema.Properties[name] = propertyValues[0]
+			continue
+		}
+		array := &Schema{Type: schemaTypeArray, SampleCount: 1}
+		for _, value := range propertyValues {
+			array.Items = mergeSchemas(array.Items, value)
+		}
+		schema.Properties[name] = array
+	}
+	schema.updateRequired()
+	return schema
+}
+
+// inferFormSchema infers the schema of a URL encoded form, as an object of its fields.
+func inferFormSchema(body []byte) *Schema {
+	form, err := url.ParseQuery(string(bytes.TrimSpace(body)))
+	if err != nil || len(form) == 0 {
+		return nil
+	}
+	values := make(map[string][]*Schema, len(form))
+	for name, fieldValues := range form {
+		for _, value := range fieldValues {
+			values[name] = append(values[name], inferScalarSchema(value))
+		}
+	}
+	return objectSchema(values)
+}
+
+// multipartPart is a part of a multipart form. The value of file uploads is not kept.
+type multipartPart struct {
+	name      string
+	mediaType string
+	fileName  string
+	value     []byte
+}
+
+// readMultipartParts reads the named parts of a multipart form. Values are read up to maxMultipartValueSize.
+func readMultipartParts(boundary string, body []byte) []multipartPart {
+	parts := make([]multipartPart, 0)
+	if boundary == "" {
+		return parts
+	}
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			// The end of the form, or a part truncated by the end of the capture.
+			break
+		}
+		name := part.FormName()
+		if name == "" {
+			continue
+		}
+		partType, _ := parseContentType(http.Header(part.Header))
+		parsed := multipartPart{name: name, mediaType: partType, fileName: part.FileName()}
+		if parsed.fileName == "" {
+			parsed.value, _ = io.ReadAll(io.LimitReader(part, maxMultipartValueSize))
+		}
+		parts = append(parts, parsed)
+	}
+	return parts
+}
+
+// inferMultipartSchema infers the schema of a multipart form, as an object of its parts. File uploads are described as
+// binary strings, with the media type of the file.
+func inferMultipartSchema(boundary string, body []byte) *Schema {
+	values := make(map[string][]*Schema)
+	for _, part := range readMultipartParts(boundary, body) {
+		if part.fileName != "" {
+			values[part.name] = append(values[part.name], &Schema{
+				Type:             schemaTypeString,
+				Format:           schemaFormatBinary,
+				ContentMediaType: part.mediaType,
+				SampleCount:      1,
+			})
+			continue
+		}
+		if isJSONMediaType(part.mediaType) && json.Valid(part.value) {
+			values[part.name] = append(values[part.name], inferSchema(part.value))
+			continue
+		}
+		values[part.name] = append(values[part.name], inferScalarSchema(string(part.value)))
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return objectSchema(values)
+}
+
+// xmlElement is a node of a parsed XML document.
+type xmlElement struct {
+	name       string
+	attributes []xml.Attr
+	children   []*xmlElement
+	text       strings.Builder
+}
+
+// schema describes an element. Elements with neither attributes nor children are described by the type of their text,
+// the others as objects of their attributes (prefixed with @), their children and their text (#text).
+func (element *xmlElement) schema(depth int) *Schema {
+	if depth > maxSchemaDepth {
+		return &Schema{SampleCount: 1}
+	}
+	text := strings.TrimSpace(element.text.String())
+	if len(element.attributes) == 0 && len(element.children) == 0 {
+		return inferScalarSchema(text)
+	}
+	values := make(map[string][]*Schema)
+	for _, attribute := range element.attributes {
+		if isNamespaceDeclaration(attribute) {
+			continue
+		}
+		values[xmlAttributePrefix+attribute.Name.Local] = []*Schema{inferScalarSchema(attribute.Value)}
+	}
+	for _, child := range element.children {
+		values[child.name] = append(values[child.name], child.schema(depth+1))
+	}
+	if text != "" {
+		values[xmlTextProperty] = []*Schema{inferScalarSchema(text)}
+	}
+	return objectSchema(values)
+}
+
+// isNamespaceDeclaration checks whether an attribute declares a namespace, which is not part of the structure.
+func isNamespaceDeclaration(attribute xml.Attr) bool {
+	return attribute.Name.Space == "xmlns" || attribute.Name.Local == "xmlns"
+}
+
+// parseXMLDocument parses the root element of an XML document, dropping the namespace prefixes of the elements. It
+// returns nil if the document holds no element.
+func parseXMLDocument(body []byte) *xmlElement {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	// The structure does not depend on the charset, so documents in other charsets are read as is.
+	decoder.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	var root *xmlElement
+	stack := make([]*xmlElement, 0)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			// The end of the document, or a document truncated by the end of the capture.
+			break
+		}
+		switch typedToken := token.(type) {
+		case xml.StartElement:
+			element := &xmlElement{name: typedToken.Name.Local, attributes: typedToken.Attr}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, element)
+			} else if root == nil {
+				root = element
+			}
+			stack = append(stack, element)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(typedToken)
+			}
+		}
+	}
+	return root
+}
+
+// inferXMLSchema infers the schema of an XML document, as an object that holds its root element. Namespace prefixes
+// are dropped, so SOAP envelopes are described by their Envelope, Header and Body elements.
+func inferXMLSchema(body []byte) *Schema {
+	root := parseXMLDocument(body)
+	if root == nil {
+		return nil
+	}
+	return objectSchema(map[string][]*Schema{root.name: {root.schema(0)}})
+}
@@ -0,0 +1,233 @@
+package connections
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// maxBSONDepth bounds the nesting of documents we decode, to avoid exhausting the stack on malicious payloads.
+	maxBSONDepth = 100
+)
+
+var (
+	errBSONTruncated = errors.New("bson document is truncated")
+)
+
+// bsonElement is a single key-value pair of a BSON document.
+type bsonElement struct {
+	key   string
+	value interface{}
+}
+
+// bsonDocument is a decoded BSON document. The order of the elements is kept, since for MongoDB commands the first
+// key is the command name.
+type bsonDocument []bsonElement
+
+// lookup returns the value of the given key.
+func (doc bsonDocument) lookup(key string) (interface{}, bool) {
+	for _, element := range doc {
+		if element.key == key {
+			return element.value, true
+		}
+	}
+	return nil, false
+}
+
+// lookupString returns the value of the given key if it is a string.
+func (doc bsonDocument) lookupString(key string) string {
+	value, _ := doc.lookup(key)
+	str, _ := value.(string)
+	return str
+}
+
+// parseBSONDocument decodes the document at the beginning of data, and returns it with its size in bytes.
+// Values are decoded into float64, string, bsonDocument, []interface{}, []byte, bool, time.Time, int32, int64 and nil.
+// ObjectIds are returned as hex strings, and the rest of the types as a printable placeholder.
+func parseBSONDocument(data []byte) (bsonDocument, int, error) {
+	return parseBSONDocumentWithDepth(data, 0)
+}
+
+func parseBSONDocumentWithDepth(data []byte, depth int) (bsonDocument, int, error) {
+	if depth > maxBSONDepth {
+		return nil, 0, errors.New("bson document is nested too deep")
+	}
+	if len(data) < 5 {
+		return nil, 0, errBSONTruncated
+	}
+	size := int(int32(binary.LittleEndian.Uint32(data)))
+	if size < 5 || size > len(data) {
+		return nil, 0, errBSONTruncated
+	}
+	if data[size-1] != 0 {
+		return nil, 0, errors.New("bson document is not null terminated")
+	}
+
+	doc := bsonDocument{}
+	offset := 4
+	for offset < size-1 {
+		elementType := data[offset]
+		key, next, err := readCString(data[:size-1], offset+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, valueSize, err := parseBSONValue(elementType, data[next:size-1], depth)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed decoding %q: %v", key, err)
+		}
+		doc = append(doc, bsonElement{key: key, value: value})
+		offset = next + valueSize
+	}
+	return doc, size, nil
+}
+
+func parseBSONValue(elementType byte, data []byte, depth int) (interface{}, int, error) {
+	fixedSize := func(size int) error {
+		if len(data) < size {
+			return errBSONTruncated
+		}
+		return nil
+	}
+
+	switch elementType {
+	case 0x01: // double
+		if err := fixedSize(8); err != nil {
+			return nil, 0, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(data)), 8, nil
+	case 0x02, 0x0D, 0x0E: // string, JavaScript code, symbol
+		return readBSONString(data)
+	case 0x03: // embedded document
+		return parseBSONDocumentWithDepth(data, depth+1)
+	case 0x04: // array, encoded as a document with the indexes as keys
+		doc, size, err := parseBSONDocumentWithDepth(data, depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		array := make([]interface{}, 0, len(doc))
+		for _, element := range doc {
+			array = append(array, element.value)
+		}
+		return array, size, nil
+	case 0x05: // binary
+		if err := fixedSize(5); err != nil {
+			return nil, 0, err
+		}
+		length := int(int32(binary.LittleEndian.Uint32(data)))
+		if length < 0 || 5+length > len(data) {
+			return nil, 0, errBSONTruncated
+		}
+		return data[5 : 5+length], 5 + length, nil
+	case 0x06, 0x0A, 0x7F, 0xFF: // undefined, null, max key, min key
+		return nil, 0, nil
+	case 0x07: // ObjectId
+		if err := fixedSize(12); err != nil {
+			return nil, 0, err
+		}
+		return hex.EncodeToString(data[:12]), 12, nil
+	case 0x08: // boolean
+		if err := fixedSize(1); err != nil {
+			return nil, 0, err
+		}
+		return data[0] != 0, 1, nil
+	case 0x09: // UTC datetime
+		if err := fixedSize(8); err != nil {
+			return nil, 0, err
+		}
+		millis := int64(binary.LittleEndian.Uint64(data))
+		return time.Unix(0, millis*int64(time.Millisecond)).UTC(), 8, nil
+	case 0x0B: // regular expression, pattern and options
+		pattern, next, err := readCString(data, 0)
+		if err != nil {
+			return nil, 0, err
+		}
+		_, next, err = readCString(data, next)
+		if err != nil {
+			return nil, 0, err
+		}
+		return pattern, next, nil
+	case 0x0C: // DBPointer
+		_, size, err := readBSONString(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		if size+12 > len(data) {
+			return nil, 0, errBSONTruncated
+		}
+		return "<dbpointer>", size + 12, nil
+	case 0x0F: // JavaScript code with scope, prefixed with its total size
+		if err := fixedSize(4); err != nil {
+			return nil, 0, err
+		}
+		length := int(int32(binary.LittleEndian.Uint32(data)))
+		if length < 4 || length > len(data) {
+			return nil, 0, errBSONTruncated
+		}
+		return "<code>", length, nil
+	case 0x10: // int32
+		if err := fixedSize(4); err != nil {
+			return nil, 0, err
+		}
+		return int32(binary.LittleEndian.Uint32(data)), 4, nil
+	case 0x11, 0x12: // timestamp, int64
+		if err := fixedSize(8); err != nil {
+			return nil, 0, err
+		}
+		return int64(binary.LittleEndian.Uint64(data)), 8, nil
+	case 0x13: // decimal128
+		if err := fixedSize(16); err != nil {
+			return nil, 0, err
+		}
+		return "<decimal128>", 16, nil
+	default:
+		return nil, 0, fmt.Errorf("unknown bson type %#x", elementType)
+	}
+}
+
+// readBSONString reads a string prefixed with its length (including the null terminator).
+func readBSONString(data []byte) (string, int, error) {
+	if len(data) < 4 {
+		return "", 0, errBSONTruncated
+	}
+	length := int(int32(binary.LittleEndian.Uint32(data)))
+	if length < 1 || 4+length > len(data) {
+		return "", 0, errBSONTruncated
+	}
+	return string(data[4 : 4+length-1]), 4 + length, nil
+}
+
+// readCString reads a null terminated string starting at the given offset, and returns the offset right after it.
+func readCString(data []byte, offset int) (string, int, error) {
+	if offset > len(data) {
+		return "", 0, errBSONTruncated
+	}
+	end := bytes.IndexByte(data[offset:], 0)
+	if end == -1 {
+		return "", 0, errBSONTruncated
+	}
+	return string(data[offset : offset+end]), offset + end + 1, nil
+}
+
+// bsonNumber converts the numeric BSON types into float64.
+func bsonNumber(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case float64:
+		return number, true
+	case int32:
+		return float64(number), true
+	case int64:
+		return float64(number), true
+	case bool:
+		if number {
+			return 1, true
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
+}
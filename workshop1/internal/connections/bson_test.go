@@ -0,0 +1,152 @@
+package connections
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// encodeBSON encodes a document of strings, int32, int64, float64, bool, nil, binary data, documents and arrays.
+func encodeBSON(doc bsonDocument) []byte {
+	body := make([]byte, 0)
+	for _, element := range doc {
+		elementType, value := encodeBSONValue(element.value)
+		body = append(append(append(body, elementType), element.key...), 0)
+		body = append(body, value...)
+	}
+	encoded := make([]byte, 4, 4+len(body)+1)
+	binary.LittleEndian.PutUint32(encoded, uint32(4+len(body)+1))
+	return append(append(encoded, body...), 0)
+}
+
+func encodeBSONValue(value interface{}) (byte, []byte) {
+	switch typedValue := value.(type) {
+	case float64:
+		encoded := make([]byte, 8)
+		binary.LittleEndian.PutUint64(encoded, math.Float64bits(typedValue))
+		return 0x01, encoded
+	case string:
+		encoded := make([]byte, 4)
+		binary.LittleEndian.PutUint32(encoded, uint32(len(typedValue)+1))
+		return 0x02, append(append(encoded, typedValue...), 0)
+	case bsonDocument:
+		return 0x03, encodeBSON(typedValue)
+	case []interface{}:
+		doc := bsonDocument{}
+		for i, item := range typedValue {
+			doc = append(doc, bsonElement{key: strconv.Itoa(i), value: item})
+		}
+		return 0x04, encodeBSON(doc)
+	case []byte:
+		encoded := make([]byte, 5)
+		binary.LittleEndian.PutUint32(encoded, uint32(len(typedValue)))
+		return 0x05, append(encoded, typedValue...)
+	case bool:
+		if typedValue {
+			return 0x08, []byte{1}
+		}
+		return 0x08, []byte{0}
+	case nil:
+		return 0x0A, nil
+	case int32:
+		encoded := make([]byte, 4)
+		binary.LittleEndian.PutUint32(encoded, uint32(typedValue))
+		return 0x10, encoded
+	case int64:
+		encoded := make([]byte, 8)
+		binary.LittleEndian.PutUint64(encoded, uint64(typedValue))
+		return 0x12, encoded
+	default:
+		panic("unsupported bson test value")
+	}
+}
+
+// mutations returns copies of the data with each of its bytes replaced by values that break lengths and types.
+func mutations(data []byte) [][]byte {
+	mutated := make([][]byte, 0, len(data)*4)
+	for i := range data {
+		for _, value := range []byte{0x00, 0x01, 0x7f, 0xff} {
+			if data[i] == value {
+				continue
+			}
+			copied := append([]byte{}, data...)
+			copied[i] = value
+			mutated = append(mutated, copied)
+		}
+	}
+	return mutated
+}
+
+func TestParseBSONDocument(t *testing.T) {
+	doc := bsonDocument{
+		{key: "find", value: "users"},
+		{key: "filter", value: bsonDocument{{key: "age", value: bsonDocument{{key: "$gt", value: int32(30)}}}}},
+		{key: "limit", value: int64(10)},
+		{key: "ratio", value: 0.5},
+		{key: "tags", value: []interface{}{"a", int32(1), true}},
+		{key: "blob", value: []byte{1, 2, 3}},
+		{key: "missing", value: nil},
+		{key: "$db", value: "app"},
+	}
+	parsed, size, err := parseBSONDocument(encodeBSON(doc))
+	if err != nil {
+		t.Fatalf("parseBSONDocument() error = %v", err)
+	}
+	if size != len(encodeBSON(doc)) || !reflect.DeepEqual(parsed, doc) {
+		t.Errorf("parseBSONDocument() = %v %d, want %v %d", parsed, size, doc, len(encodeBSON(doc)))
+	}
+	if parsed.lookupString("$db") != "app" || parsed.lookupString("limit") != "" {
+		t.Errorf("lookupString() = %q %q, want \"app\" \"\"", parsed.lookupString("$db"), parsed.lookupString("limit"))
+	}
+}
+
+func TestParseBSONDocumentMalformed(t *testing.T) {
+	valid := encodeBSON(bsonDocument{{key: "name", value: "jane"}, {key: "n", value: int32(1)}})
+	nested := bsonDocument{{key: "leaf", value: int32(1)}}
+	for i := 0; i < maxBSONDepth+1; i++ {
+		nested = bsonDocument{{key: "child", value: nested}}
+	}
+	negativeString := append([]byte{}, valid...)
+	// The length of the "jane" string.
+	binary.LittleEndian.PutUint32(negativeString[10:14], 0xffffffff)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"size larger than data", append([]byte{0xff, 0, 0, 0}, valid[4:]...)},
+		{"negative size", append([]byte{0xff, 0xff, 0xff, 0xff}, valid[4:]...)},
+		{"size below minimum", []byte{4, 0, 0, 0, 0}},
+		{"not null terminated", append(valid[:len(valid)-1:len(valid)-1], 1)},
+		{"unknown type", []byte{8, 0, 0, 0, 0x42, 'a', 0, 0}},
+		{"unterminated key", []byte{8, 0, 0, 0, 0x10, 'a', 'b', 0}},
+		{"negative string length", negativeString},
+		{"nested too deep", encodeBSON(nested)},
+	}
+	for _, test := range tests {
+		if _, _, err := parseBSONDocument(test.data); err == nil {
+			t.Errorf("%s: parseBSONDocument() succeeded, want an error", test.name)
+		}
+	}
+	for i := 0; i < len(valid); i++ {
+		if _, _, err := parseBSONDocument(valid[:i]); err == nil {
+			t.Errorf("parseBSONDocument() of %d of %d bytes succeeded, want an error", i, len(valid))
+		}
+	}
+}
+
+func TestParseBSONDocumentDoesNotPanic(t *testing.T) {
+	doc := bsonDocument{
+		{key: "insert", value: "orders"},
+		{key: "documents", value: []interface{}{bsonDocument{{key: "total", value: 9.99}, {key: "paid", value: true}}}},
+		{key: "blob", value: []byte{1, 2, 3}},
+		{key: "n", value: int64(2)},
+	}
+	for _, data := range mutations(encodeBSON(doc)) {
+		// Errors are expected, only a panic fails the test.
+		parseBSONDocument(data)
+	}
+}
@@ -0,0 +1,382 @@
+package connections
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiran-sama/ebpf-training/workshop1/internal/structs"
+)
+
+const (
+	dnsHeaderSize = 12
+	// maxDNSNamePointers bounds the compression pointers we follow, to avoid looping on malicious messages.
+	maxDNSNamePointers = 16
+	// maxCachedHostnames bounds the ip to hostname cache, the least recently resolved addresses are evicted first.
+	maxCachedHostnames = 4096
+)
+
+var (
+	dnsTypeNames = map[uint16]string{
+		1:   "A",
+		2:   "NS",
+		5:   "CNAME",
+		6:   "SOA",
+		12:  "PTR",
+		15:  "MX",
+		16:  "TXT",
+		28:  "AAAA",
+		33:  "SRV",
+		64:  "SVCB",
+		65:  "HTTPS",
+		255: "ANY",
+	}
+
+	dnsResponseCodeNames = map[uint8]string{
+		0: "NOERROR",
+		1: "FORMERR",
+		2: "SERVFAIL",
+		3: "NXDOMAIN",
+		4: "NOTIMP",
+		5: "REFUSED",
+	}
+
+	errDNSMessageTruncated = errors.New("dns message is truncated")
+)
+
+func dnsTypeName(qtype uint16) string {
+	if name, ok := dnsTypeNames[qtype]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", qtype)
+}
+
+func dnsResponseCodeName(rcode uint8) string {
+	if name, ok := dnsResponseCodeNames[rcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+type dnsQuestion struct {
+	name  string
+	qtype uint16
+}
+
+type dnsRecord struct {
+	name  string
+	rtype uint16
+	ttl   uint32
+	// data is the printable form of the record data.
+	data string
+	// ip is set for A and AAAA records.
+	ip net.IP
+}
+
+type dnsMessage struct {
+	id        uint16
+	response  bool
+	rcode     uint8
+	questions []dnsQuestion
+	answers   []dnsRecord
+}
+
+// parseDNSMessage decodes the header, questions and answers of a DNS message. The authority and additional sections
+// are ignored. Answers are parsed on a best effort basis, so a message truncated by the capture still yields the
+// answers that fit.
+func parseDNSMessage(payload []byte) (*dnsMessage, error) {
+	if len(payload) < dnsHeaderSize {
+		return nil, errDNSMessageTruncated
+	}
+	flags := binary.BigEndian.Uint16(payload[2:4])
+	message := &dnsMessage{
+		id:       binary.BigEndian.Uint16(payload[0:2]),
+		response: flags&0x8000 != 0,
+		rcode:    uint8(flags & 0x000f),
+	}
+	questionsCount := int(binary.BigEndian.Uint16(payload[4:6]))
+	answersCount := int(binary.BigEndian.Uint16(payload[6:8]))
+
+	offset := dnsHeaderSize
+	for i := 0; i < questionsCount; i++ {
+		name, next, err := readDNSName(payload, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(payload) {
+			return nil, errDNSMessageTruncated
+		}
+		message.questions = append(message.questions, dnsQuestion{
+			name:  name,
+			qtype: binary.BigEndian.Uint16(payload[next : next+2]),
+		})
+		offset = next + 4
+	}
+
+	for i := 0; i < answersCount; i++ {
+		record, next, err := readDNSRecord(payload, offset)
+		if err != nil {
+			break
+		}
+		message.answers = append(message.answers, record)
+		offset = next
+	}
+	return message, nil
+}
+
+func readDNSRecord(payload []byte, offset int) (dnsRecord, int, error) {
+	name, next, err := readDNSName(payload, offset)
+	if err != nil {
+		return dnsRecord{}, 0, err
+	}
+	// type (2), class (2), ttl (4), rdlength (2).
+	if next+10 > len(payload) {
+		return dnsRecord{}, 0, errDNSMessageTruncated
+	}
+	record := dnsRecord{
+		name:  name,
+		rtype: binary.BigEndian.Uint16(payload[next : next+2]),
+		ttl:   binary.BigEndian.Uint32(payload[next+4 : next+8]),
+	}
+	dataLength := int(binary.BigEndian.Uint16(payload[next+8 : next+10]))
+	dataOffset := next + 10
+	if dataOffset+dataLength > len(payload) {
+		return dnsRecord{}, 0, errDNSMessageTruncated
+	}
+	data := payload[dataOffset : dataOffset+dataLength]
+
+	switch dnsTypeName(record.rtype) {
+	case "A", "AAAA":
+		if len(data) != net.IPv4len && len(data) != net.IPv6len {
+			return dnsRecord{}, 0, fmt.Errorf("invalid address length %d", len(data))
+		}
+		record.ip = make(net.IP, len(data))
+		copy(record.ip, data)
+		record.data = record.ip.String()
+	case "CNAME", "NS", "PTR":
+		target, _, err := readDNSName(payload, dataOffset)
+		if err != nil {
+			return dnsRecord{}, 0, err
+		}
+		record.data = target
+	default:
+		record.data = fmt.Sprintf("<%d bytes>", dataLength)
+	}
+	return record, dataOffset + dataLength, nil
+}
+
+// readDNSName reads a (possibly compressed) domain name that starts at the given offset, and returns the name with the
+// offset right after it in the original message.
+func readDNSName(payload []byte, offset int) (string, int, error) {
+	labels := make([]string, 0, 4)
+	next := -1
+	pointers := 0
+	for {
+		if offset >= len(payload) {
+			return "", 0, errDNSMessageTruncated
+		}
+		length := int(payload[offset])
+		switch {
+		case length == 0:
+			if next == -1 {
+				next = offset + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case length&0xc0 == 0xc0:
+			if offset+2 > len(payload) {
+				return "", 0, errDNSMessageTruncated
+			}
+			pointers++
+			if pointers > maxDNSNamePointers {
+				return "", 0, errors.New("too many compression pointers in dns name")
+			}
+			if next == -1 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(payload[offset:offset+2]) & 0x3fff)
+		case length&0xc0 != 0:
+			return "", 0, fmt.Errorf("unsupported dns label type %#x", length&0xc0)
+		default:
+			if offset+1+length > len(payload) {
+				return "", 0, errDNSMessageTruncated
+			}
+			labels = append(labels, string(payload[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+// dnsLookup is a single query of a process, with its response.
+type dnsLookup struct {
+	name    string
+	qtype   string
+	rcode   string
+	answers []string
+	server  string
+	latency time.Duration
+	// answered is false for queries that got no response in time.
+	answered bool
+}
+
+func (lookup dnsLookup) String() string {
+	if !lookup.answered {
+		return fmt.Sprintf("%s %s via %s: no response", lookup.name, lookup.qtype, lookup.server)
+	}
+	latency := "unknown latency"
+	if lookup.latency > 0 {
+		latency = lookup.latency.String()
+	}
+	return fmt.Sprintf("%s %s via %s: %s %v in %s", lookup.name, lookup.qtype, lookup.server, lookup.rcode, lookup.answers, latency)
+}
+
+type dnsQueryKey struct {
+	pid   uint32
+	id    uint16
+	name  string
+	qtype uint16
+}
+
+type pendingDNSQuery struct {
+	server        string
+	timestampNano uint64
+}
+
+type cachedHostname struct {
+	name     string
+	lastSeen time.Time
+}
+
+// DNSTracker is a routine-safe container that pairs the DNS queries of the traced processes with their responses.
+// It keeps a per-process log of the lookups, and a cache of the addresses the processes resolved, so we can name the
+// peers of the connections.
+type DNSTracker struct {
+	pendingQueries map[dnsQueryKey]pendingDNSQuery
+	// lookups holds the lookups completed since the last call to Flush, per process.
+	lookups   map[uint32][]dnsLookup
+	hostnames map[string]cachedHostname
+
+	mutex sync.RWMutex
+}
+
+// NewDNSTracker creates a new instance of the DNS tracker.
+func NewDNSTracker() *DNSTracker {
+	return &DNSTracker{
+		pendingQueries: make(map[dnsQueryKey]pendingDNSQuery),
+		lookups:        make(map[uint32][]dnsLookup),
+		hostnames:      make(map[string]cachedHostname),
+	}
+}
+
+// AddEvent handles a DNS message sent or received by a traced process.
+func (tracker *DNSTracker) AddEvent(event structs.DNSEvent) {
+	message, err := parseDNSMessage(event.Msg[:event.Attr.MsgSize])
+	if err != nil {
+		log.Printf("Failed parsing DNS message of pid %d: %v", event.Attr.PID, err)
+		return
+	}
+	if len(message.questions) == 0 {
+		return
+	}
+	question := message.questions[0]
+	key := dnsQueryKey{pid: event.Attr.PID, id: message.id, name: question.name, qtype: question.qtype}
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	if !message.response {
+		tracker.pendingQueries[key] = pendingDNSQuery{
+			server:        event.Attr.Addr.String(),
+			timestampNano: event.Attr.TimestampNano,
+		}
+		return
+	}
+
+	lookup := dnsLookup{
+		name:     question.name,
+		qtype:    dnsTypeName(question.qtype),
+		rcode:    dnsResponseCodeName(message.rcode),
+		answers:  make([]string, 0, len(message.answers)),
+		server:   event.Attr.Addr.String(),
+		answered: true,
+	}
+	if query, ok := tracker.pendingQueries[key]; ok {
+		delete(tracker.pendingQueries, key)
+		if event.Attr.TimestampNano > query.timestampNano {
+			lookup.latency = time.Duration(event.Attr.TimestampNano - query.timestampNano)
+		}
+	}
+	now := time.Now()
+	for _, answer := range message.answers {
+		lookup.answers = append(lookup.answers, answer.data)
+		if answer.ip != nil {
+			// We label the address with the name the process asked for, rather than the last name in a CNAME chain.
+			tracker.cacheHostname(answer.ip, question.name, now)
+		}
+	}
+	tracker.lookups[event.Attr.PID] = append(tracker.lookups[event.Attr.PID], lookup)
+}
+
+func (tracker *DNSTracker) cacheHostname(ip net.IP, name string, now time.Time) {
+	key := ip.String()
+	if _, ok := tracker.hostnames[key]; !ok && len(tracker.hostnames) >= maxCachedHostnames {
+		oldestKey := ""
+		var oldest time.Time
+		for cachedKey, cached := range tracker.hostnames {
+			if oldestKey == "" || cached.lastSeen.Before(oldest) {
+				oldestKey, oldest = cachedKey, cached.lastSeen
+			}
+		}
+		delete(tracker.hostnames, oldestKey)
+	}
+	tracker.hostnames[key] = cachedHostname{name: name, lastSeen: now}
+}
+
+// Hostname returns the name a traced process resolved to the given address, if any.
+func (tracker *DNSTracker) Hostname(ip net.IP) (string, bool) {
+	tracker.mutex.RLock()
+	defer tracker.mutex.RUnlock()
+	cached, ok := tracker.hostnames[ip.String()]
+	return cached.name, ok
+}
+
+// Flush logs the lookups completed since the last flush, grouped by process. Queries that are pending for longer than
+// the given threshold are logged as unanswered.
+func (tracker *DNSTracker) Flush(inactivityThreshold time.Duration) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	deadline := uint64(time.Now().Add(-inactivityThreshold).UnixNano())
+	for key, query := range tracker.pendingQueries {
+		if query.timestampNano < deadline {
+			delete(tracker.pendingQueries, key)
+			tracker.lookups[key.pid] = append(tracker.lookups[key.pid], dnsLookup{
+				name:   key.name,
+				qtype:  dnsTypeName(key.qtype),
+				server: query.server,
+			})
+		}
+	}
+	if len(tracker.lookups) == 0 {
+		return
+	}
+
+	pids := make([]uint32, 0, len(tracker.lookups))
+	for pid := range tracker.lookups {
+		pids = append(pids, pid)
+	}
+	sort.Slice(pids, func(i, j int) bool { return pids[i] < pids[j] })
+
+	fmt.Println("DNS Lookups")
+	for _, pid := range pids {
+		fmt.Printf("========================>\nPID:%d\n", pid)
+		for _, lookup := range tracker.lookups[pid] {
+			fmt.Printf("%s\n", lookup)
+		}
+		fmt.Println("<========================")
+	}
+	tracker.lookups = make(map[uint32][]dnsLookup)
+}
@@ -0,0 +1,157 @@
+package connections
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// dnsName encodes a domain name as uncompressed labels.
+func dnsName(labels ...string) []byte {
+	encoded := make([]byte, 0)
+	for _, label := range labels {
+		encoded = append(append(encoded, byte(len(label))), label...)
+	}
+	return append(encoded, 0)
+}
+
+// dnsHeader encodes the header of a DNS message.
+func dnsHeader(id uint16, flags uint16, questions uint16, answers uint16) []byte {
+	header := make([]byte, dnsHeaderSize)
+	binary.BigEndian.PutUint16(header[0:2], id)
+	binary.BigEndian.PutUint16(header[2:4], flags)
+	binary.BigEndian.PutUint16(header[4:6], questions)
+	binary.BigEndian.PutUint16(header[6:8], answers)
+	return header
+}
+
+// dnsAnswer encodes a resource record of the class IN.
+func dnsAnswer(name []byte, rtype uint16, ttl uint32, data []byte) []byte {
+	record := append([]byte{}, name...)
+	fields := make([]byte, 10)
+	binary.BigEndian.PutUint16(fields[0:2], rtype)
+	binary.BigEndian.PutUint16(fields[2:4], 1)
+	binary.BigEndian.PutUint32(fields[4:8], ttl)
+	binary.BigEndian.PutUint16(fields[8:10], uint16(len(data)))
+	return append(append(record, fields...), data...)
+}
+
+func concat(parts ...[]byte) []byte {
+	joined := make([]byte, 0)
+	for _, part := range parts {
+		joined = append(joined, part...)
+	}
+	return joined
+}
+
+func TestReadDNSName(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		offset  int
+		want    string
+		next    int
+		wantErr bool
+	}{
+		{"plain", dnsName("www", "example", "com"), 0, "www.example.com", 17, false},
+		{"root", []byte{0}, 0, "", 1, false},
+		// The name continues at a pointer to "example.com" at offset 4, and ends right after the pointer.
+		{"compressed", concat([]byte{0, 0, 0, 0}, dnsName("example", "com"), []byte{3, 'w', 'w', 'w', 0xc0, 4}), 17,
+			"www.example.com", 23, false},
+		{"pointer to pointer", concat(dnsName("com"), []byte{0xc0, 0}, []byte{0xc0, 5}), 7, "com", 9, false},
+		{"pointer loop", []byte{0xc0, 0}, 0, "", 0, true},
+		{"pointer cycle", []byte{0xc0, 2, 0xc0, 0}, 0, "", 0, true},
+		{"truncated label", []byte{7, 'e', 'x', 'a'}, 0, "", 0, true},
+		{"truncated pointer", []byte{0xc0}, 0, "", 0, true},
+		{"missing terminator", []byte{3, 'c', 'o', 'm'}, 0, "", 0, true},
+		{"pointer out of bounds", []byte{0xc0, 0x20}, 0, "", 0, true},
+		{"extended label type", []byte{0x40, 0}, 0, "", 0, true},
+		{"offset out of bounds", dnsName("com"), 10, "", 0, true},
+	}
+	for _, test := range tests {
+		name, next, err := readDNSName(test.payload, test.offset)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: readDNSName() error = %v, want error %v", test.name, err, test.wantErr)
+			continue
+		}
+		if !test.wantErr && (name != test.want || next != test.next) {
+			t.Errorf("%s: readDNSName() = %q %d, want %q %d", test.name, name, next, test.want, test.next)
+		}
+	}
+}
+
+func TestParseDNSMessage(t *testing.T) {
+	question := concat(dnsName("api", "example", "com"), []byte{0, 1, 0, 1})
+	// The answers refer to the name of the question, right after the header.
+	answerName := []byte{0xc0, dnsHeaderSize}
+	response := concat(dnsHeader(0x1234, 0x8180, 1, 2), question,
+		dnsAnswer(answerName, 5, 300, concat([]byte{4, 'e', 'd', 'g', 'e'}, answerName)),
+		dnsAnswer(answerName, 1, 60, []byte{93, 184, 216, 34}))
+
+	tests := []struct {
+		name      string
+		payload   []byte
+		wantErr   bool
+		response  bool
+		rcode     uint8
+		questions []string
+		answers   []string
+	}{
+		{"query", concat(dnsHeader(0x1234, 0x0100, 1, 0), question), false, false, 0,
+			[]string{"api.example.com"}, nil},
+		{"response", response, false, true, 0, []string{"api.example.com"},
+			[]string{"CNAME edge.api.example.com", "A 93.184.216.34"}},
+		{"nxdomain", concat(dnsHeader(0x1234, 0x8183, 1, 0), question), false, true, 3,
+			[]string{"api.example.com"}, nil},
+		// The answers that fit in the capture are kept.
+		{"truncated answers", response[:len(response)-2], false, true, 0, []string{"api.example.com"},
+			[]string{"CNAME edge.api.example.com"}},
+		{"more answers than sent", concat(dnsHeader(0x1234, 0x8180, 1, 40), question), false, true, 0,
+			[]string{"api.example.com"}, nil},
+		{"invalid address length", concat(dnsHeader(0x1234, 0x8180, 1, 1), question,
+			dnsAnswer(answerName, 1, 60, []byte{1, 2, 3})), false, true, 0, []string{"api.example.com"}, nil},
+		{"truncated header", []byte{0x12, 0x34, 0x01}, true, false, 0, nil, nil},
+		{"truncated question", concat(dnsHeader(0x1234, 0x0100, 1, 0), question[:len(question)-2]), true, false, 0,
+			nil, nil},
+		{"question pointer loop", concat(dnsHeader(0x1234, 0x0100, 1, 0), []byte{0xc0, dnsHeaderSize, 0, 1, 0, 1}),
+			true, false, 0, nil, nil},
+		{"more questions than sent", concat(dnsHeader(0x1234, 0x0100, 2, 0), question), true, false, 0, nil, nil},
+	}
+	for _, test := range tests {
+		message, err := parseDNSMessage(test.payload)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: parseDNSMessage() error = %v, want error %v", test.name, err, test.wantErr)
+			continue
+		}
+		if test.wantErr {
+			continue
+		}
+		if message.id != 0x1234 || message.response != test.response || message.rcode != test.rcode {
+			t.Errorf("%s: parseDNSMessage() = id %#x response %v rcode %d, want id 0x1234 response %v rcode %d",
+				test.name, message.id, message.response, message.rcode, test.response, test.rcode)
+		}
+		questions := make([]string, 0)
+		for _, question := range message.questions {
+			questions = append(questions, question.name)
+		}
+		answers := make([]string, 0)
+		for _, answer := range message.answers {
+			answers = append(answers, dnsTypeName(answer.rtype)+" "+answer.data)
+		}
+		if !equalStrings(questions, test.questions) || !equalStrings(answers, test.answers) {
+			t.Errorf("%s: parseDNSMessage() = questions %v answers %v, want questions %v answers %v", test.name,
+				questions, answers, test.questions, test.answers)
+		}
+	}
+}
+
+func equalStrings(got []string, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
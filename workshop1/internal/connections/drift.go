@@ -0,0 +1,587 @@
+package connections
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	driftEventCategory = "drift"
+
+	driftShadowEndpoint       = "shadow_endpoint"
+	driftUnseenEndpoint       = "unseen_endpoint"
+	driftUndeclaredStatusCode = "undeclared_response_code"
+	driftUndocumentedBody     = "undocumented_body"
+	driftUndocumentedField    = "undocumented_field"
+	driftTypeMismatch         = "type_mismatch"
+	driftMissingRequiredField = "missing_required_field"
+	driftProhibitedExtraField = "prohibited_field"
+	driftLocationRequestBody  = "request"
+	driftLocationResponseBody = "response"
+	// maxReferenceDepth bounds the $ref hops we follow, so cyclic references do not loop forever.
+	maxReferenceDepth = 16
+	// maxDriftReports bounds the differences we remember as reported, the differences beyond it are not reported.
+	maxDriftReports = 10000
+)
+
+// referenceEndpoint is an operation documented in the reference specification.
+type referenceEndpoint struct {
+	method    string
+	path      string
+	segments  []string
+	operation map[string]interface{}
+}
+
+func (endpoint *referenceEndpoint) key() string {
+	return endpoint.method + "_" + endpoint.path
+}
+
+// ReferenceSpec is a hand-written OpenAPI 3 specification we compare the captured traffic to.
+type ReferenceSpec struct {
+	document  map[string]interface{}
+	endpoints []*referenceEndpoint
+	// basePaths are the paths of the server URLs, longest first.
+	basePaths []string
+}
+
+// LoadReferenceSpec loads an OpenAPI 3 specification, in JSON or YAML.
+func LoadReferenceSpec(path string) (*ReferenceSpec, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the reference specification: %v", err)
+	}
+	var document interface{}
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte("{")) {
+		err = json.Unmarshal(content, &document)
+	} else {
+		err = yaml.Unmarshal(content, &document)
+		document = normalizeYAML(document)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the reference specification: %v", err)
+	}
+	spec := &ReferenceSpec{}
+	spec.document, _ = document.(map[string]interface{})
+	paths, ok := spec.document["paths"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("reference specification %s has no paths", path)
+	}
+	for path, item := range paths {
+		pathItem, _ := spec.resolve(item).(map[string]interface{})
+		for method, operation := range pathItem {
+			method = strings.ToUpper(method)
+			operationObject, ok := operation.(map[string]interface{})
+			if _, isMethod := openAPIMethods[method]; !isMethod || !ok {
+				// Path item fields such as summary and parameters.
+				continue
+			}
+			spec.endpoints = append(spec.endpoints, &referenceEndpoint{
+				method:    method,
+				path:      path,
+				segments:  strings.Split(strings.Trim(path, "/"), "/"),
+				operation: operationObject,
+			})
+		}
+	}
+	sort.Slice(spec.endpoints, func(i, j int) bool {
+		return spec.endpoints[i].key() < spec.endpoints[j].key()
+	})
+	spec.basePaths = serverBasePaths(spec.document["servers"])
+	return spec, nil
+}
+
+// serverBasePaths returns the paths of the server URLs, which prefix the documented paths in the traffic. The server
+// variables are replaced by their default values.
+func serverBasePaths(servers interface{}) []string {
+	serverList, _ := servers.([]interface{})
+	basePaths := make([]string, 0, len(serverList))
+	for _, server := range serverList {
+		serverObject, _ := server.(map[string]interface{})
+		serverURL, _ := serverObject["url"].(string)
+		variables, _ := serverObject["variables"].(map[string]interface{})
+		for name, variable := range variables {
+			variableObject, _ := variable.(map[string]interface{})
+			if defaultValue, ok := variableObject["default"]; ok {
+				serverURL = strings.Replace(serverURL, "{"+name+"}", fmt.Sprintf("%v", defaultValue), -1)
+			}
+		}
+		parsed, err := url.Parse(serverURL)
+		if err != nil || (parsed.Scheme == "" && !strings.HasPrefix(parsed.Path, "/")) {
+			continue
+		}
+		if basePath := strings.TrimRight(parsed.Path, "/"); basePath != "" {
+			basePaths = append(basePaths, basePath)
+		}
+	}
+	sort.Slice(basePaths, func(i, j int) bool {
+		return len(basePaths[i]) > len(basePaths[j])
+	})
+	return basePaths
+}
+
+// normalizeYAML converts the maps decoded from YAML into the maps decoded from JSON, keyed by strings.
+func normalizeYAML(value interface{}) interface{} {
+	switch typedValue := value.(type) {
+	case map[interface{}]interface{}:
+		normalized := make(map[string]interface{}, len(typedValue))
+		for key, item := range typedValue {
+			normalized[fmt.Sprintf("%v", key)] = normalizeYAML(item)
+		}
+		return normalized
+	case []interface{}:
+		for i, item := range typedValue {
+			typedValue[i] = normalizeYAML(item)
+		}
+		return typedValue
+	default:
+		return value
+	}
+}
+
+func isTemplateSegment(segment string) bool {
+	return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+// match returns the documented operation that serves the templated path, or nil. The path is matched without the path
+// of a server URL that prefixes it first, and as it is otherwise.
+func (spec *ReferenceSpec) match(method string, path string) *referenceEndpoint {
+	for _, basePath := range spec.basePaths {
+		if path != basePath && !strings.HasPrefix(path, basePath+"/") {
+			continue
+		}
+		if endpoint := spec.matchPath(method, strings.TrimPrefix(path, basePath)); endpoint != nil {
+			return endpoint
+		}
+	}
+	return spec.matchPath(method, path)
+}
+
+// matchPath returns the documented operation of the path. Literal segments take precedence over templated ones, so
+// /users/me is not matched to /users/{id}.
+func (spec *ReferenceSpec) matchPath(method string, path string) *referenceEndpoint {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	var best *referenceEndpoint
+	bestLiterals := -1
+	for _, endpoint := range spec.endpoints {
+		if endpoint.method != method || len(endpoint.segments) != len(segments) {
+			continue
+		}
+		literals := 0
+		matched := true
+		for i, segment := range endpoint.segments {
+			if isTemplateSegment(segment) {
+				continue
+			}
+			if segment != segments[i] {
+				matched = false
+				break
+			}
+			literals++
+		}
+		if matched && literals > bestLiterals {
+			best = endpoint
+			bestLiterals = literals
+		}
+	}
+	return best
+}
+
+// resolve follows the local $ref of a node, such as #/components/schemas/User.
+func (spec *ReferenceSpec) resolve(node interface{}) interface{} {
+	for i := 0; i < maxReferenceDepth; i++ {
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			return node
+		}
+		reference, ok := object["$ref"].(string)
+		if !ok {
+			return node
+		}
+		if !strings.HasPrefix(reference, "#/") {
+			// References to other documents are not followed.
+			return nil
+		}
+		node = spec.document
+		for _, token := range strings.Split(strings.TrimPrefix(reference, "#/"), "/") {
+			token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+			container, ok := node.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			node = container[token]
+		}
+	}
+	return nil
+}
+
+func (spec *ReferenceSpec) resolveObject(node interface{}) map[string]interface{} {
+	object, _ := spec.resolve(node).(map[string]interface{})
+	return object
+}
+
+// jsonContentSchema returns the schema of the JSON media type of a request body or a response.
+func (spec *ReferenceSpec) jsonContentSchema(body map[string]interface{}) interface{} {
+	content, _ := body["content"].(map[string]interface{})
+	for mediaType, media := range content {
+		if strings.HasPrefix(mediaType, openAPIMediaTypeJSON) || strings.Contains(mediaType, "+json") {
+			return spec.resolveObject(media)["schema"]
+		}
+	}
+	return nil
+}
+
+// response returns the documented response of the status code, matching ranges such as 4XX and the default response.
+func (spec *ReferenceSpec) response(endpoint *referenceEndpoint, statusCode int) map[string]interface{} {
+	responses := spec.resolveObject(endpoint.operation["responses"])
+	code := strconv.Itoa(statusCode)
+	for _, key := range []string{code, code[:1] + "XX", code[:1] + "xx", "default"} {
+		if response, ok := responses[key]; ok {
+			return spec.resolveObject(response)
+		}
+	}
+	return nil
+}
+
+// schemaFinding is a difference between an observed schema and the documented one.
+type schemaFinding struct {
+	findingType string
+	location    string
+	message     string
+}
+
+// flatten merges the allOf sub-schemas of a documented schema into a single schema.
+func (spec *ReferenceSpec) flatten(reference map[string]interface{}, depth int) map[string]interface{} {
+	allOf, ok := reference["allOf"].([]interface{})
+	if !ok || depth > maxReferenceDepth {
+		return reference
+	}
+	properties := make(map[string]interface{})
+	var required []interface{}
+	flattened := make(map[string]interface{}, len(reference))
+	for key, value := range reference {
+		flattened[key] = value
+	}
+	delete(flattened, "allOf")
+	parts := []map[string]interface{}{reference}
+	for _, node := range allOf {
+		if part := spec.flatten(spec.resolveObject(node), depth+1); part != nil {
+			parts = append(parts, part)
+		}
+	}
+	for _, part := range parts {
+		if partProperties, ok := part["properties"].(map[string]interface{}); ok {
+			for name, property := range partProperties {
+				properties[name] = property
+			}
+		}
+		if partRequired, ok := part["required"].([]interface{}); ok {
+			required = append(required, partRequired...)
+		}
+		if _, ok := flattened["type"]; !ok && part["type"] != nil {
+			flattened["type"] = part["type"]
+		}
+		if additional, ok := part["additionalProperties"]; ok {
+			flattened["additionalProperties"] = additional
+		}
+	}
+	flattened["properties"] = properties
+	flattened["required"] = required
+	return flattened
+}
+
+// referenceTypes returns the types a documented schema allows, or nil if it allows any type.
+func referenceTypes(reference map[string]interface{}) []string {
+	var types []string
+	switch typedValue := reference["type"].(type) {
+	case string:
+		types = append(types, typedValue)
+	case []interface{}:
+		for _, item := range typedValue {
+			if itemType, ok := item.(string); ok {
+				types = append(types, itemType)
+			}
+		}
+	}
+	if nullable, _ := reference["nullable"].(bool); nullable && len(types) > 0 {
+		types = append(types, schemaTypeNull)
+	}
+	return types
+}
+
+func typeAllowed(observedType string, types []string) bool {
+	for _, allowedType := range types {
+		if observedType == allowedType || (observedType == schemaTypeInteger && allowedType == schemaTypeNumber) {
+			return true
+		}
+	}
+	return false
+}
+
+// compareSchema compares an observed schema to the documented one, and returns the differences.
+func (spec *ReferenceSpec) compareSchema(observed *Schema, node interface{}, location string, depth int) []schemaFinding {
+	reference := spec.resolveObject(node)
+	if observed == nil || reference == nil || depth > maxSchemaDepth {
+		return nil
+	}
+	if len(observed.OneOf) > 0 {
+		var findings []schemaFinding
+		for _, variant := range observed.OneOf {
+			findings = append(findings, spec.compareSchema(variant, reference, location, depth+1)...)
+		}
+		return findings
+	}
+	reference = spec.flatten(reference, 0)
+
+	// The observed value should conform to one of the alternatives, we report the differences from the closest one.
+	for _, keyword := range []string{"oneOf", "anyOf"} {
+		alternatives, ok := reference[keyword].([]interface{})
+		if !ok || len(alternatives) == 0 {
+			continue
+		}
+		var closest []schemaFinding
+		for i, alternative := range alternatives {
+			findings := spec.compareSchema(observed, alternative, location, depth+1)
+			if i == 0 || len(findings) < len(closest) {
+				closest = findings
+			}
+		}
+		return closest
+	}
+
+	if types := referenceTypes(reference); observed.Type != "" && len(types) > 0 && !typeAllowed(observed.Type, types) {
+		return []schemaFinding{{
+			findingType: driftTypeMismatch,
+			location:    location,
+			message:     fmt.Sprintf("observed %s, documented %s", observed.Type, strings.Join(types, " or ")),
+		}}
+	}
+
+	var findings []schemaFinding
+	switch observed.Type {
+	case schemaTypeObject:
+		properties, _ := reference["properties"].(map[string]interface{})
+		names := make([]string, 0, len(observed.Properties))
+		for name := range observed.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			propertyLocation := location + "." + name
+			if property, ok := properties[name]; ok {
+				findings = append(findings, spec.compareSchema(observed.Properties[name], property, propertyLocation, depth+1)...)
+				continue
+			}
+			switch additional := reference["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					findings = append(findings, schemaFinding{
+						findingType: driftProhibitedExtraField,
+						location:    propertyLocation,
+						message:     "field is not allowed by the documented schema",
+					})
+				}
+			case map[string]interface{}:
+				findings = append(findings, spec.compareSchema(observed.Properties[name], additional, propertyLocation, depth+1)...)
+			default:
+				findings = append(findings, schemaFinding{
+					findingType: driftUndocumentedField,
+					location:    propertyLocation,
+					message:     "field is not documented",
+				})
+			}
+		}
+		required, _ := reference["required"].([]interface{})
+		for _, item := range required {
+			name, _ := item.(string)
+			if property, ok := observed.Properties[name]; !ok || property.SampleCount < observed.SampleCount {
+				findings = append(findings, schemaFinding{
+					findingType: driftMissingRequiredField,
+					location:    location + "." + name,
+					message:     "required field is missing from some of the observed values",
+				})
+			}
+		}
+	case schemaTypeArray:
+		findings = append(findings, spec.compareSchema(observed.Items, reference["items"], location+"[]", depth+1)...)
+	}
+	return findings
+}
+
+// DriftDetector compares the api inventory to a reference specification, and emits an event for every difference.
+// Each difference is emitted once.
+type DriftDetector struct {
+	spec *ReferenceSpec
+	// seen holds the documented endpoints that were observed.
+	seen     map[string]struct{}
+	reported map[string]struct{}
+	// changed holds the inventory entries that recorded transactions since they were last compared.
+	changed map[*ApiSchema]struct{}
+	events  *EventSink
+}
+
+// NewDriftDetector creates a new instance of the drift detector.
+func NewDriftDetector(spec *ReferenceSpec, events *EventSink) *DriftDetector {
+	return &DriftDetector{
+		spec:     spec,
+		seen:     make(map[string]struct{}),
+		reported: make(map[string]struct{}),
+		changed:  make(map[*ApiSchema]struct{}),
+		events:   events,
+	}
+}
+
+func (detector *DriftDetector) emit(findingType string, severity string, schema *ApiSchema, message string, details map[string]interface{}) {
+	// Maps are printed sorted by key, so the details are a stable part of the key.
+	key := fmt.Sprintf("%s|%s|%s|%s|%v", findingType, schema.method, schema.uri, message, details)
+	if _, ok := detector.reported[key]; ok || len(detector.reported) >= maxDriftReports {
+		return
+	}
+	detector.reported[key] = struct{}{}
+	if len(detector.reported) == maxDriftReports {
+		log.Printf("Reported %d drift differences, the differences found from now on are not reported", maxDriftReports)
+	}
+	detector.events.Emit(Event{
+		Category: driftEventCategory,
+		Type:     findingType,
+		Severity: severity,
+		Method:   schema.method,
+		Path:     schema.uri,
+		Message:  message,
+		Details:  details,
+	})
+}
+
+func (detector *DriftDetector) emitSchemaFindings(schema *ApiSchema, body string, statusCode int, findings []schemaFinding) {
+	for _, finding := range findings {
+		severity := eventSeverityWarning
+		if finding.findingType == driftUndocumentedField {
+			// The schema was extended, which is drift rather than a violation.
+			severity = eventSeverityInfo
+		}
+		details := map[string]interface{}{
+			"body":     body,
+			"location": finding.location,
+		}
+		if statusCode != 0 {
+			details["status"] = statusCode
+		}
+		detector.emit(finding.findingType, severity, schema, finding.message, details)
+	}
+}
+
+// observedStatusCodes returns the status codes the endpoint responded with, in order.
+func observedStatusCodes(schema *ApiSchema) []int {
+	statusCodes := make([]int, 0, len(schema.statusCodes))
+	for statusCode := range schema.statusCodes {
+		statusCodes = append(statusCodes, statusCode)
+	}
+	sort.Ints(statusCodes)
+	return statusCodes
+}
+
+// check compares a single inventory entry to the reference specification.
+func (detector *DriftDetector) check(schema *ApiSchema) {
+	if _, ok := openAPIMethods[schema.method]; !ok {
+		return
+	}
+	endpoint := detector.spec.match(schema.method, schema.uri)
+	if endpoint == nil {
+		detector.emit(driftShadowEndpoint, eventSeverityWarning, schema, "endpoint is not documented", nil)
+		return
+	}
+	detector.seen[endpoint.key()] = struct{}{}
+
+	schema.mutex.RLock()
+	defer schema.mutex.RUnlock()
+	// The bodies of GraphQL operations and JSON-RPC methods are recorded without their envelope, so they cannot be
+	// compared to the documented bodies.
+	comparableBodies := schema.graphql == nil && schema.jsonRPC == nil
+	for _, statusCode := range observedStatusCodes(schema) {
+		response := detector.spec.response(endpoint, statusCode)
+		if response == nil {
+			detector.emit(driftUndeclaredStatusCode, eventSeverityWarning, schema, "response code is not documented",
+				map[string]interface{}{"status": statusCode, "documented_path": endpoint.path})
+			continue
+		}
+		observedBody := schema.errorSchemas[statusCode]
+		if statusCode >= http.StatusOK && statusCode < http.StatusMultipleChoices {
+			observedBody = schema.responseSchema
+		}
+		if !comparableBodies || observedBody == nil {
+			continue
+		}
+		documentedBody := detector.spec.jsonContentSchema(response)
+		if documentedBody == nil {
+			detector.emit(driftUndocumentedBody, eventSeverityWarning, schema, "response body is not documented",
+				map[string]interface{}{"body": driftLocationResponseBody, "status": statusCode})
+			continue
+		}
+		findings := detector.spec.compareSchema(observedBody, documentedBody, "$", 0)
+		detector.emitSchemaFindings(schema, driftLocationResponseBody, statusCode, findings)
+	}
+
+	if observedRequestBody := schema.jsonRequestSchema(); comparableBodies && observedRequestBody != nil {
+		requestBody := detector.spec.resolveObject(endpoint.operation["requestBody"])
+		if requestBody == nil {
+			detector.emit(driftUndocumentedBody, eventSeverityWarning, schema, "request body is not documented",
+				map[string]interface{}{"body": driftLocationRequestBody})
+		} else {
+			findings := detector.spec.compareSchema(observedRequestBody, detector.spec.jsonContentSchema(requestBody), "$", 0)
+			detector.emitSchemaFindings(schema, driftLocationRequestBody, 0, findings)
+		}
+	}
+}
+
+// reportUnseen emits an event for every documented endpoint that was not observed.
+func (detector *DriftDetector) reportUnseen() {
+	for _, endpoint := range detector.spec.endpoints {
+		if _, ok := detector.seen[endpoint.key()]; ok {
+			continue
+		}
+		detector.emit(driftUnseenEndpoint, eventSeverityInfo, &ApiSchema{method: endpoint.method, uri: endpoint.path},
+			"documented endpoint was not observed", nil)
+	}
+}
+
+// markDriftChanged records that an inventory entry changed, so it is compared to the reference specification again.
+func (factory *Factory) markDriftChanged(schema *ApiSchema) {
+	if factory.drift != nil {
+		factory.drift.changed[schema] = struct{}{}
+	}
+}
+
+// detectDrift compares the inventory entries that changed since the last time to the reference specification, if one
+// was loaded. The caller must hold the factory lock.
+func (factory *Factory) detectDrift() {
+	if factory.drift == nil {
+		return
+	}
+	for schema := range factory.drift.changed {
+		delete(factory.drift.changed, schema)
+		// Entries merged into another one when their paths were templated again are no longer in the inventory.
+		if factory.apiInventory[schema.inventoryKey()] == schema {
+			factory.drift.check(schema)
+		}
+	}
+}
+
+// ReportUnseenEndpoints emits an event for every endpoint of the reference specification that was not observed.
+func (factory *Factory) ReportUnseenEndpoints() {
+	factory.mutex.Lock()
+	defer factory.mutex.Unlock()
+	if factory.drift == nil {
+		return
+	}
+	factory.detectDrift()
+	factory.drift.reportUnseen()
+}
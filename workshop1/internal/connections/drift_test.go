@@ -0,0 +1,133 @@
+package connections
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testReferenceSpec = `openapi: 3.0.0
+servers:
+  - url: https://api.example.com/v1/
+  - url: '{scheme}://staging.example.com/{base}'
+    variables:
+      scheme:
+        default: https
+      base:
+        default: api/v2
+  - url: /
+paths:
+  /:
+    get:
+      responses:
+        '200':
+          description: index
+  /users/{id}:
+    get:
+      responses:
+        '200':
+          description: user
+  /users/me:
+    get:
+      responses:
+        '200':
+          description: current user
+`
+
+func loadTestReferenceSpec(t *testing.T) *ReferenceSpec {
+	path := filepath.Join(t.TempDir(), "openapi.yaml")
+	if err := os.WriteFile(path, []byte(testReferenceSpec), 0600); err != nil {
+		t.Fatal(err)
+	}
+	spec, err := LoadReferenceSpec(path)
+	if err != nil {
+		t.Fatalf("LoadReferenceSpec() error = %v", err)
+	}
+	return spec
+}
+
+func TestReferenceSpecMatch(t *testing.T) {
+	spec := loadTestReferenceSpec(t)
+	if !equalStrings(spec.basePaths, []string{"/api/v2", "/v1"}) {
+		t.Errorf("LoadReferenceSpec() base paths = %v, want [/api/v2 /v1]", spec.basePaths)
+	}
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{"GET", "/v1/users/{id}", "/users/{id}"},
+		{"GET", "/v1/users/me", "/users/me"},
+		{"GET", "/api/v2/users/{id}", "/users/{id}"},
+		{"GET", "/users/{id}", "/users/{id}"},
+		{"GET", "/v1", "/"},
+		{"GET", "/v1/", "/"},
+		{"GET", "/v10/users/{id}", ""},
+		{"GET", "/v2/users/{id}", ""},
+		{"POST", "/v1/users/{id}", ""},
+	}
+	for _, test := range tests {
+		got := ""
+		if endpoint := spec.match(test.method, test.path); endpoint != nil {
+			got = endpoint.path
+		}
+		if got != test.want {
+			t.Errorf("match(%q, %q) = %q, want %q", test.method, test.path, got, test.want)
+		}
+	}
+}
+
+func TestDetectDriftChecksChangedEntries(t *testing.T) {
+	factory := NewFactory(time.Minute)
+	var events strings.Builder
+	factory.SetEventSink(NewEventSink(&events))
+	factory.addHTTPTransaction(newTestTransaction("GET", "/internal/debug", "", http.StatusOK, "", ""))
+	// Entries recorded before the specification was set are compared as well.
+	factory.SetReferenceSpec(loadTestReferenceSpec(t))
+	factory.addHTTPTransaction(newTestTransaction("GET", "/v1/users/1", "", http.StatusOK, "", ""))
+
+	tests := []struct {
+		name        string
+		transaction *httpTransaction
+		events      int
+	}{
+		{"first comparison", nil, 1},
+		{"nothing changed", nil, 1},
+		{"documented endpoint", newTestTransaction("GET", "/v1/users/2", "", http.StatusOK, "", ""), 1},
+		{"undeclared response code", newTestTransaction("GET", "/v1/users/3", "", http.StatusNotFound, "", ""), 2},
+		{"another shadow endpoint", newTestTransaction("DELETE", "/v1/users/3", "", http.StatusOK, "", ""), 3},
+	}
+	for _, test := range tests {
+		if test.transaction != nil {
+			factory.addHTTPTransaction(test.transaction)
+			if len(factory.drift.changed) != 1 {
+				t.Errorf("%s: addHTTPTransaction() marked %d entries as changed, want 1", test.name,
+					len(factory.drift.changed))
+			}
+		}
+		factory.detectDrift()
+		if got := strings.Count(events.String(), `"category":"drift"`); got != test.events ||
+			len(factory.drift.changed) != 0 {
+			t.Errorf("%s: detectDrift() emitted %d events with %d entries left to compare, want %d with none", test.name,
+				got, len(factory.drift.changed), test.events)
+		}
+	}
+}
+
+func TestDriftDetectorBoundsReports(t *testing.T) {
+	var events strings.Builder
+	detector := NewDriftDetector(&ReferenceSpec{}, NewEventSink(&events))
+	for i := 0; i < maxDriftReports; i++ {
+		detector.emit(driftShadowEndpoint, eventSeverityWarning, &ApiSchema{method: "GET", uri: fmt.Sprintf("/%d", i)},
+			"endpoint is not documented", nil)
+	}
+	detector.emit(driftShadowEndpoint, eventSeverityWarning, &ApiSchema{method: "GET", uri: "/new"},
+		"endpoint is not documented", nil)
+	if got := strings.Count(events.String(), "\n"); got != maxDriftReports || len(detector.reported) != maxDriftReports {
+		t.Errorf("emit() emitted %d events and remembered %d, want %d", got, len(detector.reported), maxDriftReports)
+	}
+}
@@ -0,0 +1,76 @@
+package connections
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	// maxDecodedBodySize bounds the size of a decompressed body, so compression bombs do not exhaust the memory.
+	maxDecodedBodySize = 4 * 1024 * 1024 // 4MB
+)
+
+var (
+	errDecodedBodyTooLarge = errors.New("decoded body exceeds the size limit")
+)
+
+// decodeContentEncoding removes the content codings of a body, in the reverse order they were applied. The chunked
+// transfer coding is removed by the HTTP parser before.
+func decodeContentEncoding(header http.Header, body []byte) ([]byte, error) {
+	codings := make([]string, 0)
+	for _, value := range header.Values("Content-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			if coding = strings.ToLower(strings.TrimSpace(coding)); coding != "" && coding != "identity" {
+				codings = append(codings, coding)
+			}
+		}
+	}
+	for i := len(codings) - 1; i >= 0 && len(body) > 0; i-- {
+		var err error
+		if body, err = decodeContentCoding(codings[i], body); err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+func decodeContentCoding(coding string, body []byte) ([]byte, error) {
+	var reader io.ReadCloser
+	var err error
+	switch coding {
+	case "gzip", "x-gzip":
+		reader, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		// Deflate should be wrapped by zlib, but some servers send a raw deflate stream.
+		reader, err = zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			reader, err = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	case "br":
+		reader = io.NopCloser(brotli.NewReader(bytes.NewReader(body)))
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", coding)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s body: %v", coding, err)
+	}
+	defer reader.Close()
+	decoded, err := io.ReadAll(io.LimitReader(reader, maxDecodedBodySize+1))
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("failed to decode %s body: %v", coding, err)
+	}
+	if len(decoded) > maxDecodedBodySize {
+		return nil, errDecodedBodyTooLarge
+	}
+	// A body truncated by the end of the capture is decoded as far as it goes.
+	return decoded, nil
+}
@@ -0,0 +1,52 @@
+package connections
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	eventSeverityInfo    = "info"
+	eventSeverityWarning = "warning"
+	eventSeverityHigh    = "high"
+)
+
+// Event is a structured finding, written as a single JSON line so it can be shipped to a log pipeline.
+type Event struct {
+	Timestamp time.Time `json:"timestamp"`
+	// Category groups the events of a single detector, such as drift.
+	Category string `json:"category"`
+	Type     string `json:"type"`
+	Severity string `json:"severity"`
+	Method   string `json:"method,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Message  string `json:"message"`
+	// Details holds the attributes specific to the type of the event.
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// EventSink is a routine-safe writer of events, in the JSON lines format.
+type EventSink struct {
+	encoder *json.Encoder
+	mutex   sync.Mutex
+}
+
+// NewEventSink creates a new instance of the event sink, writing to the given writer.
+func NewEventSink(writer io.Writer) *EventSink {
+	return &EventSink{encoder: json.NewEncoder(writer)}
+}
+
+// Emit writes the event, stamping it with the current time if it has no timestamp.
+func (sink *EventSink) Emit(event Event) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if err := sink.encoder.Encode(event); err != nil {
+		log.Printf("Failed writing %s event: %v", event.Type, err)
+	}
+}
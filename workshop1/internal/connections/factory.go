@@ -20,11 +20,13 @@ package connections
 
 import (
 	"bufio"
-	"encoding/json"
+	"bytes"
 	"fmt"
 	"github.com/kiran-sama/ebpf-training/workshop1/internal/structs"
 	"io"
+	"log"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -34,55 +36,168 @@ import (
 type Factory struct {
 	connections         map[structs.ConnID]*Tracker
 	apiInventory        map[string]*ApiSchema
+	mongoInventory      map[string]*MongoCommandStats
+	paths               *PathNormalizer
+	dns                 *DNSTracker
+	events              *EventSink
+	drift               *DriftDetector
+	pii                 *PIIClassifier
+	redactor            *Redactor
+	failureThresholds   []AuthFailureThreshold
 	inactivityThreshold time.Duration
 	mutex               *sync.RWMutex
 }
 
 // NewFactory creates a new instance of the factory.
 func NewFactory(inactivityThreshold time.Duration) *Factory {
+	// The payloads are masked unless the redaction is configured otherwise, masking never fails.
+	redactor, _ := NewRedactor(RedactionMask, "", nil)
+	failureThresholds, _ := ParseAuthFailureThresholds(DefaultAuthFailureThresholds)
+	classifier := NewPIIClassifier()
 	return &Factory{
 		connections:         make(map[structs.ConnID]*Tracker),
 		apiInventory:        make(map[string]*ApiSchema),
+		mongoInventory:      make(map[string]*MongoCommandStats),
+		paths:               NewPathNormalizer(defaultCardinalityThreshold, classifier),
+		dns:                 NewDNSTracker(),
+		events:              NewEventSink(os.Stdout),
+		pii:                 classifier,
+		redactor:            redactor,
+		failureThresholds:   failureThresholds,
 		mutex:               &sync.RWMutex{},
 		inactivityThreshold: inactivityThreshold,
 	}
 }
 
+// SetEventSink sets the sink of the structured events, which are written to the stdout by default.
+func (factory *Factory) SetEventSink(events *EventSink) {
+	factory.mutex.Lock()
+	defer factory.mutex.Unlock()
+	factory.events = events
+	if factory.drift != nil {
+		factory.drift.events = events
+	}
+}
+
+// SetReferenceSpec sets the specification the api inventory is compared to, to detect drift.
+func (factory *Factory) SetReferenceSpec(spec *ReferenceSpec) {
+	factory.mutex.Lock()
+	defer factory.mutex.Unlock()
+	factory.drift = NewDriftDetector(spec, factory.events)
+	for _, schema := range factory.apiInventory {
+		factory.markDriftChanged(schema)
+	}
+}
+
+// SetPIIClassifier replaces the classifier of the PII in the transactions, such as when the PII rules are reloaded.
+func (factory *Factory) SetPIIClassifier(classifier *PIIClassifier) {
+	factory.mutex.Lock()
+	defer factory.mutex.Unlock()
+	factory.pii = classifier
+	factory.paths.pii = classifier
+}
+
+// SetRedactor replaces the redactor of the printed payloads.
+func (factory *Factory) SetRedactor(redactor *Redactor) {
+	factory.mutex.Lock()
+	defer factory.mutex.Unlock()
+	factory.redactor = redactor
+}
+
+// SetAuthFailureThresholds replaces the thresholds the authentication failures of the peers are alerted on.
+func (factory *Factory) SetAuthFailureThresholds(thresholds []AuthFailureThreshold) {
+	factory.mutex.Lock()
+	defer factory.mutex.Unlock()
+	factory.failureThresholds = thresholds
+}
+
 func (factory *Factory) HandleReadyConnections() {
 	trackersToDelete := make(map[structs.ConnID]struct{})
 	factory.mutex.Lock()
 	defer factory.mutex.Unlock()
 	for connID, tracker := range factory.connections {
+		if tracker.isMongo() {
+			// MongoDB connections are pooled and live long, so their messages are decoded as they arrive rather than
+			// when the connection is closed.
+			done := tracker.IsComplete() || tracker.Malformed() || tracker.IsInactive(factory.inactivityThreshold)
+			factory.handleMongoConnection(tracker, done)
+			if done {
+				trackersToDelete[connID] = struct{}{}
+			}
+			continue
+		}
+		if tracker.webSocket != nil || (!tracker.IsComplete() && factory.detectWebSocketUpgrade(tracker)) {
+			// WebSocket connections live long, so their frames are decoded as they arrive rather than when the
+			// connection is closed.
+			factory.handleWebSocketFrames(tracker)
+			if tracker.IsComplete() || tracker.Malformed() || tracker.IsInactive(factory.inactivityThreshold) {
+				trackersToDelete[connID] = struct{}{}
+			}
+			continue
+		}
 		if tracker.IsComplete() {
 			trackersToDelete[connID] = struct{}{}
 			if len(tracker.sentBuf) == 0 && len(tracker.recvBuf) == 0 {
 				continue
 			}
-			fmt.Printf("========================>\nFound HTTP payload\nRequest->\n%s\n\nResponse->\n%s\n\n<========================\n", tracker.recvBuf, tracker.sentBuf)
-			reader := bufio.NewReader(strings.NewReader(string(tracker.recvBuf)))
-			req, e1 := http.ReadRequest(reader)
-			reader = bufio.NewReader(strings.NewReader(string(tracker.sentBuf)))
-			res, e2 := http.ReadResponse(reader, req)
-			if e1 == nil && e2 == nil {
-				if res.StatusCode != 200 || !strings.Contains(res.Header.Get("Content-Type"), "application/json") {
-					continue
-				} else {
-					if _, ok := factory.apiInventory[req.Method+"_"+req.RequestURI]; !ok {
-						fmt.Println("New URI found, adding to api inventory")
-						// Building Schema
-						requestSchemaBytes, _ := io.ReadAll(req.Body)
-						requestSchema := string(requestSchemaBytes)
-						responseSchemaBytes, _ := io.ReadAll(res.Body)
-						responseSchema := string(responseSchemaBytes)
-						factory.apiInventory[req.Method+"_"+req.RequestURI] = NewApiSchema(
-							req.Method, req.RequestURI,
-							factory.removeValues(requestSchema),
-							factory.removeValues(responseSchema),
-							factory.detectPII(responseSchema))
+			recvReader := bytes.NewReader(tracker.recvBuf)
+			reqReader := bufio.NewReader(recvReader)
+			sentReader := bytes.NewReader(tracker.sentBuf)
+			resReader := bufio.NewReader(sentReader)
+			// The offsets of the bytes consumed by the parsers, which buffer ahead of them.
+			requestOffset := func() int { return len(tracker.recvBuf) - recvReader.Len() - reqReader.Buffered() }
+			responseOffset := func() int { return len(tracker.sentBuf) - sentReader.Len() - resReader.Buffered() }
+			// A connection holds several transactions when it is kept alive, or when the requests are pipelined.
+			for transactions := 0; ; transactions++ {
+				requestStart := requestOffset()
+				req, e1 := http.ReadRequest(reqReader)
+				if e1 != nil && transactions > 0 {
+					// The end of the stream, or a transaction truncated by the end of the capture.
+					break
+				}
+				responseStart := responseOffset()
+				res, e2 := http.ReadResponse(resReader, req)
+				if e1 == nil && e2 == nil && isWebSocketUpgrade(res) {
+					// Connections upgraded after other transactions are decoded once they are closed.
+					requestEnd := requestOffset()
+					responseEnd := responseOffset()
+					factory.upgradeWebSocket(tracker, req, res,
+						newTransactionTiming(tracker, requestStart, requestEnd, responseStart, responseEnd), requestEnd, responseEnd)
+					factory.handleWebSocketFrames(tracker)
+					break
+				}
+				if e1 != nil || e2 != nil {
+					if transactions == 0 {
+						fmt.Printf("========================>\nFound HTTP payload\nPeer->%s\nRequest->\n%s\n\nResponse->\n%s\n\n<========================\n", factory.peerName(tracker.addr),
+							factory.redactor.formatUnparsed(factory.pii, tracker.recvBuf), factory.redactor.formatUnparsed(factory.pii, tracker.sentBuf))
+						fmt.Println("Error building request/response")
 					}
+					break
+				}
+				transaction := &httpTransaction{req: req, res: res, pid: tracker.connID.TGID, peer: tracker.addr}
+				// Both bodies are read to their end, so the next transaction of the connection can be parsed.
+				requestBody, _ := io.ReadAll(req.Body)
+				responseBody, _ := io.ReadAll(res.Body)
+				transaction.timing = newTransactionTiming(tracker, requestStart, requestOffset(), responseStart, responseOffset())
+				// Compressed bodies are decoded before they are analyzed, the bodies we cannot decode are not analyzed.
+				var err error
+				if transaction.requestBody, err = decodeContentEncoding(req.Header, requestBody); err != nil {
+					log.Printf("Skipping the request body of %s %s: %v", req.Method, factory.redactor.redactRequestURI(factory.pii, req.URL), err)
+				}
+				if transaction.responseBody, err = decodeContentEncoding(res.Header, responseBody); err != nil {
+					log.Printf("Skipping the response body of %s %s: %v", req.Method, factory.redactor.redactRequestURI(factory.pii, req.URL), err)
+				}
+				// The payloads are printed redacted, with the bodies we could decode.
+				printedRequestBody, printedResponseBody := requestBody, responseBody
+				if transaction.requestBody != nil {
+					printedRequestBody = transaction.requestBody
 				}
-			} else {
-				fmt.Println("Error building request/response")
+				if transaction.responseBody != nil {
+					printedResponseBody = transaction.responseBody
+				}
+				fmt.Printf("========================>\nFound HTTP payload\nPeer->%s\nRequest->\n%s\n\nResponse->\n%s\n\n<========================\n", factory.peerName(tracker.addr),
+					factory.redactor.formatRequest(factory.pii, req, printedRequestBody), factory.redactor.formatResponse(factory.pii, res, printedResponseBody))
+				factory.addHTTPTransaction(transaction)
 			}
 		} else if tracker.Malformed() {
 			trackersToDelete[connID] = struct{}{}
@@ -93,38 +208,153 @@ func (factory *Factory) HandleReadyConnections() {
 	for key := range trackersToDelete {
 		delete(factory.connections, key)
 	}
+	factory.dns.Flush(factory.inactivityThreshold)
+	factory.detectDrift()
 	fmt.Println("Api Inventory")
 	for api := range factory.apiInventory {
-		fmt.Printf("========================>\nURI:%s\nMethod:%s\nRequestSchema:%s\nResponseSchema:%s\nContainsPII:%v\n<========================\n",
-			factory.apiInventory[api].uri, factory.apiInventory[api].method,
-			factory.apiInventory[api].requestSchema, factory.apiInventory[api].responseSchema,
-			factory.apiInventory[api].containsPII,
+		fmt.Printf("========================>\nURI:%s\nMethod:%s\nPathParameters:%v\nSamples:%d\nStatusCodes:%v\nContentTypes:%v\nRequestContentTypes:%v\nRequestSchemas:%v\nResponseSchema:%s\nErrorSchemas:%v\nLatency:%s\nContainsPII:%v\n",
+			factory.apiInventory[api].uri, factory.apiInventory[api].method, factory.apiInventory[api].pathParameters,
+			factory.apiInventory[api].samples, factory.apiInventory[api].statusCodes, factory.apiInventory[api].contentTypes,
+			factory.apiInventory[api].requestContentTypes,
+			factory.apiInventory[api].requestSchemas, factory.apiInventory[api].responseSchema,
+			factory.apiInventory[api].errorSchemas, factory.apiInventory[api].latency, factory.apiInventory[api].containsPII,
+		)
+		fmt.Printf("QueryParameters:%v\nRequestHeaders:%v\nResponseHeaders:%v\nCookies:%v\nPII:%v\nAuth:%s\n",
+			factory.apiInventory[api].queryParameters, factory.apiInventory[api].headers,
+			factory.apiInventory[api].responseHeaders, factory.apiInventory[api].cookies,
+			sortedPIIFindings(factory.apiInventory[api].piiFindings), factory.apiInventory[api].auth,
 		)
+		if len(factory.apiInventory[api].hygiene) > 0 {
+			fmt.Printf("Hygiene:%v\n", sortedHygieneFindings(factory.apiInventory[api].hygiene))
+		}
+		if len(factory.apiInventory[api].objects.identities) > 0 {
+			fmt.Printf("ObjectAccess:%s\n", factory.apiInventory[api].objects)
+		}
+		if len(factory.apiInventory[api].authFailures) > 0 {
+			fmt.Printf("AuthFailures:%v\n", sortedAuthFailures(factory.apiInventory[api].authFailures))
+		}
+		if len(factory.apiInventory[api].secrets) > 0 {
+			fmt.Printf("Secrets:%v\n", sortedSecretFindings(factory.apiInventory[api].secrets))
+		}
+		if factory.apiInventory[api].graphql != nil {
+			fmt.Printf("GraphQL:%s\n", factory.apiInventory[api].graphql)
+		}
+		if factory.apiInventory[api].jsonRPC != nil {
+			fmt.Printf("JSONRPC:%s\n", factory.apiInventory[api].jsonRPC)
+		}
+		if factory.apiInventory[api].websocket != nil {
+			fmt.Printf("WebSocket:%s\n", factory.apiInventory[api].websocket)
+		}
+		fmt.Println("<========================")
 	}
+	factory.printMongoInventory()
+}
+
+// httpTransaction is a request and its response, parsed from a connection.
+type httpTransaction struct {
+	req          *http.Request
+	res          *http.Response
+	requestBody  []byte
+	responseBody []byte
+	timing       transactionTiming
+	// pid is the process that served the connection, and peer the address of the other end.
+	pid  uint32
+	peer structs.SockAddrIn
 }
 
-func (factory *Factory) removeValues(payload string) string {
-	var x map[string]interface{}
-	json.Unmarshal([]byte(payload), &x)
-	for key := range x {
-		x[key] = ""
+// addHTTPTransaction adds a parsed transaction to the api inventory.
+func (factory *Factory) addHTTPTransaction(transaction *httpTransaction) {
+	req, res := transaction.req, transaction.res
+	requestBody, responseBody := transaction.requestBody, transaction.responseBody
+	requestType, requestParams := parseContentType(req.Header)
+	contentType, contentParams := parseContentType(res.Header)
+	successful := res.StatusCode >= http.StatusOK && res.StatusCode < http.StatusMultipleChoices
+	// Attacks are looked for once per request, before it is split into operations.
+	factory.detectAttacks(transaction)
+	// GraphQL endpoints serve many operations on a single URI, so each operation is an entry of its own. The request
+	// tells them apart, whatever the response, so the rejected operations are recorded as well.
+	if factory.addGraphQLOperations(transaction) {
+		return
 	}
-	jsonString, _ := json.Marshal(x)
-	return string(jsonString)
-}
-
-func (factory *Factory) detectPII(payload string) bool {
-	keys := make(map[string]struct{})
-	keys["email"] = struct{}{}
-	keys["mobile"] = struct{}{}
-	keys["firstname"] = struct{}{}
-	keys["lastname"] = struct{}{}
-	for key := range keys {
-		if strings.Contains(payload, key) {
-			return true
-		}
+	// Likewise, each method of a JSON-RPC endpoint is an entry of its own.
+	if factory.addJSONRPCCalls(transaction) {
+		return
+	}
+
+	// The query string and the identifiers in the path are not part of the endpoint.
+	path, parameters := factory.endpointPath(req.URL.Path)
+	schema, ok := factory.apiInventory[req.Method+"_"+path]
+	if !ok {
+		fmt.Println("New URI found, adding to api inventory")
+		schema = NewApiSchema(req.Method, path, nil, nil, false)
+		factory.apiInventory[req.Method+"_"+path] = schema
+	}
+	schema.addParameters(req, parameters)
+	if len(requestBody) > 0 {
+		schema.addRequestContentType(requestType)
 	}
-	return false
+
+	var responseSchema *Schema
+	if contentType != "" {
+		responseSchema = inferBodySchema(contentType, contentParams, responseBody)
+	}
+	schema.addResponse(res, responseSchema)
+	schema.addLatency(transaction.timing)
+	// Personal data is looked for in every part of the transaction, whatever its status code.
+	findings := factory.pii.classifyBody(piiLocationRequestBody, requestType, requestParams, requestBody)
+	findings = append(findings, factory.pii.classifyBody(piiLocationResponseBody, contentType, contentParams, responseBody)...)
+	factory.analyzeTransaction(schema, transaction, responseBody, findings)
+	if res.StatusCode >= http.StatusBadRequest {
+		// Rejected requests are often malformed, so they do not take part in the request schema.
+		schema.addSample(requestType, nil, nil)
+		return
+	}
+	requestSchema := inferBodySchema(requestType, requestParams, requestBody)
+	if !successful || responseSchema == nil {
+		schema.addSample(requestType, requestSchema, nil)
+		return
+	}
+	// Every transaction is merged into the schema, so a single early sample does not define the endpoint.
+	schema.addSample(requestType, requestSchema, responseSchema)
+}
+
+// analyzeTransaction runs the analyzers of a transaction on an endpoint it belongs to: the PII of its parameters along
+// with the PII findings of its bodies, the leaked secrets, the authentication, the object accesses, the authentication
+// failures and the security headers. The response body is the part of the response that belongs to the endpoint, such
+// as the response of a single operation of a batch.
+func (factory *Factory) analyzeTransaction(schema *ApiSchema, transaction *httpTransaction, responseBody []byte, bodyFindings []*PIIFinding) {
+	req, res := transaction.req, transaction.res
+	factory.markDriftChanged(schema)
+	factory.addPIIFindings(schema, append(factory.pii.classifyParameters(req, res, schema.uri), bodyFindings...))
+	factory.detectSecrets(schema, transaction, responseBody)
+	factory.inspectAuth(schema, req, res, transaction.timing.capturedAt)
+	factory.trackObjectAccess(schema, req, res, schema.uri)
+	factory.countAuthFailures(schema, transaction)
+	factory.checkHygiene(schema, req, res)
+}
+
+// responseMediaType returns the media type of the response body, without its parameters.
+func responseMediaType(res *http.Response) string {
+	mediaType, _ := parseContentType(res.Header)
+	return mediaType
+}
+
+// isJSONMediaType checks whether the media type is JSON, including the structured syntax suffix (RFC 6839).
+func isJSONMediaType(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// peerName formats the peer address, labeled with the hostname the traced processes resolved for it, if any.
+func (factory *Factory) peerName(addr structs.SockAddrIn) string {
+	if hostname, ok := factory.dns.Hostname(addr.IP()); ok {
+		return fmt.Sprintf("%s (%s)", addr, hostname)
+	}
+	return addr.String()
+}
+
+// AddDNSEvent hands a DNS message captured over UDP to the DNS tracker.
+func (factory *Factory) AddDNSEvent(event structs.DNSEvent) {
+	factory.dns.AddEvent(event)
 }
 
 // GetOrCreate returns a tracker that related to the given connection and transaction ids. If there is no such tracker
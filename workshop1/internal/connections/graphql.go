@@ -0,0 +1,509 @@
+package connections
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	graphQLTokenName = iota
+	graphQLTokenPunctuator
+	graphQLTokenValue
+
+	// maxGraphQLFragmentDepth bounds the fragment spreads we follow, fragments may (illegally) spread each other.
+	maxGraphQLFragmentDepth = 10
+)
+
+var (
+	errGraphQLUnexpectedEnd = errors.New("unexpected end of graphql document")
+	// graphQLRequestKeys are the keys allowed in a GraphQL-over-HTTP request body.
+	graphQLRequestKeys = map[string]struct{}{
+		"query":         {},
+		"operationName": {},
+		"variables":     {},
+		"extensions":    {},
+	}
+)
+
+// GraphQLOperation describes a single operation of a GraphQL document.
+type GraphQLOperation struct {
+	// operationType is one of query, mutation or subscription.
+	operationType string
+	name          string
+	// fields are the top-level fields the operation selects, with the fragments expanded.
+	fields []string
+}
+
+func (operation *GraphQLOperation) String() string {
+	name := operation.name
+	if name == "" {
+		name = "<anonymous>"
+	}
+	return fmt.Sprintf("%s %s %v", operation.operationType, name, operation.fields)
+}
+
+// key identifies the operation in the inventory. Anonymous operations are identified by their fields.
+func (operation *GraphQLOperation) key() string {
+	if operation.name != "" {
+		return operation.operationType + " " + operation.name
+	}
+	return operation.operationType + " {" + strings.Join(operation.fields, ",") + "}"
+}
+
+type graphQLToken struct {
+	kind  int
+	value string
+}
+
+// tokenizeGraphQL splits a GraphQL document into names, punctuators and values, dropping comments and commas.
+func tokenizeGraphQL(document string) ([]graphQLToken, error) {
+	tokens := make([]graphQLToken, 0)
+	document = strings.TrimPrefix(document, "\ufeff")
+	for i := 0; i < len(document); {
+		c := document[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			// Whitespace and commas are insignificant.
+			i++
+		case c == '#':
+			for i < len(document) && document[i] != '\n' && document[i] != '\r' {
+				i++
+			}
+		case strings.HasPrefix(document[i:], "..."):
+			tokens = append(tokens, graphQLToken{kind: graphQLTokenPunctuator, value: "..."})
+			i += 3
+		case strings.IndexByte("!$&()[]{}:=@|", c) != -1:
+			tokens = append(tokens, graphQLToken{kind: graphQLTokenPunctuator, value: string(c)})
+			i++
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			start := i
+			for i < len(document) && isGraphQLNameChar(document[i]) {
+				i++
+			}
+			tokens = append(tokens, graphQLToken{kind: graphQLTokenName, value: document[start:i]})
+		case c == '-' || (c >= '0' && c <= '9'):
+			start := i
+			i++
+			for i < len(document) && (isGraphQLNameChar(document[i]) || document[i] == '.' || document[i] == '+' || document[i] == '-') {
+				i++
+			}
+			tokens = append(tokens, graphQLToken{kind: graphQLTokenValue, value: document[start:i]})
+		case strings.HasPrefix(document[i:], `"""`):
+			end := strings.Index(strings.ReplaceAll(document[i+3:], `\"""`, "xxxx"), `"""`)
+			if end == -1 {
+				return nil, errGraphQLUnexpectedEnd
+			}
+			tokens = append(tokens, graphQLToken{kind: graphQLTokenValue, value: document[i : i+3+end+3]})
+			i += 3 + end + 3
+		case c == '"':
+			start := i
+			i++
+			for i < len(document) && document[i] != '"' {
+				if document[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(document) {
+				return nil, errGraphQLUnexpectedEnd
+			}
+			i++
+			tokens = append(tokens, graphQLToken{kind: graphQLTokenValue, value: document[start:i]})
+		default:
+			return nil, fmt.Errorf("unexpected character %q in graphql document", c)
+		}
+	}
+	return tokens, nil
+}
+
+func isGraphQLNameChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// graphQLSelection is a top-level selection of an operation or a fragment.
+type graphQLSelection struct {
+	// field is set for fields, and spread for fragment spreads. Inline fragments are expanded in place.
+	field  string
+	spread string
+}
+
+type graphQLParser struct {
+	tokens   []graphQLToken
+	position int
+}
+
+func (parser *graphQLParser) peek() (graphQLToken, bool) {
+	if parser.position >= len(parser.tokens) {
+		return graphQLToken{}, false
+	}
+	return parser.tokens[parser.position], true
+}
+
+func (parser *graphQLParser) next() (graphQLToken, error) {
+	token, ok := parser.peek()
+	if !ok {
+		return graphQLToken{}, errGraphQLUnexpectedEnd
+	}
+	parser.position++
+	return token, nil
+}
+
+func (parser *graphQLParser) peekPunctuator(value string) bool {
+	token, ok := parser.peek()
+	return ok && token.kind == graphQLTokenPunctuator && token.value == value
+}
+
+func (parser *graphQLParser) expectPunctuator(value string) error {
+	token, err := parser.next()
+	if err != nil {
+		return err
+	}
+	if token.kind != graphQLTokenPunctuator || token.value != value {
+		return fmt.Errorf("expected %q but found %q in graphql document", value, token.value)
+	}
+	return nil
+}
+
+func (parser *graphQLParser) expectName() (string, error) {
+	token, err := parser.next()
+	if err != nil {
+		return "", err
+	}
+	if token.kind != graphQLTokenName {
+		return "", fmt.Errorf("expected a name but found %q in graphql document", token.value)
+	}
+	return token.value, nil
+}
+
+// skipBalanced skips a block that starts at the current token and ends with the matching closing punctuator.
+func (parser *graphQLParser) skipBalanced(open string, closing string) error {
+	if err := parser.expectPunctuator(open); err != nil {
+		return err
+	}
+	for depth := 1; depth > 0; {
+		token, err := parser.next()
+		if err != nil {
+			return err
+		}
+		if token.kind != graphQLTokenPunctuator {
+			continue
+		}
+		switch token.value {
+		case open:
+			depth++
+		case closing:
+			depth--
+		}
+	}
+	return nil
+}
+
+// skipDirectives skips the directives (@name(arguments)) that follow the current position.
+func (parser *graphQLParser) skipDirectives() error {
+	for parser.peekPunctuator("@") {
+		parser.position++
+		if _, err := parser.expectName(); err != nil {
+			return err
+		}
+		if parser.peekPunctuator("(") {
+			if err := parser.skipBalanced("(", ")"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseSelectionSet returns the selections of the selection set at the current position, skipping the nested ones.
+func (parser *graphQLParser) parseSelectionSet() ([]graphQLSelection, error) {
+	if err := parser.expectPunctuator("{"); err != nil {
+		return nil, err
+	}
+	selections := make([]graphQLSelection, 0)
+	for !parser.peekPunctuator("}") {
+		if parser.peekPunctuator("...") {
+			parser.position++
+			token, ok := parser.peek()
+			if ok && token.kind == graphQLTokenName && token.value != "on" {
+				parser.position++
+				selections = append(selections, graphQLSelection{spread: token.value})
+				if err := parser.skipDirectives(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			// An inline fragment, with an optional type condition.
+			if ok && token.kind == graphQLTokenName {
+				parser.position++
+				if _, err := parser.expectName(); err != nil {
+					return nil, err
+				}
+			}
+			if err := parser.skipDirectives(); err != nil {
+				return nil, err
+			}
+			inline, err := parser.parseSelectionSet()
+			if err != nil {
+				return nil, err
+			}
+			selections = append(selections, inline...)
+			continue
+		}
+
+		name, err := parser.expectName()
+		if err != nil {
+			return nil, err
+		}
+		// The first name is an alias, the field name follows it.
+		if parser.peekPunctuator(":") {
+			parser.position++
+			if name, err = parser.expectName(); err != nil {
+				return nil, err
+			}
+		}
+		if parser.peekPunctuator("(") {
+			if err := parser.skipBalanced("(", ")"); err != nil {
+				return nil, err
+			}
+		}
+		if err := parser.skipDirectives(); err != nil {
+			return nil, err
+		}
+		if parser.peekPunctuator("{") {
+			if err := parser.skipBalanced("{", "}"); err != nil {
+				return nil, err
+			}
+		}
+		selections = append(selections, graphQLSelection{field: name})
+	}
+	parser.position++
+	return selections, nil
+}
+
+// parseGraphQLDocument returns the operations of a GraphQL document, with the top-level fields of each.
+func parseGraphQLDocument(document string) ([]*GraphQLOperation, error) {
+	tokens, err := tokenizeGraphQL(document)
+	if err != nil {
+		return nil, err
+	}
+	parser := &graphQLParser{tokens: tokens}
+	operationSelections := make(map[*GraphQLOperation][]graphQLSelection)
+	operations := make([]*GraphQLOperation, 0)
+	fragments := make(map[string][]graphQLSelection)
+	for {
+		token, ok := parser.peek()
+		if !ok {
+			break
+		}
+		operation := &GraphQLOperation{operationType: "query"}
+		switch {
+		case token.kind == graphQLTokenPunctuator && token.value == "{":
+			// The query shorthand.
+		case token.kind == graphQLTokenName && token.value == "fragment":
+			parser.position++
+			name, err := parser.expectName()
+			if err != nil {
+				return nil, err
+			}
+			// on <type>.
+			if _, err := parser.expectName(); err != nil {
+				return nil, err
+			}
+			if _, err := parser.expectName(); err != nil {
+				return nil, err
+			}
+			if err := parser.skipDirectives(); err != nil {
+				return nil, err
+			}
+			if fragments[name], err = parser.parseSelectionSet(); err != nil {
+				return nil, err
+			}
+			continue
+		case token.kind == graphQLTokenName && (token.value == "query" || token.value == "mutation" || token.value == "subscription"):
+			parser.position++
+			operation.operationType = token.value
+			if next, ok := parser.peek(); ok && next.kind == graphQLTokenName {
+				operation.name = next.value
+				parser.position++
+			}
+			if parser.peekPunctuator("(") {
+				if err := parser.skipBalanced("(", ")"); err != nil {
+					return nil, err
+				}
+			}
+			if err := parser.skipDirectives(); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unexpected %q in graphql document", token.value)
+		}
+		selections, err := parser.parseSelectionSet()
+		if err != nil {
+			return nil, err
+		}
+		operationSelections[operation] = selections
+		operations = append(operations, operation)
+	}
+	if len(operations) == 0 {
+		return nil, errors.New("graphql document has no operations")
+	}
+
+	for _, operation := range operations {
+		seen := make(map[string]struct{})
+		operation.fields = expandGraphQLSelections(operationSelections[operation], fragments, seen, 0)
+	}
+	return operations, nil
+}
+
+// expandGraphQLSelections returns the distinct field names of the selections, following the fragment spreads.
+func expandGraphQLSelections(selections []graphQLSelection, fragments map[string][]graphQLSelection, seen map[string]struct{}, depth int) []string {
+	fields := make([]string, 0, len(selections))
+	for _, selection := range selections {
+		if selection.spread != "" {
+			if depth < maxGraphQLFragmentDepth {
+				fields = append(fields, expandGraphQLSelections(fragments[selection.spread], fragments, seen, depth+1)...)
+			}
+			continue
+		}
+		if _, ok := seen[selection.field]; ok {
+			continue
+		}
+		seen[selection.field] = struct{}{}
+		fields = append(fields, selection.field)
+	}
+	return fields
+}
+
+// graphQLRequest is a single GraphQL-over-HTTP request.
+type graphQLRequest struct {
+	Query         string          `json:"query"`
+	OperationName string          `json:"operationName"`
+	Variables     json.RawMessage `json:"variables"`
+}
+
+// operation returns the operation the request executes, which is either the only operation in the document or the one
+// selected by the operation name.
+func (request graphQLRequest) operation() (*GraphQLOperation, error) {
+	operations, err := parseGraphQLDocument(request.Query)
+	if err != nil {
+		return nil, err
+	}
+	if len(operations) == 1 {
+		return operations[0], nil
+	}
+	for _, operation := range operations {
+		if operation.name == request.OperationName {
+			return operation, nil
+		}
+	}
+	return nil, fmt.Errorf("operation %q not found in graphql document", request.OperationName)
+}
+
+// parseGraphQLRequests returns the GraphQL requests carried by an HTTP request, either in the query string (GET) or as
+// a single or batched JSON body. A nil slice means the request is not a GraphQL request.
+func parseGraphQLRequests(req *http.Request, body []byte) []graphQLRequest {
+	if req.Method == http.MethodGet {
+		query := req.URL.Query()
+		if query.Get("query") == "" {
+			return nil
+		}
+		return []graphQLRequest{{
+			Query:         query.Get("query"),
+			OperationName: query.Get("operationName"),
+			Variables:     json.RawMessage(query.Get("variables")),
+		}}
+	}
+
+	var rawRequests []map[string]json.RawMessage
+	trimmed := strings.TrimSpace(string(body))
+	if strings.HasPrefix(trimmed, "[") {
+		if err := json.Unmarshal(body, &rawRequests); err != nil {
+			return nil
+		}
+	} else {
+		var rawRequest map[string]json.RawMessage
+		if err := json.Unmarshal(body, &rawRequest); err != nil {
+			return nil
+		}
+		rawRequests = append(rawRequests, rawRequest)
+	}
+
+	requests := make([]graphQLRequest, 0, len(rawRequests))
+	for _, rawRequest := range rawRequests {
+		if _, ok := rawRequest["query"]; !ok {
+			return nil
+		}
+		for key := range rawRequest {
+			if _, ok := graphQLRequestKeys[key]; !ok {
+				return nil
+			}
+		}
+		var request graphQLRequest
+		if err := json.Unmarshal(rawRequest["query"], &request.Query); err != nil {
+			return nil
+		}
+		_ = json.Unmarshal(rawRequest["operationName"], &request.OperationName)
+		request.Variables = rawRequest["variables"]
+		requests = append(requests, request)
+	}
+	return requests
+}
+
+// addGraphQLOperations adds every operation of a GraphQL request as its own inventory entry. It returns false if the
+// request is not a GraphQL request.
+func (factory *Factory) addGraphQLOperations(transaction *httpTransaction) bool {
+	req, res := transaction.req, transaction.res
+	requestBody, responseBody := transaction.requestBody, transaction.responseBody
+	requests := parseGraphQLRequests(req, requestBody)
+	if len(requests) == 0 {
+		return false
+	}
+	operations := make([]*GraphQLOperation, 0, len(requests))
+	for _, request := range requests {
+		operation, err := request.operation()
+		if err != nil {
+			// Not a GraphQL document, such as a search query that happens to be named "query".
+			return false
+		}
+		operations = append(operations, operation)
+	}
+
+	// Batched requests are answered with an array of responses in the same order. Bodies that are not JSON, such as the
+	// error page of a proxy, are not the responses of the operations.
+	responses := make([]json.RawMessage, len(requests))
+	if isJSONMediaType(responseMediaType(res)) {
+		if len(requests) == 1 {
+			responses[0] = responseBody
+		} else {
+			var batch []json.RawMessage
+			if err := json.Unmarshal(responseBody, &batch); err == nil && len(batch) == len(requests) {
+				responses = batch
+			}
+		}
+	}
+
+	for i, operation := range operations {
+		path, parameters := factory.endpointPath(req.URL.Path)
+		key := req.Method + "_" + path + "#" + operation.key()
+		schema, ok := factory.apiInventory[key]
+		if !ok {
+			fmt.Println("New GraphQL operation found, adding to api inventory")
+			schema = NewApiSchema(req.Method, path, nil, nil, false)
+			schema.operation = operation.key()
+			schema.graphql = operation
+			factory.apiInventory[key] = schema
+		}
+		responseSchema := inferSchema(responses[i])
+		schema.addParameters(req, parameters)
+		schema.addResponse(res, responseSchema)
+		schema.addLatency(transaction.timing)
+		schema.addOperationSample(res, inferSchema(requests[i].Variables), responseSchema)
+		findings := factory.pii.classifyBody(piiLocationRequestBody, "", nil, requests[i].Variables)
+		findings = append(findings, factory.pii.classifyBody(piiLocationResponseBody, "", nil, responses[i])...)
+		factory.analyzeTransaction(schema, transaction, responses[i], findings)
+	}
+	return true
+}
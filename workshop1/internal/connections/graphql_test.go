@@ -0,0 +1,162 @@
+package connections
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestTransaction builds a transaction of a request with a JSON body, answered with the given status code and body.
+func newTestTransaction(method string, target string, requestBody string, statusCode int, contentType string, responseBody string) *httpTransaction {
+	requestURL, _ := url.Parse(target)
+	req := &http.Request{Method: method, URL: requestURL, Header: http.Header{}}
+	if requestBody != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res := &http.Response{StatusCode: statusCode, Header: http.Header{}}
+	if contentType != "" {
+		res.Header.Set("Content-Type", contentType)
+	}
+	return &httpTransaction{req: req, res: res, requestBody: []byte(requestBody), responseBody: []byte(responseBody)}
+}
+
+func TestParseGraphQLDocument(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		want     []string
+		wantErr  bool
+	}{
+		{"shorthand", `{ user(id: 1) { name } viewer { id } }`, []string{"query <anonymous> [user viewer]"}, false},
+		{"named with variables", `query GetUser($id: ID!) @cached { user(id: $id) { name } }`,
+			[]string{"query GetUser [user]"}, false},
+		{"aliases and fragments", `mutation Save { saved: saveUser { ...F } } fragment F on User { id name }`,
+			[]string{"mutation Save [saveUser]"}, false},
+		{"fragment at the top", `query Q { ...Root } fragment Root on Query { a b ...Nested } fragment Nested on Query { c a }`,
+			[]string{"query Q [a b c]"}, false},
+		{"spreads each other", `query Q { ...A } fragment A on Query { a ...B } fragment B on Query { b ...A }`,
+			[]string{"query Q [a b]"}, false},
+		{"several operations", `query A { a } subscription B { b }`, []string{"query A [a]", "subscription B [b]"}, false},
+		{"not graphql", `laptops under 500`, nil, true},
+		{"unbalanced", `query { user { name }`, nil, true},
+		{"fragments only", `fragment F on User { id }`, nil, true},
+	}
+	for _, test := range tests {
+		operations, err := parseGraphQLDocument(test.document)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: parseGraphQLDocument() error = %v, want error %v", test.name, err, test.wantErr)
+			continue
+		}
+		got := make([]string, 0)
+		for _, operation := range operations {
+			got = append(got, operation.String())
+		}
+		if !test.wantErr && !equalStrings(got, test.want) {
+			t.Errorf("%s: parseGraphQLDocument() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseGraphQLRequests(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		want   []string
+	}{
+		{"get", "GET", "/graphql?query=%7Bme%7Bid%7D%7D&operationName=Me", "", []string{"{me{id}} Me"}},
+		{"get without query", "GET", "/graphql?q=laptops", "", nil},
+		{"single", "POST", "/graphql", `{"query":"{ me { id } }","variables":{"a":1}}`, []string{"{ me { id } } "}},
+		{"batch", "POST", "/graphql", `[{"query":"query A { a }","operationName":"A"},{"query":"query B { b }"}]`,
+			[]string{"query A { a } A", "query B { b } "}},
+		{"unknown key", "POST", "/graphql", `{"query":"{ me { id } }","page":2}`, nil},
+		{"batch with a non graphql request", "POST", "/graphql", `[{"query":"{ a }"},{"search":"b"}]`, nil},
+		{"not json", "POST", "/graphql", `query { me }`, nil},
+	}
+	for _, test := range tests {
+		requestURL, _ := url.Parse(test.target)
+		requests := parseGraphQLRequests(&http.Request{Method: test.method, URL: requestURL}, []byte(test.body))
+		var got []string
+		for _, request := range requests {
+			got = append(got, request.Query+" "+request.OperationName)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: parseGraphQLRequests() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAddGraphQLOperations(t *testing.T) {
+	batch := `[{"query":"query A { a }","variables":{"id":1}},{"query":"mutation B { b }"}]`
+	tests := []struct {
+		name         string
+		transaction  *httpTransaction
+		statusCodes  map[string]int
+		responses    []string
+		errorSchemas []string
+	}{
+		{"batch", newTestTransaction("POST", "/graphql", batch, http.StatusOK, "application/json",
+			`[{"data":{"a":1}},{"data":{"b":true}}]`),
+			map[string]int{"query A": 200, "mutation B": 200}, []string{"query A", "mutation B"}, nil},
+		{"rejected with graphql errors", newTestTransaction("POST", "/graphql", `{"query":"query A { a }"}`,
+			http.StatusUnauthorized, "application/graphql-response+json", `{"errors":[{"message":"unauthorized"}]}`),
+			map[string]int{"query A": 401}, nil, []string{"query A"}},
+		{"proxy error page", newTestTransaction("POST", "/graphql", batch, http.StatusBadGateway, "text/html",
+			"<html>bad gateway</html>"), map[string]int{"query A": 502, "mutation B": 502}, nil, nil},
+		{"response batch of another size", newTestTransaction("POST", "/graphql", batch, http.StatusOK,
+			"application/json", `[{"data":{"a":1}}]`), map[string]int{"query A": 200, "mutation B": 200}, nil, nil},
+	}
+	for _, test := range tests {
+		factory := NewFactory(time.Minute)
+		factory.SetEventSink(NewEventSink(&strings.Builder{}))
+		factory.addHTTPTransaction(test.transaction)
+		if len(factory.apiInventory) != len(test.statusCodes) {
+			t.Errorf("%s: addHTTPTransaction() added %d entries, want %d", test.name, len(factory.apiInventory),
+				len(test.statusCodes))
+		}
+		responses := make([]string, 0)
+		errorSchemas := make([]string, 0)
+		for operation, statusCode := range test.statusCodes {
+			schema, ok := factory.apiInventory["POST_/graphql#"+operation]
+			if !ok {
+				t.Errorf("%s: addHTTPTransaction() did not add %q", test.name, operation)
+				continue
+			}
+			if schema.statusCodes[statusCode] != 1 || schema.samples != 1 {
+				t.Errorf("%s: %q status codes = %v with %d samples, want one %d", test.name, operation,
+					schema.statusCodes, schema.samples, statusCode)
+			}
+			if schema.responseSchema != nil {
+				responses = append(responses, operation)
+			}
+			if len(schema.errorSchemas) > 0 {
+				errorSchemas = append(errorSchemas, operation)
+			}
+		}
+		if !sameStrings(responses, test.responses) || !sameStrings(errorSchemas, test.errorSchemas) {
+			t.Errorf("%s: addHTTPTransaction() response schemas of %v and error schemas of %v, want %v and %v",
+				test.name, responses, errorSchemas, test.responses, test.errorSchemas)
+		}
+	}
+}
+
+// sameStrings checks whether the slices hold the same strings, in any order.
+func sameStrings(got []string, want []string) bool {
+	counts := make(map[string]int)
+	for _, value := range got {
+		counts[value]++
+	}
+	for _, value := range want {
+		counts[value]--
+	}
+	for _, count := range counts {
+		if count != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,296 @@
+package connections
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	hygieneEventCategory = "hygiene"
+	// hygieneEventResolved reports that a finding reported before no longer holds.
+	hygieneEventResolved = "hygiene_resolved"
+
+	hygieneMissingHSTS           = "missing_hsts"
+	hygieneWeakHSTS              = "weak_hsts"
+	hygieneMissingNoSniff        = "missing_content_type_options"
+	hygieneMissingCSP            = "missing_csp"
+	hygieneWeakCSP               = "weak_csp"
+	hygieneMissingFrameOptions   = "missing_frame_options"
+	hygienePermissiveCORS        = "permissive_cors"
+	hygieneReflectedCORS         = "reflected_cors_origin"
+	hygieneCookieWithoutSecure   = "cookie_without_secure"
+	hygieneCookieWithoutHTTPOnly = "cookie_without_httponly"
+	hygieneCookieWithoutSameSite = "cookie_without_samesite"
+	hygieneCookieSameSiteNone    = "cookie_samesite_none_without_secure"
+
+	// minHSTSMaxAge is the lowest HSTS max-age that is not reported as weak, 180 days.
+	minHSTSMaxAge = 180 * 24 * 60 * 60
+	// hygieneResolveAfter is the number of consecutive responses that pass a check for its finding to be resolved, so
+	// endpoints whose responses differ (such as error pages) do not report and resolve findings over and over.
+	hygieneResolveAfter = 10
+	// maxHygieneFindingsPerEndpoint bounds the distinct hygiene findings we keep per endpoint.
+	maxHygieneFindingsPerEndpoint = 64
+)
+
+// hygieneCheck is the outcome of a check of a response. Checks that passed resolve the findings reported before.
+type hygieneCheck struct {
+	findingType string
+	// subject is what the check is about when an endpoint can fail it several times, such as the name of a cookie.
+	subject  string
+	severity string
+	message  string
+	failed   bool
+}
+
+func (check *hygieneCheck) key() string {
+	return check.findingType + "|" + check.subject
+}
+
+// HygieneFinding is a security header or cookie issue of an endpoint, that held in its latest checked response.
+type HygieneFinding struct {
+	findingType string
+	subject     string
+	severity    string
+	// count is the number of responses that failed the check, and passes the number of consecutive responses that
+	// passed it since.
+	count  uint64
+	passes int
+}
+
+func (finding *HygieneFinding) String() string {
+	if finding.subject == "" {
+		return fmt.Sprintf("%s count=%d", finding.findingType, finding.count)
+	}
+	return fmt.Sprintf("%s(%s) count=%d", finding.findingType, finding.subject, finding.count)
+}
+
+// hstsMaxAge returns the max-age of an HSTS header, or false if it has none.
+func hstsMaxAge(value string) (int64, bool) {
+	for _, directive := range strings.Split(value, ";") {
+		directive = strings.TrimSpace(directive)
+		if strings.HasPrefix(strings.ToLower(directive), "max-age=") {
+			maxAge, err := strconv.ParseInt(strings.Trim(directive[len("max-age="):], `"`), 10, 64)
+			return maxAge, err == nil
+		}
+	}
+	return 0, false
+}
+
+// cspDirectives parses a content security policy into its directives, keyed by their lowercase names.
+func cspDirectives(policy string) map[string][]string {
+	directives := make(map[string][]string)
+	for _, directive := range strings.Split(policy, ";") {
+		fields := strings.Fields(strings.ToLower(directive))
+		if len(fields) > 0 {
+			directives[fields[0]] = fields[1:]
+		}
+	}
+	return directives
+}
+
+// weakCSP returns why a content security policy does not restrict scripts, or an empty string.
+func weakCSP(directives map[string][]string) string {
+	sources, ok := directives["script-src"]
+	if !ok {
+		if sources, ok = directives["default-src"]; !ok {
+			return "no script-src nor default-src"
+		}
+	}
+	for _, source := range sources {
+		switch source {
+		case "'unsafe-inline'", "'unsafe-eval'", "*", "http:", "https:", "data:":
+			return "scripts allowed from " + source
+		}
+	}
+	return ""
+}
+
+// checkSecurityHeaders checks the security headers of a response. The headers that protect documents (CSP and
+// framing) are only checked on HTML responses.
+func checkSecurityHeaders(req *http.Request, res *http.Response) []hygieneCheck {
+	checks := make([]hygieneCheck, 0)
+	hsts := res.Header.Get("Strict-Transport-Security")
+	maxAge, hasMaxAge := hstsMaxAge(hsts)
+	checks = append(checks,
+		hygieneCheck{findingType: hygieneMissingHSTS, severity: eventSeverityWarning,
+			message: "Strict-Transport-Security is missing", failed: hsts == ""},
+		hygieneCheck{findingType: hygieneWeakHSTS, severity: eventSeverityWarning,
+			message: fmt.Sprintf("Strict-Transport-Security max-age is below %d seconds", minHSTSMaxAge),
+			failed:  hsts != "" && (!hasMaxAge || maxAge < minHSTSMaxAge)},
+		hygieneCheck{findingType: hygieneMissingNoSniff, severity: eventSeverityWarning,
+			message: "X-Content-Type-Options is not nosniff",
+			failed:  !strings.EqualFold(strings.TrimSpace(res.Header.Get("X-Content-Type-Options")), "nosniff")},
+	)
+
+	if responseMediaType(res) == "text/html" {
+		policy := res.Header.Get("Content-Security-Policy")
+		directives := cspDirectives(policy)
+		weakness := ""
+		if policy != "" {
+			weakness = weakCSP(directives)
+		}
+		frameOptions := strings.ToUpper(strings.TrimSpace(res.Header.Get("X-Frame-Options")))
+		_, frameAncestors := directives["frame-ancestors"]
+		checks = append(checks,
+			hygieneCheck{findingType: hygieneMissingCSP, severity: eventSeverityWarning,
+				message: "Content-Security-Policy is missing", failed: policy == ""},
+			hygieneCheck{findingType: hygieneWeakCSP, severity: eventSeverityWarning,
+				message: "Content-Security-Policy is weak: " + weakness, failed: weakness != ""},
+			hygieneCheck{findingType: hygieneMissingFrameOptions, severity: eventSeverityWarning,
+				message: "neither X-Frame-Options nor a frame-ancestors policy prevent framing",
+				failed:  frameOptions != "DENY" && frameOptions != "SAMEORIGIN" && !frameAncestors},
+		)
+	}
+
+	allowedOrigin := strings.TrimSpace(res.Header.Get("Access-Control-Allow-Origin"))
+	credentials := strings.EqualFold(strings.TrimSpace(res.Header.Get("Access-Control-Allow-Credentials")), "true")
+	origin := req.Header.Get("Origin")
+	checks = append(checks,
+		hygieneCheck{findingType: hygienePermissiveCORS, severity: eventSeverityHigh,
+			message: "CORS allows any origin with credentials",
+			failed:  credentials && (allowedOrigin == "*" || allowedOrigin == "null")},
+		hygieneCheck{findingType: hygieneReflectedCORS, severity: eventSeverityHigh,
+			message: "CORS reflects the origin of the request with credentials",
+			// A single origin may be allowed on purpose, so only reflections seen with a cross-site origin are reported.
+			failed: credentials && origin != "" && allowedOrigin == origin && !sameSiteOrigin(origin, req.Host)},
+	)
+	return checks
+}
+
+// sameSiteOrigin checks whether the origin of a request is the host the request was sent to.
+func sameSiteOrigin(origin string, host string) bool {
+	if index := strings.Index(origin, "://"); index != -1 {
+		origin = origin[index+3:]
+	}
+	return strings.EqualFold(origin, host)
+}
+
+// checkCookies checks the attributes of the cookies set by a response.
+func checkCookies(res *http.Response) []hygieneCheck {
+	checks := make([]hygieneCheck, 0)
+	for _, cookie := range res.Cookies() {
+		if cookie.MaxAge < 0 {
+			// Deleted cookies hold no value.
+			continue
+		}
+		checks = append(checks,
+			hygieneCheck{findingType: hygieneCookieWithoutSecure, subject: cookie.Name, severity: eventSeverityWarning,
+				message: fmt.Sprintf("cookie %s is set without Secure", cookie.Name), failed: !cookie.Secure},
+			hygieneCheck{findingType: hygieneCookieWithoutHTTPOnly, subject: cookie.Name, severity: eventSeverityWarning,
+				message: fmt.Sprintf("cookie %s is set without HttpOnly", cookie.Name), failed: !cookie.HttpOnly},
+			hygieneCheck{findingType: hygieneCookieWithoutSameSite, subject: cookie.Name, severity: eventSeverityInfo,
+				message: fmt.Sprintf("cookie %s is set without SameSite", cookie.Name),
+				failed:  cookie.SameSite == http.SameSiteDefaultMode},
+			hygieneCheck{findingType: hygieneCookieSameSiteNone, subject: cookie.Name, severity: eventSeverityHigh,
+				message: fmt.Sprintf("cookie %s is set with SameSite=None without Secure", cookie.Name),
+				failed:  cookie.SameSite == http.SameSiteNoneMode && !cookie.Secure},
+		)
+	}
+	return checks
+}
+
+// applyHygieneChecks records the outcomes of the checks of another response of the endpoint. It returns the checks
+// that failed for the first time, or failed again after they were resolved, and the findings that were resolved by
+// this response.
+func (schema *ApiSchema) applyHygieneChecks(checks []hygieneCheck) ([]hygieneCheck, []*HygieneFinding) {
+	schema.mutex.Lock()
+	defer schema.mutex.Unlock()
+	reported := make([]hygieneCheck, 0)
+	resolved := make([]*HygieneFinding, 0)
+	for _, check := range checks {
+		finding, active := schema.hygiene[check.key()]
+		if !check.failed {
+			if active {
+				if finding.passes++; finding.passes >= hygieneResolveAfter {
+					delete(schema.hygiene, check.key())
+					resolved = append(resolved, finding)
+				}
+			}
+			continue
+		}
+		if active {
+			finding.count++
+			finding.passes = 0
+			continue
+		}
+		if len(schema.hygiene) < maxHygieneFindingsPerEndpoint {
+			schema.hygiene[check.key()] = &HygieneFinding{
+				findingType: check.findingType,
+				subject:     check.subject,
+				severity:    check.severity,
+				count:       1,
+			}
+			reported = append(reported, check)
+		}
+	}
+	return reported, resolved
+}
+
+func mergeHygieneFindings(current map[string]*HygieneFinding, other map[string]*HygieneFinding) {
+	for key, finding := range other {
+		if existing, ok := current[key]; ok {
+			existing.count += finding.count
+		} else if len(current) < maxHygieneFindingsPerEndpoint {
+			copied := *finding
+			current[key] = &copied
+		}
+	}
+}
+
+// sortedHygieneFindings returns the hygiene findings of an endpoint ordered by type and subject.
+func sortedHygieneFindings(findings map[string]*HygieneFinding) []*HygieneFinding {
+	sorted := make([]*HygieneFinding, 0, len(findings))
+	for _, finding := range findings {
+		sorted = append(sorted, finding)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].findingType != sorted[j].findingType {
+			return sorted[i].findingType < sorted[j].findingType
+		}
+		return sorted[i].subject < sorted[j].subject
+	})
+	return sorted
+}
+
+// checkHygiene checks the security headers and the cookies of a response of the endpoint. Findings are reported when
+// they appear, and again when they are resolved, so the events hold an up to date view of each endpoint.
+func (factory *Factory) checkHygiene(schema *ApiSchema, req *http.Request, res *http.Response) {
+	if res.StatusCode == http.StatusNotModified || res.StatusCode < http.StatusOK {
+		// Not modified responses omit most headers, and informational responses are not the final response.
+		return
+	}
+	reported, resolved := schema.applyHygieneChecks(append(checkSecurityHeaders(req, res), checkCookies(res)...))
+	for _, check := range reported {
+		details := map[string]interface{}{"status": res.StatusCode}
+		if check.subject != "" {
+			details["subject"] = check.subject
+		}
+		factory.events.Emit(Event{
+			Category: hygieneEventCategory,
+			Type:     check.findingType,
+			Severity: check.severity,
+			Method:   schema.method,
+			Path:     schema.uri,
+			Message:  check.message,
+			Details:  details,
+		})
+	}
+	for _, finding := range resolved {
+		details := map[string]interface{}{"finding": finding.findingType, "count": finding.count}
+		if finding.subject != "" {
+			details["subject"] = finding.subject
+		}
+		factory.events.Emit(Event{
+			Category: hygieneEventCategory,
+			Type:     hygieneEventResolved,
+			Severity: eventSeverityInfo,
+			Method:   schema.method,
+			Path:     schema.uri,
+			Message:  fmt.Sprintf("%s no longer holds", finding.findingType),
+			Details:  details,
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package connections
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// JSONRPCMethod aggregates the calls of a single JSON-RPC 2.0 method.
+type JSONRPCMethod struct {
+	name          string
+	calls         uint64
+	notifications uint64
+	errors        uint64
+	// errorCodes counts the error objects returned by the method, per code.
+	errorCodes map[int]uint64
+	lastError  string
+}
+
+func NewJSONRPCMethod(name string) *JSONRPCMethod {
+	return &JSONRPCMethod{
+		name:       name,
+		errorCodes: make(map[int]uint64),
+	}
+}
+
+func (method *JSONRPCMethod) String() string {
+	return fmt.Sprintf("%s calls=%d notifications=%d errors=%d errorCodes=%v lastError=%q",
+		method.name, method.calls, method.notifications, method.errors, method.errorCodes, method.lastError)
+}
+
+func (method *JSONRPCMethod) merge(other *JSONRPCMethod) {
+	method.calls += other.calls
+	method.notifications += other.notifications
+	method.errors += other.errors
+	for code, count := range other.errorCodes {
+		method.errorCodes[code] += count
+	}
+	if other.lastError != "" {
+		method.lastError = other.lastError
+	}
+}
+
+type jsonRPCRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type jsonRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type jsonRPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result"`
+	Error   *jsonRPCError   `json:"error"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// isNotification checks whether the request has no id, and therefore expects no response.
+func (request jsonRPCRequest) isNotification() bool {
+	return len(request.ID) == 0
+}
+
+// unmarshalJSONRPCBatch decodes a single JSON-RPC object, or a batch array of them.
+func unmarshalJSONRPCBatch(body []byte, single interface{}, batch interface{}) (bool, error) {
+	if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+		return true, json.Unmarshal(body, batch)
+	}
+	return false, json.Unmarshal(body, single)
+}
+
+// parseJSONRPCRequests returns the JSON-RPC 2.0 requests in the body. A nil slice means the body is not JSON-RPC.
+func parseJSONRPCRequests(body []byte) []jsonRPCRequest {
+	var request jsonRPCRequest
+	var requests []jsonRPCRequest
+	isBatch, err := unmarshalJSONRPCBatch(body, &request, &requests)
+	if err != nil {
+		return nil
+	}
+	if !isBatch {
+		requests = []jsonRPCRequest{request}
+	}
+	if len(requests) == 0 {
+		return nil
+	}
+	for _, request := range requests {
+		if request.JSONRPC != "2.0" || request.Method == "" {
+			return nil
+		}
+	}
+	return requests
+}
+
+// parseJSONRPCResponses returns the responses in the body, by their id. Batch responses may come in any order.
+func parseJSONRPCResponses(body []byte) map[string]jsonRPCResponse {
+	var response jsonRPCResponse
+	var responses []jsonRPCResponse
+	isBatch, err := unmarshalJSONRPCBatch(body, &response, &responses)
+	if err != nil {
+		return nil
+	}
+	if !isBatch {
+		responses = []jsonRPCResponse{response}
+	}
+	byID := make(map[string]jsonRPCResponse, len(responses))
+	for _, response := range responses {
+		byID[string(response.ID)] = response
+	}
+	return byID
+}
+
+// addJSONRPCCalls adds every method called in a JSON-RPC request as its own inventory entry. It returns false if the
+// request is not a JSON-RPC request.
+func (factory *Factory) addJSONRPCCalls(transaction *httpTransaction) bool {
+	req, res := transaction.req, transaction.res
+	requestBody, responseBody := transaction.requestBody, transaction.responseBody
+	requests := parseJSONRPCRequests(requestBody)
+	if requests == nil {
+		return false
+	}
+	// Error objects are answered with any status code, while bodies that are not JSON, such as the error page of a
+	// proxy, are not JSON-RPC responses.
+	var responses map[string]jsonRPCResponse
+	if isJSONMediaType(responseMediaType(res)) {
+		responses = parseJSONRPCResponses(responseBody)
+	}
+
+	for _, request := range requests {
+		path, parameters := factory.endpointPath(req.URL.Path)
+		key := req.Method + "_" + path + "#" + request.Method
+		schema, ok := factory.apiInventory[key]
+		if !ok {
+			fmt.Println("New JSON-RPC method found, adding to api inventory")
+			schema = NewApiSchema(req.Method, path, nil, nil, false)
+			schema.operation = request.Method
+			schema.jsonRPC = NewJSONRPCMethod(request.Method)
+			factory.apiInventory[key] = schema
+		}
+		schema.addParameters(req, parameters)
+		schema.addResponse(res, nil)
+		schema.addLatency(transaction.timing)
+		// The PII and the secrets of a result are credited to the method that returned it.
+		response, answered := responses[string(request.ID)]
+		answered = answered && !request.isNotification()
+		var result json.RawMessage
+		if answered {
+			result = response.Result
+		}
+		findings := factory.pii.classifyBody(piiLocationRequestBody, "", nil, request.Params)
+		findings = append(findings, factory.pii.classifyBody(piiLocationResponseBody, "", nil, result)...)
+		factory.analyzeTransaction(schema, transaction, result, findings)
+
+		method := schema.jsonRPC
+		if request.isNotification() {
+			method.notifications++
+			schema.addOperationSample(res, inferSchema(request.Params), nil)
+			continue
+		}
+		method.calls++
+		if answered && response.Error != nil {
+			method.errors++
+			method.errorCodes[response.Error.Code]++
+			method.lastError = factory.redactor.redactText(factory.pii, response.Error.Message)
+		}
+		// The params and the result are inferred separately, the error objects are tracked in the method stats.
+		schema.addOperationSample(res, inferSchema(request.Params), inferSchema(result))
+	}
+	return true
+}
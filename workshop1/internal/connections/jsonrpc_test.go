@@ -0,0 +1,100 @@
+package connections
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseJSONRPCRequests(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{"single", `{"jsonrpc":"2.0","method":"eth_blockNumber","id":1}`, []string{"eth_blockNumber"}},
+		{"batch", `[{"jsonrpc":"2.0","method":"a","id":1},{"jsonrpc":"2.0","method":"b"}]`, []string{"a", "b"}},
+		{"empty batch", `[]`, nil},
+		{"version 1", `{"method":"a","params":[],"id":1}`, nil},
+		{"batch with a non json-rpc request", `[{"jsonrpc":"2.0","method":"a","id":1},{"id":2}]`, nil},
+		{"not json", `method=a`, nil},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, request := range parseJSONRPCRequests([]byte(test.body)) {
+			got = append(got, request.Method)
+		}
+		if !equalStrings(got, test.want) || (got == nil) != (test.want == nil) {
+			t.Errorf("%s: parseJSONRPCRequests() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAddJSONRPCCalls(t *testing.T) {
+	batch := `[{"jsonrpc":"2.0","method":"getUser","params":{"id":1},"id":1},` +
+		`{"jsonrpc":"2.0","method":"deleteUser","params":{"id":2},"id":"b"},` +
+		`{"jsonrpc":"2.0","method":"log","params":["hello"]}]`
+	type want struct {
+		statusCode    int
+		calls         uint64
+		notifications uint64
+		errorCodes    map[int]uint64
+		result        bool
+	}
+	tests := []struct {
+		name        string
+		transaction *httpTransaction
+		methods     map[string]want
+	}{
+		// The responses of a batch may come in any order.
+		{"batch", newTestTransaction("POST", "/rpc", batch, http.StatusOK, "application/json",
+			`[{"jsonrpc":"2.0","error":{"code":-32601,"message":"not allowed"},"id":"b"},`+
+				`{"jsonrpc":"2.0","result":{"name":"jane"},"id":1}]`), map[string]want{
+			"getUser":    {200, 1, 0, map[int]uint64{}, true},
+			"deleteUser": {200, 1, 0, map[int]uint64{-32601: 1}, false},
+			"log":        {200, 0, 1, map[int]uint64{}, false},
+		}},
+		{"error with a server error status", newTestTransaction("POST", "/rpc",
+			`{"jsonrpc":"2.0","method":"getUser","id":7}`, http.StatusInternalServerError, "application/json",
+			`{"jsonrpc":"2.0","error":{"code":-32000,"message":"database down"},"id":7}`), map[string]want{
+			"getUser": {500, 1, 0, map[int]uint64{-32000: 1}, false},
+		}},
+		{"proxy error page", newTestTransaction("POST", "/rpc", batch, http.StatusBadGateway, "text/html",
+			`<html>bad gateway</html>`), map[string]want{
+			"getUser":    {502, 1, 0, map[int]uint64{}, false},
+			"deleteUser": {502, 1, 0, map[int]uint64{}, false},
+			"log":        {502, 0, 1, map[int]uint64{}, false},
+		}},
+	}
+	for _, test := range tests {
+		factory := NewFactory(time.Minute)
+		factory.SetEventSink(NewEventSink(&strings.Builder{}))
+		factory.addHTTPTransaction(test.transaction)
+		if len(factory.apiInventory) != len(test.methods) {
+			t.Errorf("%s: addHTTPTransaction() added %d entries, want %d", test.name, len(factory.apiInventory),
+				len(test.methods))
+		}
+		for name, want := range test.methods {
+			schema, ok := factory.apiInventory["POST_/rpc#"+name]
+			if !ok {
+				t.Errorf("%s: addHTTPTransaction() did not add %q", test.name, name)
+				continue
+			}
+			method := schema.jsonRPC
+			if schema.statusCodes[want.statusCode] != 1 || method.calls != want.calls ||
+				method.notifications != want.notifications || method.errors != uint64(len(want.errorCodes)) {
+				t.Errorf("%s: %q = status codes %v %s, want one %d calls=%d notifications=%d", test.name, name,
+					schema.statusCodes, method, want.statusCode, want.calls, want.notifications)
+			}
+			for code, count := range want.errorCodes {
+				if method.errorCodes[code] != count {
+					t.Errorf("%s: %q error codes = %v, want %v", test.name, name, method.errorCodes, want.errorCodes)
+				}
+			}
+			if (schema.responseSchema != nil) != want.result {
+				t.Errorf("%s: %q response schema = %v, want one %v", test.name, name, schema.responseSchema, want.result)
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package connections
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// The histogram buckets grow geometrically, so the quantiles have the same relative error at every scale.
+	minLatencyBucket    = 50 * time.Microsecond
+	maxLatencyBucket    = 2 * time.Minute
+	latencyBucketGrowth = 1.2
+)
+
+// latencyBuckets holds the upper bounds of the histogram buckets, the last bucket is unbounded.
+var latencyBuckets = func() []time.Duration {
+	buckets := make([]time.Duration, 0)
+	for bound := float64(minLatencyBucket); bound < float64(maxLatencyBucket); bound *= latencyBucketGrowth {
+		buckets = append(buckets, time.Duration(bound))
+	}
+	return buckets
+}()
+
+// transactionTiming holds the capture times of the first and last bytes of a request and its response.
+type transactionTiming struct {
+	requestFirstByte  uint64
+	requestLastByte   uint64
+	responseFirstByte uint64
+	responseLastByte  uint64
+	// capturedAt is the wall-clock time the transaction was captured at, by the last byte of its response. Time based
+	// checks, such as the expiry of tokens, are evaluated at this time rather than when the transaction is analyzed.
+	capturedAt time.Time
+}
+
+// newTransactionTiming times a transaction by the offsets of the request and the response in the buffers of the
+// tracker. The end offsets are exclusive.
+func newTransactionTiming(tracker *Tracker, requestStart int, requestEnd int, responseStart int, responseEnd int) transactionTiming {
+	timing := transactionTiming{
+		requestFirstByte:  timestampAt(tracker.recvSegments, requestStart),
+		requestLastByte:   timestampAt(tracker.recvSegments, requestEnd-1),
+		responseFirstByte: timestampAt(tracker.sentSegments, responseStart),
+		responseLastByte:  timestampAt(tracker.sentSegments, responseEnd-1),
+		capturedAt:        capturedAt(tracker.sentSegments, responseEnd-1),
+	}
+	if timing.capturedAt.IsZero() {
+		timing.capturedAt = capturedAt(tracker.recvSegments, requestEnd-1)
+	}
+	return timing
+}
+
+// serverLatency returns the time from the last byte of the request to the first byte of the response. It returns false
+// if the transaction could not be timed.
+func (timing transactionTiming) serverLatency() (time.Duration, bool) {
+	if timing.requestLastByte == 0 || timing.responseFirstByte < timing.requestLastByte {
+		return 0, false
+	}
+	return time.Duration(timing.responseFirstByte - timing.requestLastByte), true
+}
+
+// LatencyHistogram counts latencies in geometric buckets, so quantiles are estimated in a bounded memory.
+type LatencyHistogram struct {
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+	max    time.Duration
+}
+
+// NewLatencyHistogram creates a new instance of the latency histogram.
+func NewLatencyHistogram() *LatencyHistogram {
+	return &LatencyHistogram{counts: make([]uint64, len(latencyBuckets)+1)}
+}
+
+func (histogram *LatencyHistogram) add(latency time.Duration) {
+	bucket := len(latencyBuckets)
+	for i, bound := range latencyBuckets {
+		if latency <= bound {
+			bucket = i
+			break
+		}
+	}
+	histogram.counts[bucket]++
+	histogram.count++
+	histogram.sum += latency
+	if latency > histogram.max {
+		histogram.max = latency
+	}
+}
+
+func (histogram *LatencyHistogram) merge(other *LatencyHistogram) {
+	for i, count := range other.counts {
+		histogram.counts[i] += count
+	}
+	histogram.count += other.count
+	histogram.sum += other.sum
+	if other.max > histogram.max {
+		histogram.max = other.max
+	}
+}
+
+// quantile estimates the given quantile by the upper bound of the bucket that holds it, which is at most 20% above the
+// actual latency.
+func (histogram *LatencyHistogram) quantile(q float64) time.Duration {
+	if histogram.count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(histogram.count)))
+	var seen uint64
+	for i, count := range histogram.counts {
+		seen += count
+		if seen < rank {
+			continue
+		}
+		if i == len(latencyBuckets) || latencyBuckets[i] > histogram.max {
+			return histogram.max
+		}
+		return latencyBuckets[i]
+	}
+	return histogram.max
+}
+
+func (histogram *LatencyHistogram) String() string {
+	if histogram.count == 0 {
+		return "count=0"
+	}
+	return fmt.Sprintf("count=%d p50=%v p90=%v p99=%v max=%v", histogram.count,
+		histogram.quantile(0.5), histogram.quantile(0.9), histogram.quantile(0.99), histogram.max)
+}
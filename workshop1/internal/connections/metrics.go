@@ -0,0 +1,73 @@
+package connections
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var (
+	metricsQuantiles = []float64{0.5, 0.9, 0.99}
+	labelReplacer    = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// endpointLabels formats the labels that identify an endpoint, in the Prometheus text format.
+func endpointLabels(schema *ApiSchema) string {
+	return fmt.Sprintf(`method="%s",path="%s",operation="%s"`,
+		labelReplacer.Replace(schema.method), labelReplacer.Replace(schema.uri), labelReplacer.Replace(schema.operation))
+}
+
+// WriteMetrics writes the transaction counts and the latencies of the endpoints in the Prometheus text format.
+func (factory *Factory) WriteMetrics(writer io.Writer) error {
+	factory.mutex.RLock()
+	keys := make([]string, 0, len(factory.apiInventory))
+	for key := range factory.apiInventory {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var requests, latencies bytes.Buffer
+	requests.WriteString("# HELP api_requests_total The transactions of the endpoint, by status code.\n")
+	requests.WriteString("# TYPE api_requests_total counter\n")
+	latencies.WriteString("# HELP api_server_latency_seconds The time from the last byte of the requests to the first byte of the responses.\n")
+	latencies.WriteString("# TYPE api_server_latency_seconds summary\n")
+	for _, key := range keys {
+		schema := factory.apiInventory[key]
+		labels := endpointLabels(schema)
+		schema.mutex.RLock()
+		statusCodes := observedStatusCodes(schema)
+		for _, statusCode := range statusCodes {
+			fmt.Fprintf(&requests, "api_requests_total{%s,status=\"%d\"} %d\n", labels, statusCode, schema.statusCodes[statusCode])
+		}
+		if schema.latency.count > 0 {
+			for _, quantile := range metricsQuantiles {
+				fmt.Fprintf(&latencies, "api_server_latency_seconds{%s,quantile=\"%g\"} %g\n",
+					labels, quantile, schema.latency.quantile(quantile).Seconds())
+			}
+			fmt.Fprintf(&latencies, "api_server_latency_seconds_sum{%s} %g\n", labels, schema.latency.sum.Seconds())
+			fmt.Fprintf(&latencies, "api_server_latency_seconds_count{%s} %d\n", labels, schema.latency.count)
+		}
+		schema.mutex.RUnlock()
+	}
+	factory.mutex.RUnlock()
+
+	if _, err := requests.WriteTo(writer); err != nil {
+		return err
+	}
+	_, err := latencies.WriteTo(writer)
+	return err
+}
+
+// MetricsHandler serves the metrics of the api inventory, to be scraped by Prometheus.
+func (factory *Factory) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, _ *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := factory.WriteMetrics(writer); err != nil {
+			log.Printf("Failed writing metrics: %v", err)
+		}
+	})
+}
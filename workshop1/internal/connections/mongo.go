@@ -0,0 +1,393 @@
+package connections
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	mongoHeaderSize     = 16
+	mongoMaxMessageSize = 48 * 1024 * 1024
+	// maxPendingMongoRequests bounds the requests of a connection that wait for their responses, unacknowledged writes
+	// never get one.
+	maxPendingMongoRequests = 1024
+
+	mongoOpReply      = 1
+	mongoOpQuery      = 2004
+	mongoOpCompressed = 2012
+	mongoOpMsg        = 2013
+
+	// mongoChecksumPresent is the OP_MSG flag bit indicating the message ends with a CRC-32C checksum.
+	mongoChecksumPresent = 1
+	// mongoQueryFailure is the OP_REPLY flag bit indicating the query failed.
+	mongoQueryFailure = 2
+)
+
+// mongoMessage is a single decoded MongoDB wire protocol message.
+type mongoMessage struct {
+	requestID  int32
+	responseTo int32
+	opCode     int32
+	// fullCollectionName is set for OP_QUERY messages, in the <database>.<collection> form.
+	fullCollectionName string
+	// body is the command document of a request, or the first reply document of a response.
+	body bsonDocument
+	// queryFailure is set for OP_REPLY messages flagged as failed.
+	queryFailure bool
+
+	firstByteTimestamp uint64
+	lastByteTimestamp  uint64
+}
+
+// mongoCommand identifies a command sent to the database.
+type mongoCommand struct {
+	database   string
+	collection string
+	name       string
+}
+
+// isMongoMessage checks whether the buffer starts with a valid MongoDB message header.
+func isMongoMessage(buf []byte) bool {
+	if len(buf) < mongoHeaderSize {
+		return false
+	}
+	length := int32(binary.LittleEndian.Uint32(buf[0:4]))
+	if length < mongoHeaderSize || length > mongoMaxMessageSize {
+		return false
+	}
+	switch int32(binary.LittleEndian.Uint32(buf[12:16])) {
+	case mongoOpReply, mongoOpQuery, mongoOpCompressed, mongoOpMsg:
+		return true
+	default:
+		return false
+	}
+}
+
+// parseMongoMessages decodes the consecutive messages in the buffer. Messages we fail to decode (such as
+// OP_COMPRESSED) are skipped, and decoding stops at the first message that is truncated. It also returns the size of
+// the messages that were complete.
+func parseMongoMessages(buf []byte, segments []dataSegment) ([]mongoMessage, int) {
+	messages := make([]mongoMessage, 0)
+	offset := 0
+	for offset+mongoHeaderSize <= len(buf) && isMongoMessage(buf[offset:]) {
+		length := int(binary.LittleEndian.Uint32(buf[offset : offset+4]))
+		if offset+length > len(buf) {
+			break
+		}
+		message, err := parseMongoMessage(buf[offset : offset+length])
+		if err == nil {
+			message.firstByteTimestamp = timestampAt(segments, offset)
+			message.lastByteTimestamp = timestampAt(segments, offset+length-1)
+			messages = append(messages, message)
+		}
+		offset += length
+	}
+	return messages, offset
+}
+
+func parseMongoMessage(buf []byte) (mongoMessage, error) {
+	message := mongoMessage{
+		requestID:  int32(binary.LittleEndian.Uint32(buf[4:8])),
+		responseTo: int32(binary.LittleEndian.Uint32(buf[8:12])),
+		opCode:     int32(binary.LittleEndian.Uint32(buf[12:16])),
+	}
+	payload := buf[mongoHeaderSize:]
+	var err error
+	switch message.opCode {
+	case mongoOpMsg:
+		message.body, err = parseMongoOpMsg(payload)
+	case mongoOpQuery:
+		message.fullCollectionName, message.body, err = parseMongoOpQuery(payload)
+	case mongoOpReply:
+		message.queryFailure, message.body, err = parseMongoOpReply(payload)
+	default:
+		err = fmt.Errorf("unsupported mongo opcode %d", message.opCode)
+	}
+	return message, err
+}
+
+// parseMongoOpMsg returns the body section of an OP_MSG. Document sequences (such as the documents of an insert) are
+// skipped.
+func parseMongoOpMsg(payload []byte) (bsonDocument, error) {
+	if len(payload) < 4 {
+		return nil, errBSONTruncated
+	}
+	flags := binary.LittleEndian.Uint32(payload[0:4])
+	end := len(payload)
+	if flags&mongoChecksumPresent != 0 {
+		end -= 4
+	}
+
+	var body bsonDocument
+	offset := 4
+	for offset < end {
+		kind := payload[offset]
+		offset++
+		switch kind {
+		case 0:
+			doc, size, err := parseBSONDocument(payload[offset:end])
+			if err != nil {
+				return nil, err
+			}
+			body = doc
+			offset += size
+		case 1:
+			if offset+4 > end {
+				return nil, errBSONTruncated
+			}
+			size := int(int32(binary.LittleEndian.Uint32(payload[offset : offset+4])))
+			if size < 4 || offset+size > end {
+				return nil, errBSONTruncated
+			}
+			offset += size
+		default:
+			return nil, fmt.Errorf("unknown OP_MSG section kind %d", kind)
+		}
+	}
+	if body == nil {
+		return nil, fmt.Errorf("OP_MSG without a body section")
+	}
+	return body, nil
+}
+
+// parseMongoOpQuery returns the full collection name and the query document of a legacy OP_QUERY.
+func parseMongoOpQuery(payload []byte) (string, bsonDocument, error) {
+	if len(payload) < 4 {
+		return "", nil, errBSONTruncated
+	}
+	fullCollectionName, offset, err := readCString(payload, 4)
+	if err != nil {
+		return "", nil, err
+	}
+	// numberToSkip and numberToReturn.
+	offset += 8
+	if offset > len(payload) {
+		return "", nil, errBSONTruncated
+	}
+	query, _, err := parseBSONDocument(payload[offset:])
+	if err != nil {
+		return "", nil, err
+	}
+	// Drivers wrap the query when they add modifiers such as a read preference.
+	if len(query) > 0 && (query[0].key == "$query" || query[0].key == "query") {
+		if wrapped, ok := query[0].value.(bsonDocument); ok {
+			query = wrapped
+		}
+	}
+	return fullCollectionName, query, nil
+}
+
+// parseMongoOpReply returns whether the reply is flagged as failed, and its first document.
+func parseMongoOpReply(payload []byte) (bool, bsonDocument, error) {
+	// responseFlags (4), cursorID (8), startingFrom (4), numberReturned (4).
+	if len(payload) < 20 {
+		return false, nil, errBSONTruncated
+	}
+	queryFailure := binary.LittleEndian.Uint32(payload[0:4])&mongoQueryFailure != 0
+	if int32(binary.LittleEndian.Uint32(payload[16:20])) == 0 {
+		return queryFailure, bsonDocument{}, nil
+	}
+	doc, _, err := parseBSONDocument(payload[20:])
+	return queryFailure, doc, err
+}
+
+// command returns the command of a request message.
+func (message mongoMessage) command() mongoCommand {
+	command := mongoCommand{}
+	if message.opCode == mongoOpQuery {
+		parts := strings.SplitN(message.fullCollectionName, ".", 2)
+		command.database = parts[0]
+		if len(parts) == 2 && parts[1] != "$cmd" {
+			// A legacy query on a collection rather than a command.
+			command.collection = parts[1]
+			command.name = "find"
+			return command
+		}
+	} else {
+		command.database = message.body.lookupString("$db")
+	}
+
+	if len(message.body) == 0 {
+		return command
+	}
+	command.name = message.body[0].key
+	// Most commands name the collection as their value, while getMore names it in a dedicated field.
+	if collection, ok := message.body[0].value.(string); ok {
+		command.collection = collection
+	} else {
+		command.collection = message.body.lookupString("collection")
+	}
+	return command
+}
+
+// responseError returns the error reported by a response message, or an empty string for successful responses.
+func (message mongoMessage) responseError() string {
+	if message.queryFailure {
+		if errorMessage := message.body.lookupString("$err"); errorMessage != "" {
+			return errorMessage
+		}
+		return "query failure"
+	}
+	if ok, found := message.body.lookup("ok"); found {
+		if number, isNumber := bsonNumber(ok); isNumber && number == 0 {
+			errorMessage := message.body.lookupString("errmsg")
+			if codeName := message.body.lookupString("codeName"); codeName != "" {
+				errorMessage = codeName + ": " + errorMessage
+			}
+			if errorMessage == "" {
+				return "command failed"
+			}
+			return errorMessage
+		}
+	}
+	if writeErrors, found := message.body.lookup("writeErrors"); found {
+		if writeErrorList, ok := writeErrors.([]interface{}); ok && len(writeErrorList) > 0 {
+			if first, ok := writeErrorList[0].(bsonDocument); ok {
+				return "write error: " + first.lookupString("errmsg")
+			}
+			return "write error"
+		}
+	}
+	return ""
+}
+
+// MongoCommandStats aggregates the invocations of a single command on a single collection.
+type MongoCommandStats struct {
+	database   string
+	collection string
+	command    string
+	count      uint64
+	errors     uint64
+	lastError  string
+
+	// Latency is measured from the last byte of the request to the first byte of the response.
+	timedCount   uint64
+	totalLatency time.Duration
+	minLatency   time.Duration
+	maxLatency   time.Duration
+}
+
+func NewMongoCommandStats(database string, collection string, command string) *MongoCommandStats {
+	return &MongoCommandStats{
+		database:   database,
+		collection: collection,
+		command:    command,
+	}
+}
+
+func (stats *MongoCommandStats) add(request mongoMessage, response *mongoMessage) {
+	stats.count++
+	if response == nil {
+		return
+	}
+	if errorMessage := response.responseError(); errorMessage != "" {
+		stats.errors++
+		stats.lastError = errorMessage
+	}
+	if request.lastByteTimestamp == 0 || response.firstByteTimestamp < request.lastByteTimestamp {
+		return
+	}
+	latency := time.Duration(response.firstByteTimestamp - request.lastByteTimestamp)
+	if stats.timedCount == 0 || latency < stats.minLatency {
+		stats.minLatency = latency
+	}
+	if latency > stats.maxLatency {
+		stats.maxLatency = latency
+	}
+	stats.timedCount++
+	stats.totalLatency += latency
+}
+
+func (stats *MongoCommandStats) averageLatency() time.Duration {
+	if stats.timedCount == 0 {
+		return 0
+	}
+	return stats.totalLatency / time.Duration(stats.timedCount)
+}
+
+// handleMongoConnection decodes the complete messages of a MongoDB connection, pairs the requests and responses by
+// their ids, and adds them to the mongo inventory. Pairing does not rely on the direction, so it works for both the
+// server and the client side. The decoded messages are consumed from the buffers, and the requests whose responses
+// did not arrive yet are kept for the next time, unless the connection is done.
+func (factory *Factory) handleMongoConnection(tracker *Tracker, done bool) {
+	recvBuf, recvSegments, sentBuf, sentSegments := tracker.snapshot()
+	received, receivedSize := parseMongoMessages(recvBuf, recvSegments)
+	sent, sentSize := parseMongoMessages(sentBuf, sentSegments)
+	tracker.consume(receivedSize, sentSize)
+	messages := append(received, sent...)
+
+	requests := tracker.mongoRequests
+	for _, message := range messages {
+		if message.responseTo == 0 {
+			requests[message.requestID] = message
+		}
+	}
+	for i := range messages {
+		response := &messages[i]
+		if response.responseTo == 0 {
+			continue
+		}
+		if request, ok := requests[response.responseTo]; ok {
+			factory.addMongoCommand(request, response)
+			delete(requests, response.responseTo)
+		}
+	}
+	if done {
+		// Requests without a response, such as unacknowledged writes.
+		for id, request := range requests {
+			factory.addMongoCommand(request, nil)
+			delete(requests, id)
+		}
+		return
+	}
+	if len(requests) <= maxPendingMongoRequests {
+		return
+	}
+	// Only the oldest requests beyond the bound are given up on, the responses of the others may still be in flight.
+	pending := make([]mongoMessage, 0, len(requests))
+	for _, request := range requests {
+		pending = append(pending, request)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if pending[i].firstByteTimestamp != pending[j].firstByteTimestamp {
+			return pending[i].firstByteTimestamp < pending[j].firstByteTimestamp
+		}
+		return pending[i].requestID < pending[j].requestID
+	})
+	for _, request := range pending[:len(pending)-maxPendingMongoRequests] {
+		factory.addMongoCommand(request, nil)
+		delete(requests, request.requestID)
+	}
+}
+
+func (factory *Factory) addMongoCommand(request mongoMessage, response *mongoMessage) {
+	command := request.command()
+	if command.name == "" {
+		return
+	}
+	key := command.database + "." + command.collection + ":" + command.name
+	stats, ok := factory.mongoInventory[key]
+	if !ok {
+		fmt.Println("New mongo command found, adding to mongo inventory")
+		stats = NewMongoCommandStats(command.database, command.collection, command.name)
+		factory.mongoInventory[key] = stats
+	}
+	stats.add(request, response)
+}
+
+func (factory *Factory) printMongoInventory() {
+	if len(factory.mongoInventory) == 0 {
+		return
+	}
+	fmt.Println("Mongo Inventory")
+	for _, stats := range factory.mongoInventory {
+		fmt.Printf("========================>\nDatabase:%s\nCollection:%s\nCommand:%s\nCount:%d\nErrors:%d\nLastError:%s\nLatency:avg=%v min=%v max=%v\n<========================\n",
+			stats.database, stats.collection, stats.command,
+			stats.count, stats.errors, factory.redactor.redactText(factory.pii, stats.lastError),
+			stats.averageLatency(), stats.minLatency, stats.maxLatency,
+		)
+	}
+}
@@ -0,0 +1,221 @@
+package connections
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kiran-sama/ebpf-training/workshop1/internal/structs"
+)
+
+// encodeMongoMessage prepends the header to the payload of a message.
+func encodeMongoMessage(requestID int32, responseTo int32, opCode int32, payload []byte) []byte {
+	header := make([]byte, mongoHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:4], uint32(mongoHeaderSize+len(payload)))
+	binary.LittleEndian.PutUint32(header[4:8], uint32(requestID))
+	binary.LittleEndian.PutUint32(header[8:12], uint32(responseTo))
+	binary.LittleEndian.PutUint32(header[12:16], uint32(opCode))
+	return append(header, payload...)
+}
+
+// encodeMongoOpMsg encodes an OP_MSG made of a body section.
+func encodeMongoOpMsg(requestID int32, responseTo int32, body bsonDocument) []byte {
+	return encodeMongoMessage(requestID, responseTo, mongoOpMsg, concat([]byte{0, 0, 0, 0, 0}, encodeBSON(body)))
+}
+
+// encodeMongoOpQuery encodes a legacy OP_QUERY.
+func encodeMongoOpQuery(requestID int32, fullCollectionName string, query bsonDocument) []byte {
+	payload := concat([]byte{0, 0, 0, 0}, []byte(fullCollectionName), []byte{0}, make([]byte, 8), encodeBSON(query))
+	return encodeMongoMessage(requestID, 0, mongoOpQuery, payload)
+}
+
+// encodeMongoOpReply encodes a legacy OP_REPLY.
+func encodeMongoOpReply(requestID int32, responseTo int32, flags uint32, docs ...bsonDocument) []byte {
+	payload := make([]byte, 20)
+	binary.LittleEndian.PutUint32(payload[0:4], flags)
+	binary.LittleEndian.PutUint32(payload[16:20], uint32(len(docs)))
+	for _, doc := range docs {
+		payload = append(payload, encodeBSON(doc)...)
+	}
+	return encodeMongoMessage(requestID, responseTo, mongoOpReply, payload)
+}
+
+func TestParseMongoMessage(t *testing.T) {
+	find := bsonDocument{{key: "find", value: "users"}, {key: "filter", value: bsonDocument{}},
+		{key: "$db", value: "app"}}
+	documents := encodeBSON(bsonDocument{{key: "name", value: "jane"}})
+	sequence := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sequence, uint32(4+len("documents")+1+len(documents)))
+	sequence = concat(sequence, []byte("documents"), []byte{0}, documents)
+	insert := bsonDocument{{key: "insert", value: "users"}, {key: "$db", value: "app"}}
+	// The flags announce a checksum, the document sequence comes before the body.
+	withSequence := encodeMongoMessage(3, 0, mongoOpMsg,
+		concat([]byte{mongoChecksumPresent, 0, 0, 0, 1}, sequence, []byte{0}, encodeBSON(insert), []byte{1, 2, 3, 4}))
+
+	tests := []struct {
+		name       string
+		data       []byte
+		wantErr    bool
+		command    mongoCommand
+		body       bsonDocument
+		errMessage string
+	}{
+		{"op_msg", encodeMongoOpMsg(1, 0, find), false, mongoCommand{"app", "users", "find"}, find, ""},
+		{"op_msg document sequence", withSequence, false, mongoCommand{"app", "users", "insert"}, insert, ""},
+		{"op_msg failure", encodeMongoOpMsg(2, 1, bsonDocument{{key: "ok", value: 0.0},
+			{key: "errmsg", value: "not authorized"}, {key: "codeName", value: "Unauthorized"}}), false,
+			mongoCommand{}, nil, "Unauthorized: not authorized"},
+		{"op_msg write error", encodeMongoOpMsg(2, 1, bsonDocument{{key: "ok", value: 1.0},
+			{key: "writeErrors", value: []interface{}{bsonDocument{{key: "errmsg", value: "duplicate key"}}}}}), false,
+			mongoCommand{}, nil, "write error: duplicate key"},
+		{"op_msg getMore", encodeMongoOpMsg(4, 0, bsonDocument{{key: "getMore", value: int64(7)},
+			{key: "collection", value: "users"}, {key: "$db", value: "app"}}), false,
+			mongoCommand{"app", "users", "getMore"}, nil, ""},
+		{"op_query command", encodeMongoOpQuery(5, "admin.$cmd", bsonDocument{{key: "isMaster", value: int32(1)}}),
+			false, mongoCommand{"admin", "", "isMaster"}, bsonDocument{{key: "isMaster", value: int32(1)}}, ""},
+		{"op_query wrapped", encodeMongoOpQuery(6, "app.users", bsonDocument{
+			{key: "$query", value: bsonDocument{{key: "age", value: int32(30)}}},
+			{key: "$readPreference", value: bsonDocument{{key: "mode", value: "secondary"}}}}),
+			false, mongoCommand{"app", "users", "find"}, bsonDocument{{key: "age", value: int32(30)}}, ""},
+		{"op_reply failure", encodeMongoOpReply(7, 6, mongoQueryFailure, bsonDocument{{key: "$err", value: "bad query"}}),
+			false, mongoCommand{}, nil, "bad query"},
+		{"op_reply empty", encodeMongoOpReply(7, 6, 0), false, mongoCommand{}, bsonDocument{}, ""},
+		{"op_compressed", encodeMongoMessage(8, 0, mongoOpCompressed, make([]byte, 9)), true, mongoCommand{}, nil, ""},
+		{"op_msg without body", encodeMongoMessage(9, 0, mongoOpMsg, concat([]byte{0, 0, 0, 0, 1}, sequence)), true,
+			mongoCommand{}, nil, ""},
+		{"op_msg unknown section", encodeMongoMessage(9, 0, mongoOpMsg, []byte{0, 0, 0, 0, 2}), true, mongoCommand{},
+			nil, ""},
+		{"op_msg sequence beyond checksum", encodeMongoMessage(9, 0, mongoOpMsg,
+			concat([]byte{mongoChecksumPresent, 0, 0, 0, 1}, sequence)), true, mongoCommand{}, nil, ""},
+		{"op_reply truncated", encodeMongoMessage(10, 6, mongoOpReply, make([]byte, 19)), true, mongoCommand{}, nil, ""},
+		{"op_query unterminated name", encodeMongoMessage(11, 0, mongoOpQuery, []byte{0, 0, 0, 0, 'a', 'p', 'p'}), true,
+			mongoCommand{}, nil, ""},
+	}
+	for _, test := range tests {
+		message, err := parseMongoMessage(test.data)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: parseMongoMessage() error = %v, want error %v", test.name, err, test.wantErr)
+			continue
+		}
+		if test.wantErr {
+			continue
+		}
+		if message.responseTo == 0 && message.command() != test.command {
+			t.Errorf("%s: command() = %+v, want %+v", test.name, message.command(), test.command)
+		}
+		if test.body != nil && !reflect.DeepEqual(message.body, test.body) {
+			t.Errorf("%s: body = %v, want %v", test.name, message.body, test.body)
+		}
+		if errorMessage := message.responseError(); errorMessage != test.errMessage {
+			t.Errorf("%s: responseError() = %q, want %q", test.name, errorMessage, test.errMessage)
+		}
+	}
+}
+
+func TestParseMongoMessages(t *testing.T) {
+	first := encodeMongoOpMsg(1, 0, bsonDocument{{key: "ping", value: int32(1)}, {key: "$db", value: "admin"}})
+	compressed := encodeMongoMessage(2, 0, mongoOpCompressed, make([]byte, 9))
+	second := encodeMongoOpMsg(3, 0, bsonDocument{{key: "find", value: "users"}, {key: "$db", value: "app"}})
+	invalid := encodeMongoMessage(4, 0, 9999, nil)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		requests []int32
+		consumed int
+	}{
+		{"complete", concat(first, second), []int32{1, 3}, len(first) + len(second)},
+		{"undecodable skipped", concat(first, compressed, second), []int32{1, 3},
+			len(first) + len(compressed) + len(second)},
+		{"truncated kept", concat(first, second[:len(second)-1]), []int32{1}, len(first)},
+		{"truncated header kept", concat(first, second[:mongoHeaderSize-1]), []int32{1}, len(first)},
+		{"invalid opcode stops", concat(first, invalid, second), []int32{1}, len(first)},
+	}
+	for _, test := range tests {
+		messages, consumed := parseMongoMessages(test.data, []dataSegment{{offset: 0, timestampNano: 100}})
+		requests := make([]int32, 0)
+		for _, message := range messages {
+			requests = append(requests, message.requestID)
+			if message.firstByteTimestamp != 100 || message.lastByteTimestamp != 100 {
+				t.Errorf("%s: message %d timestamps = %d %d, want 100 100", test.name, message.requestID,
+					message.firstByteTimestamp, message.lastByteTimestamp)
+			}
+		}
+		if !reflect.DeepEqual(requests, test.requests) || consumed != test.consumed {
+			t.Errorf("%s: parseMongoMessages() = %v %d, want %v %d", test.name, requests, consumed, test.requests,
+				test.consumed)
+		}
+	}
+}
+
+func TestParseMongoMessagesDoesNotPanic(t *testing.T) {
+	documents := encodeBSON(bsonDocument{{key: "name", value: "jane"}})
+	sequence := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sequence, uint32(4+len("documents")+1+len(documents)))
+	sequence = concat(sequence, []byte("documents"), []byte{0}, documents)
+
+	messages := [][]byte{
+		encodeMongoOpMsg(1, 0, bsonDocument{{key: "find", value: "users"}, {key: "$db", value: "app"}}),
+		encodeMongoMessage(2, 0, mongoOpMsg, concat([]byte{mongoChecksumPresent, 0, 0, 0, 1}, sequence, []byte{0},
+			encodeBSON(bsonDocument{{key: "insert", value: "users"}}), []byte{1, 2, 3, 4})),
+		encodeMongoOpQuery(3, "app.users", bsonDocument{{key: "$query", value: bsonDocument{{key: "n", value: 1.0}}}}),
+		encodeMongoOpReply(4, 3, mongoQueryFailure, bsonDocument{{key: "$err", value: "bad query"}}),
+	}
+	for _, message := range messages {
+		inputs := mutations(message)
+		for i := 0; i < len(message); i++ {
+			inputs = append(inputs, message[:i])
+		}
+		for _, input := range inputs {
+			// Errors are expected, only a panic fails the test.
+			decoded, _ := parseMongoMessages(input, nil)
+			for _, decodedMessage := range decoded {
+				decodedMessage.command()
+				decodedMessage.responseError()
+			}
+		}
+	}
+}
+
+func TestHandleMongoConnectionEvictsOldestRequests(t *testing.T) {
+	factory := NewFactory(time.Minute)
+	tracker := NewTracker(structs.ConnID{})
+	tracker.mongo = true
+	tracker.mongoRequests = make(map[int32]mongoMessage)
+
+	// The request ids decrease as the requests arrive, so that the oldest have the highest ids.
+	total := maxPendingMongoRequests + 76
+	find := bsonDocument{{key: "find", value: "users"}, {key: "$db", value: "app"}}
+	for i := 0; i < total; i++ {
+		tracker.recvSegments = append(tracker.recvSegments, dataSegment{offset: len(tracker.recvBuf),
+			timestampNano: uint64(1000 + i)})
+		tracker.recvBuf = append(tracker.recvBuf, encodeMongoOpMsg(int32(total-i), 0, find)...)
+	}
+	factory.handleMongoConnection(tracker, false)
+
+	stats := factory.mongoInventory["app.users:find"]
+	if len(tracker.mongoRequests) != maxPendingMongoRequests || stats == nil || stats.count != 76 {
+		t.Fatalf("handleMongoConnection() kept %d requests and recorded %v, want %d kept and 76 recorded",
+			len(tracker.mongoRequests), stats, maxPendingMongoRequests)
+	}
+	for id := range tracker.mongoRequests {
+		if id > int32(maxPendingMongoRequests) {
+			t.Errorf("handleMongoConnection() kept request %d, want only the %d newest", id, maxPendingMongoRequests)
+		}
+	}
+
+	// The newest request is still paired with its response, the response of an evicted one is dropped.
+	ok := bsonDocument{{key: "ok", value: 1.0}}
+	tracker.sentSegments = []dataSegment{{offset: 0, timestampNano: uint64(1000 + total + 5)}}
+	tracker.sentBuf = concat(encodeMongoOpMsg(5000, 1, ok), encodeMongoOpMsg(5001, int32(total), ok))
+	factory.handleMongoConnection(tracker, false)
+	if stats.count != 77 || stats.timedCount != 1 || stats.maxLatency != 6 {
+		t.Errorf("handleMongoConnection() recorded %d commands and %d timed with latency %v, want 77, 1 and 6ns",
+			stats.count, stats.timedCount, stats.maxLatency)
+	}
+	if _, pending := tracker.mongoRequests[1]; pending || len(tracker.mongoRequests) != maxPendingMongoRequests-1 {
+		t.Errorf("handleMongoConnection() kept %d requests, want %d without request 1", len(tracker.mongoRequests),
+			maxPendingMongoRequests-1)
+	}
+}
@@ -0,0 +1,291 @@
+package connections
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	accessEventCategory = "access"
+
+	accessFindingEnumeration   = "object_enumeration"
+	accessFindingCrossIdentity = "cross_identity_access"
+
+	identityPrefixJWT     = "jwt:"
+	identityPrefixSession = "session:"
+
+	// objectEnumerationThreshold is the number of distinct objects an identity reads through an endpoint before it is
+	// reported as enumerating them.
+	objectEnumerationThreshold = 50
+	// sharedObjectAccessors is the number of identities an object is read by before it is considered shared, such as a
+	// catalog entry, so further reads by other identities are expected.
+	sharedObjectAccessors = 3
+	// maxTrackedObjectsPerEndpoint and maxTrackedIdentitiesPerEndpoint bound the accesses we keep per endpoint.
+	maxTrackedObjectsPerEndpoint    = 10000
+	maxTrackedIdentitiesPerEndpoint = 1000
+	// maxTrackedObjectsPerIdentity bounds the objects we keep per identity, well above the enumeration threshold, so
+	// the identities of an endpoint cannot hold more than maxTrackedIdentitiesPerEndpoint times as many.
+	maxTrackedObjectsPerIdentity = 4 * objectEnumerationThreshold
+)
+
+// callerIdentity returns who sent a request: the subject of its JWT, or else the hash of its session cookie. Requests
+// without either return an empty string.
+func callerIdentity(req *http.Request) string {
+	for _, token := range extractCredentials(req).tokens {
+		if subject := token.stringClaim("sub"); subject != "" {
+			return identityPrefixJWT + subject
+		}
+	}
+	for _, cookie := range req.Cookies() {
+		if cookie.Value != "" && isSessionCookieName(cookie.Name) {
+			hash := sha256.Sum256([]byte(cookie.Value))
+			return identityPrefixSession + hex.EncodeToString(hash[:])[:16]
+		}
+	}
+	return ""
+}
+
+// objectIDs returns the identifiers of the objects a request addresses, the values of the templated segments of its
+// path, keyed by the names of their parameters.
+func objectIDs(path string, template string) map[string]string {
+	segments, templateSegments := strings.Split(path, "/"), strings.Split(template, "/")
+	if len(segments) != len(templateSegments) {
+		return nil
+	}
+	ids := make(map[string]string)
+	for i, segment := range templateSegments {
+		if strings.HasPrefix(segment, "{") {
+			ids[strings.Trim(segment, "{}")] = segments[i]
+		}
+	}
+	return ids
+}
+
+// objectOwner is the identity that read an object first, and the other identities that read it since. Once it is read
+// by more than sharedObjectAccessors identities, the object is shared and the identities are no longer kept.
+type objectOwner struct {
+	identity  string
+	accessors map[string]struct{}
+	shared    bool
+}
+
+// addAccessor records that an identity read the object. It returns whether the identity is another one than the
+// identities that read the object before, and the object is not shared.
+func (owner *objectOwner) addAccessor(identity string) bool {
+	if owner.shared || identity == owner.identity {
+		return false
+	}
+	if _, ok := owner.accessors[identity]; ok {
+		return false
+	}
+	if 1+len(owner.accessors) >= sharedObjectAccessors {
+		owner.shared = true
+		owner.accessors = nil
+		return false
+	}
+	if owner.accessors == nil {
+		owner.accessors = make(map[string]struct{})
+	}
+	owner.accessors[identity] = struct{}{}
+	return true
+}
+
+// identityAccess is what an identity read through an endpoint.
+type identityAccess struct {
+	objects       map[string]struct{}
+	crossAccesses uint64
+	// The findings are reported once per identity and endpoint.
+	enumerationReported bool
+	crossReported       bool
+}
+
+// ObjectAccess tracks which identities read which objects through an endpoint, to tell endpoints that serve the
+// objects of other identities (broken object level authorization).
+type ObjectAccess struct {
+	owners     map[string]*objectOwner
+	identities map[string]*identityAccess
+}
+
+// NewObjectAccess creates a new instance of the object access tracker.
+func NewObjectAccess() *ObjectAccess {
+	return &ObjectAccess{
+		owners:     make(map[string]*objectOwner),
+		identities: make(map[string]*identityAccess),
+	}
+}
+
+func (access *ObjectAccess) identity(identity string) *identityAccess {
+	accesses, ok := access.identities[identity]
+	if !ok {
+		if len(access.identities) >= maxTrackedIdentitiesPerEndpoint {
+			return nil
+		}
+		accesses = &identityAccess{objects: make(map[string]struct{})}
+		access.identities[identity] = accesses
+	}
+	return accesses
+}
+
+// crossAccesses returns the number of reads of objects owned by other identities.
+func (access *ObjectAccess) crossAccesses() uint64 {
+	total := uint64(0)
+	for _, accesses := range access.identities {
+		total += accesses.crossAccesses
+	}
+	return total
+}
+
+func (access *ObjectAccess) merge(other *ObjectAccess) {
+	for object, owner := range other.owners {
+		existing, ok := access.owners[object]
+		if !ok {
+			if len(access.owners) >= maxTrackedObjectsPerEndpoint {
+				continue
+			}
+			existing = &objectOwner{identity: owner.identity}
+			access.owners[object] = existing
+		}
+		existing.addAccessor(owner.identity)
+		for identity := range owner.accessors {
+			existing.addAccessor(identity)
+		}
+		if owner.shared {
+			existing.shared = true
+			existing.accessors = nil
+		}
+	}
+	for identity, otherAccesses := range other.identities {
+		accesses := access.identity(identity)
+		if accesses == nil {
+			continue
+		}
+		for object := range otherAccesses.objects {
+			if len(accesses.objects) >= maxTrackedObjectsPerIdentity {
+				break
+			}
+			accesses.objects[object] = struct{}{}
+		}
+		accesses.crossAccesses += otherAccesses.crossAccesses
+		accesses.enumerationReported = accesses.enumerationReported || otherAccesses.enumerationReported
+		accesses.crossReported = accesses.crossReported || otherAccesses.crossReported
+	}
+}
+
+func (access *ObjectAccess) String() string {
+	return fmt.Sprintf("identities=%d objects=%d cross_identity=%d", len(access.identities), len(access.owners),
+		access.crossAccesses())
+}
+
+// objectAccessFinding is a finding of a read, along with what to report it with.
+type objectAccessFinding struct {
+	findingType string
+	object      string
+	owner       string
+	objects     int
+}
+
+// addObjectAccess records that an identity read objects through the endpoint. It returns the findings that were not
+// reported for the identity before.
+func (schema *ApiSchema) addObjectAccess(identity string, ids map[string]string) []objectAccessFinding {
+	schema.mutex.Lock()
+	defer schema.mutex.Unlock()
+	access := schema.objects
+	accesses := access.identity(identity)
+	if accesses == nil {
+		return nil
+	}
+	findings := make([]objectAccessFinding, 0)
+	for name, id := range ids {
+		object := name + "=" + id
+		_, seen := accesses.objects[object]
+		if !seen && len(accesses.objects) < maxTrackedObjectsPerIdentity {
+			accesses.objects[object] = struct{}{}
+		}
+		owner, ok := access.owners[object]
+		if !ok {
+			if len(access.owners) < maxTrackedObjectsPerEndpoint {
+				access.owners[object] = &objectOwner{identity: identity}
+			}
+			continue
+		}
+		// Reads of an object by the identities that read it before are not counted again.
+		if !owner.addAccessor(identity) {
+			continue
+		}
+		accesses.crossAccesses++
+		if !accesses.crossReported {
+			accesses.crossReported = true
+			findings = append(findings, objectAccessFinding{findingType: accessFindingCrossIdentity, object: object,
+				owner: owner.identity})
+		}
+	}
+	if !accesses.enumerationReported && len(accesses.objects) >= objectEnumerationThreshold {
+		accesses.enumerationReported = true
+		findings = append(findings, objectAccessFinding{findingType: accessFindingEnumeration,
+			objects: len(accesses.objects)})
+	}
+	return findings
+}
+
+// reportedIdentity returns the identity as it is reported, with subjects that hold sensitive values redacted.
+func (factory *Factory) reportedIdentity(identity string) string {
+	if subject := strings.TrimPrefix(identity, identityPrefixJWT); subject != identity &&
+		factory.redactor.sensitive(factory.pii, "sub", subject) {
+		return identityPrefixJWT + factory.redactor.redactValue(subject)
+	}
+	return identity
+}
+
+// reportedObject returns the object as it is reported, with identifiers that hold sensitive values redacted.
+func (factory *Factory) reportedObject(object string) string {
+	index := strings.IndexByte(object, '=')
+	if index == -1 {
+		return object
+	}
+	if name, id := object[:index], object[index+1:]; factory.redactor.sensitive(factory.pii, name, id) {
+		return name + "=" + factory.redactor.redactValue(id)
+	}
+	return object
+}
+
+// trackObjectAccess records which identity read which objects through the endpoint, by the templated segments of its
+// path. Identities that read many distinct objects, or objects read by another identity before, are reported once per
+// endpoint.
+func (factory *Factory) trackObjectAccess(schema *ApiSchema, req *http.Request, res *http.Response, template string) {
+	if res.StatusCode < http.StatusOK || res.StatusCode >= http.StatusMultipleChoices {
+		// Only the objects the endpoint served count as read.
+		return
+	}
+	ids := objectIDs(req.URL.Path, template)
+	if len(ids) == 0 {
+		return
+	}
+	identity := callerIdentity(req)
+	if identity == "" {
+		return
+	}
+	for _, finding := range schema.addObjectAccess(identity, ids) {
+		event := Event{
+			Category: accessEventCategory,
+			Type:     finding.findingType,
+			Method:   schema.method,
+			Path:     schema.uri,
+			Details:  map[string]interface{}{"identity": factory.reportedIdentity(identity)},
+		}
+		switch finding.findingType {
+		case accessFindingCrossIdentity:
+			event.Severity = eventSeverityHigh
+			event.Message = "identity read an object read by another identity before"
+			event.Details["object"] = factory.reportedObject(finding.object)
+			event.Details["owner"] = factory.reportedIdentity(finding.owner)
+		case accessFindingEnumeration:
+			event.Severity = eventSeverityWarning
+			event.Message = fmt.Sprintf("identity read %d distinct objects", finding.objects)
+			event.Details["objects"] = finding.objects
+		}
+		factory.events.Emit(event)
+	}
+}
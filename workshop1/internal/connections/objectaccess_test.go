@@ -0,0 +1,170 @@
+package connections
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testJWT returns an unsigned JWT of the subject.
+func testJWT(subject string) string {
+	encode := base64.RawURLEncoding.EncodeToString
+	return encode([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + encode([]byte(`{"sub":"`+subject+`"}`)) + ".c2ln"
+}
+
+func TestAddObjectAccessCrossIdentity(t *testing.T) {
+	type read struct {
+		identity string
+		object   string
+		// findings are the types of the findings of the read, crossAccesses the cross-identity reads of the identity
+		// after it.
+		findings      []string
+		crossAccesses uint64
+	}
+	tests := []struct {
+		name  string
+		reads []read
+	}{
+		{"owner reads again", []read{
+			{"alice", "1", nil, 0},
+			{"alice", "1", nil, 0},
+		}},
+		{"reported once per identity", []read{
+			{"alice", "1", nil, 0},
+			{"alice", "2", nil, 0},
+			{"bob", "1", []string{accessFindingCrossIdentity}, 1},
+			{"bob", "1", nil, 1},
+			{"bob", "2", nil, 2},
+		}},
+		// The fourth identity makes the object shared, so its reads and the reads of the identities after it are
+		// expected.
+		{"shared object", []read{
+			{"alice", "1", nil, 0},
+			{"bob", "1", []string{accessFindingCrossIdentity}, 1},
+			{"carol", "1", []string{accessFindingCrossIdentity}, 1},
+			{"dave", "1", nil, 0},
+			{"erin", "1", nil, 0},
+			{"bob", "1", nil, 1},
+		}},
+		// Repeated reads by an identity do not count as the reads of other identities, and do not make it shared.
+		{"repeated reads", []read{
+			{"alice", "1", nil, 0},
+			{"bob", "1", []string{accessFindingCrossIdentity}, 1},
+			{"bob", "1", nil, 1},
+			{"bob", "1", nil, 1},
+			{"bob", "1", nil, 1},
+			{"carol", "1", []string{accessFindingCrossIdentity}, 1},
+		}},
+	}
+	for _, test := range tests {
+		schema := NewApiSchema("GET", "/orders/{id}", nil, nil, false)
+		for i, read := range test.reads {
+			findings := make([]string, 0)
+			for _, finding := range schema.addObjectAccess(read.identity, map[string]string{"id": read.object}) {
+				findings = append(findings, finding.findingType)
+			}
+			crossAccesses := schema.objects.identities[read.identity].crossAccesses
+			if !equalStrings(findings, read.findings) || crossAccesses != read.crossAccesses {
+				t.Errorf("%s: read %d of %s = findings %v and %d cross accesses, want %v and %d", test.name, i,
+					read.identity, findings, crossAccesses, read.findings, read.crossAccesses)
+			}
+		}
+	}
+}
+
+func TestAddObjectAccessBeyondTrackedObjects(t *testing.T) {
+	schema := NewApiSchema("GET", "/orders/{id}", nil, nil, false)
+	schema.addObjectAccess("alice", map[string]string{"id": "owned"})
+	for i := 0; i < maxTrackedObjectsPerIdentity; i++ {
+		schema.addObjectAccess("bob", map[string]string{"id": fmt.Sprintf("bob-%d", i)})
+	}
+	// Bob no longer records the objects he reads, which must not make his reads of an object count more than once.
+	for i := 0; i < 2*sharedObjectAccessors; i++ {
+		schema.addObjectAccess("bob", map[string]string{"id": "owned"})
+	}
+	owner := schema.objects.owners["id=owned"]
+	if owner.shared || len(owner.accessors) != 1 || schema.objects.identities["bob"].crossAccesses != 1 {
+		t.Errorf("addObjectAccess() = shared %v with %d accessors and %d cross accesses, want 1 accessor and 1 cross "+
+			"access", owner.shared, len(owner.accessors), schema.objects.identities["bob"].crossAccesses)
+	}
+	findings := schema.addObjectAccess("carol", map[string]string{"id": "owned"})
+	if len(findings) != 1 || findings[0].findingType != accessFindingCrossIdentity || findings[0].owner != "alice" {
+		t.Errorf("addObjectAccess() of another identity = %+v, want a cross identity finding of alice", findings)
+	}
+}
+
+func TestAddObjectAccessEnumeration(t *testing.T) {
+	schema := NewApiSchema("GET", "/orders/{id}", nil, nil, false)
+	reported := 0
+	for i := 0; i < 2*objectEnumerationThreshold; i++ {
+		for _, finding := range schema.addObjectAccess("mallory", map[string]string{"id": fmt.Sprintf("%d", i)}) {
+			if finding.findingType != accessFindingEnumeration || finding.objects != objectEnumerationThreshold {
+				t.Errorf("addObjectAccess() of object %d = %+v, want an enumeration of %d objects", i, finding,
+					objectEnumerationThreshold)
+			}
+			reported++
+		}
+	}
+	// Reading the same object again does not enumerate.
+	for i := 0; i < 2*objectEnumerationThreshold; i++ {
+		schema.addObjectAccess("alice", map[string]string{"id": "1"})
+	}
+	if reported != 1 || schema.objects.identities["alice"].enumerationReported {
+		t.Errorf("addObjectAccess() reported %d enumerations, want 1 of mallory", reported)
+	}
+}
+
+func TestObjectAccessMerge(t *testing.T) {
+	access := NewObjectAccess()
+	access.owners["id=1"] = &objectOwner{identity: "alice"}
+	access.owners["id=1"].addAccessor("bob")
+	other := NewObjectAccess()
+	other.owners["id=1"] = &objectOwner{identity: "carol"}
+	other.owners["id=1"].addAccessor("bob")
+	other.owners["id=2"] = &objectOwner{identity: "carol"}
+	access.merge(other)
+
+	// Carol is the third identity of the first object, which becomes shared with a fourth one.
+	if owner := access.owners["id=1"]; owner.shared || len(owner.accessors) != 2 {
+		t.Errorf("merge() = shared %v with accessors %v, want [bob carol]", owner.shared, owner.accessors)
+	}
+	if access.owners["id=1"].addAccessor("dave") || !access.owners["id=1"].shared {
+		t.Errorf("addAccessor() of a fourth identity did not make the object shared")
+	}
+	if owner := access.owners["id=2"]; owner == nil || owner.identity != "carol" {
+		t.Errorf("merge() = %+v, want the second object owned by carol", owner)
+	}
+}
+
+func TestTrackObjectAccess(t *testing.T) {
+	factory := NewFactory(time.Minute)
+	var events strings.Builder
+	factory.SetEventSink(NewEventSink(&events))
+	schema := NewApiSchema("GET", "/orders/{id}", nil, nil, false)
+	requests := []struct {
+		token      string
+		path       string
+		statusCode int
+	}{
+		{testJWT("alice"), "/orders/1", http.StatusOK},
+		// Objects the endpoint did not serve are not read.
+		{testJWT("bob"), "/orders/1", http.StatusForbidden},
+		{"", "/orders/1", http.StatusOK},
+		{testJWT("bob"), "/orders/1", http.StatusOK},
+	}
+	for _, request := range requests {
+		transaction := newTestTransaction("GET", request.path, "", request.statusCode, "", "")
+		if request.token != "" {
+			transaction.req.Header.Set("Authorization", "Bearer "+request.token)
+		}
+		factory.trackObjectAccess(schema, transaction.req, transaction.res, schema.uri)
+	}
+	if got := strings.Count(events.String(), `"type":"cross_identity_access"`); got != 1 ||
+		!strings.Contains(events.String(), `"owner":"jwt:alice"`) {
+		t.Errorf("trackObjectAccess() emitted %d cross identity events, want 1 of the object of alice: %s", got,
+			events.String())
+	}
+}
@@ -0,0 +1,353 @@
+package connections
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	openAPIVersion = "3.1.0"
+	// openAPIMediaTypeJSON is the media type of the bodies we inferred a schema for without a media type.
+	openAPIMediaTypeJSON = "application/json"
+)
+
+// openAPIMethods are the methods an OpenAPI path item can describe, other methods are left out of the specification.
+var openAPIMethods = map[string]struct{}{
+	http.MethodGet:     {},
+	http.MethodPut:     {},
+	http.MethodPost:    {},
+	http.MethodDelete:  {},
+	http.MethodOptions: {},
+	http.MethodHead:    {},
+	http.MethodPatch:   {},
+	http.MethodTrace:   {},
+}
+
+// openAPIIgnoredHeaders are the request headers left out of the parameters. Accept, Content-Type and Authorization
+// are described elsewhere in OpenAPI specifications, cookies are parameters of their own, and the rest are sent by
+// every client rather than being inputs of the endpoint.
+var openAPIIgnoredHeaders = map[string]struct{}{
+	"Accept":                   {},
+	"Accept-Encoding":          {},
+	"Accept-Language":          {},
+	"Authorization":            {},
+	"Connection":               {},
+	"Content-Length":           {},
+	"Content-Type":             {},
+	"Cookie":                   {},
+	"Sec-Websocket-Extensions": {},
+	"Sec-Websocket-Key":        {},
+	"Sec-Websocket-Version":    {},
+	"Upgrade":                  {},
+	"User-Agent":               {},
+}
+
+type openAPIDocument struct {
+	OpenAPI string                                  `json:"openapi"`
+	Info    openAPIInfo                             `json:"info"`
+	Paths   map[string]map[string]*openAPIOperation `json:"paths"`
+}
+
+type openAPIInfo struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+type openAPIOperation struct {
+	Summary     string                      `json:"summary,omitempty"`
+	Parameters  []openAPIParameter          `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+	SampleCount uint64                      `json:"x-sample-count"`
+	ContainsPII bool                        `json:"x-contains-pii,omitempty"`
+	// Authentication counts the requests by authentication scheme, so unauthenticated endpoints stand out.
+	Authentication map[string]uint64 `json:"x-authentication,omitempty"`
+}
+
+type openAPIParameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required,omitempty"`
+	Schema   *Schema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Content map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema *Schema `json:"schema,omitempty"`
+}
+
+// parameterSchema describes the values of a path parameter of the given type.
+func parameterSchema(parameterType string) *Schema {
+	switch parameterType {
+	case pathParameterInteger:
+		return &Schema{Type: schemaTypeInteger}
+	case pathParameterUUID:
+		return &Schema{Type: schemaTypeString, Format: schemaFormatUUID}
+	default:
+		return &Schema{Type: schemaTypeString}
+	}
+}
+
+// unionSchema describes the bodies of the entries that share an operation, such as the GraphQL operations served on a
+// single path.
+func unionSchema(schemas []*Schema) *Schema {
+	switch len(schemas) {
+	case 0:
+		return nil
+	case 1:
+		return schemas[0]
+	default:
+		return &Schema{OneOf: schemas}
+	}
+}
+
+// requestBodyContent describes the media types of the request bodies, each with the schema of the bodies sent with it.
+func requestBodyContent(contentTypes map[string]struct{}, bodies map[string][]*Schema) map[string]openAPIMediaType {
+	content := make(map[string]openAPIMediaType, len(contentTypes))
+	for contentType := range contentTypes {
+		content[contentType] = openAPIMediaType{Schema: unionSchema(bodies[contentType])}
+	}
+	return content
+}
+
+// bodyContent describes the media types of the bodies. The schema is set for the media types we infer the schema of,
+// and bodies with a schema but no media type are described as JSON.
+func bodyContent(contentTypes map[string]struct{}, body *Schema) map[string]openAPIMediaType {
+	content := make(map[string]openAPIMediaType, len(contentTypes))
+	hasSchema := false
+	for contentType := range contentTypes {
+		if body != nil && isStructuredMediaType(contentType) {
+			content[contentType] = openAPIMediaType{Schema: body}
+			hasSchema = true
+			continue
+		}
+		content[contentType] = openAPIMediaType{}
+	}
+	if body != nil && !hasSchema {
+		content[openAPIMediaTypeJSON] = openAPIMediaType{Schema: body}
+	}
+	return content
+}
+
+// buildOpenAPIOperation describes the entries of a single method and path as an OpenAPI operation.
+func buildOpenAPIOperation(entries []*ApiSchema) *openAPIOperation {
+	operation := &openAPIOperation{Responses: make(map[string]*openAPIResponse)}
+	var names []string
+	var responseBodies []*Schema
+	requestBodies := make(map[string][]*Schema)
+	queryParameters := make(map[string]*ParameterStats)
+	headers := make(map[string]*ParameterStats)
+	cookies := make(map[string]uint64)
+	contentTypes := make(map[int]map[string]struct{})
+	requestContentTypes := make(map[string]struct{})
+	errorBodies := make(map[int][]*Schema)
+	requests := uint64(0)
+	for _, entry := range entries {
+		entry.mutex.RLock()
+		operation.SampleCount += entry.samples
+		requests += entry.requests
+		operation.ContainsPII = operation.ContainsPII || entry.containsPII
+		for scheme, count := range entry.auth.schemes {
+			if operation.Authentication == nil {
+				operation.Authentication = make(map[string]uint64)
+			}
+			operation.Authentication[scheme] += count
+		}
+		if entry.operation != "" {
+			names = append(names, entry.operation)
+		}
+		for contentType, requestSchema := range entry.requestSchemas {
+			// Bodies without a media type are described as JSON.
+			if contentType == "" {
+				contentType = openAPIMediaTypeJSON
+			}
+			requestBodies[contentType] = append(requestBodies[contentType], requestSchema)
+			requestContentTypes[contentType] = struct{}{}
+		}
+		if entry.responseSchema != nil {
+			responseBodies = append(responseBodies, entry.responseSchema)
+		}
+		mergeParameters(queryParameters, entry.queryParameters)
+		for name, stats := range entry.headers {
+			if _, ok := openAPIIgnoredHeaders[name]; !ok {
+				mergeParameters(headers, map[string]*ParameterStats{name: stats})
+			}
+		}
+		for name, stats := range entry.cookies {
+			if stats.sent > 0 {
+				cookies[name] += stats.sent
+			}
+		}
+		for statusCode := range entry.statusCodes {
+			if _, ok := contentTypes[statusCode]; !ok {
+				contentTypes[statusCode] = make(map[string]struct{})
+			}
+			for contentType := range entry.contentTypes[statusCode] {
+				contentTypes[statusCode][contentType] = struct{}{}
+			}
+		}
+		for contentType := range entry.requestContentTypes {
+			requestContentTypes[contentType] = struct{}{}
+		}
+		for statusCode, errorSchema := range entry.errorSchemas {
+			errorBodies[statusCode] = append(errorBodies[statusCode], errorSchema)
+		}
+		entry.mutex.RUnlock()
+	}
+	if len(names) > 0 {
+		operation.Summary = strings.Join(names, ", ")
+	}
+
+	// Every entry of the operation shares the template, so the path parameters of the first entry describe them all.
+	for _, parameter := range entries[0].pathParameters {
+		operation.Parameters = append(operation.Parameters, openAPIParameter{
+			Name:     parameter.name,
+			In:       "path",
+			Required: true,
+			Schema:   parameterSchema(parameter.parameterType),
+		})
+	}
+	addOpenAPIParameters := func(in string, parameters map[string]*ParameterStats) {
+		names := make([]string, 0, len(parameters))
+		for name := range parameters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			schema := parameters[name].schema
+			if schema == nil {
+				schema = &Schema{Type: schemaTypeString}
+			}
+			operation.Parameters = append(operation.Parameters, openAPIParameter{
+				Name: name,
+				In:   in,
+				// Parameters sent with every request we saw are considered required.
+				Required: requests > 0 && parameters[name].count >= requests,
+				Schema:   schema,
+			})
+		}
+	}
+	addOpenAPIParameters("query", queryParameters)
+	addOpenAPIParameters("header", headers)
+	cookieParameters := make(map[string]*ParameterStats, len(cookies))
+	for name, count := range cookies {
+		// Cookie values are opaque.
+		cookieParameters[name] = &ParameterStats{count: count, schema: &Schema{Type: schemaTypeString}}
+	}
+	addOpenAPIParameters("cookie", cookieParameters)
+
+	if len(requestContentTypes) > 0 {
+		operation.RequestBody = &openAPIRequestBody{Content: requestBodyContent(requestContentTypes, requestBodies)}
+	}
+	for statusCode, statusContentTypes := range contentTypes {
+		var body *Schema
+		if statusCode >= http.StatusOK && statusCode < http.StatusMultipleChoices {
+			body = unionSchema(responseBodies)
+		} else {
+			body = unionSchema(errorBodies[statusCode])
+		}
+		content := bodyContent(statusContentTypes, body)
+		response := &openAPIResponse{Description: http.StatusText(statusCode)}
+		if response.Description == "" {
+			response.Description = fmt.Sprintf("Status %d", statusCode)
+		}
+		if len(content) > 0 {
+			response.Content = content
+		}
+		operation.Responses[strconv.Itoa(statusCode)] = response
+	}
+	if len(operation.Responses) == 0 {
+		// OpenAPI requires at least one response per operation.
+		operation.Responses["default"] = &openAPIResponse{Description: "No response was observed"}
+	}
+	return operation
+}
+
+// buildOpenAPIDocument describes the api inventory as an OpenAPI document. The caller must hold the factory lock.
+func (factory *Factory) buildOpenAPIDocument() *openAPIDocument {
+	document := &openAPIDocument{
+		OpenAPI: openAPIVersion,
+		Info: openAPIInfo{
+			Title:       "API inventory",
+			Description: "Inferred from the traffic captured by the sniffer.",
+			Version:     time.Now().UTC().Format(time.RFC3339),
+		},
+		Paths: make(map[string]map[string]*openAPIOperation),
+	}
+
+	// GraphQL operations and JSON-RPC methods are entries of their own, but share the method and path.
+	keys := make([]string, 0, len(factory.apiInventory))
+	for key := range factory.apiInventory {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	operations := make(map[string][]*ApiSchema)
+	for _, key := range keys {
+		schema := factory.apiInventory[key]
+		if _, ok := openAPIMethods[schema.method]; !ok {
+			continue
+		}
+		operationKey := schema.method + "_" + schema.uri
+		operations[operationKey] = append(operations[operationKey], schema)
+	}
+
+	for _, entries := range operations {
+		path := entries[0].uri
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		if _, ok := document.Paths[path]; !ok {
+			document.Paths[path] = make(map[string]*openAPIOperation)
+		}
+		document.Paths[path][strings.ToLower(entries[0].method)] = buildOpenAPIOperation(entries)
+	}
+	return document
+}
+
+// OpenAPISpec returns the api inventory as an OpenAPI 3 specification, in JSON.
+func (factory *Factory) OpenAPISpec() ([]byte, error) {
+	factory.mutex.RLock()
+	defer factory.mutex.RUnlock()
+	return json.MarshalIndent(factory.buildOpenAPIDocument(), "", "  ")
+}
+
+// WriteOpenAPISpec writes the api inventory as an OpenAPI 3 specification to the given file. The file is replaced
+// atomically, so readers never see a partially written specification.
+func (factory *Factory) WriteOpenAPISpec(path string) error {
+	spec, err := factory.OpenAPISpec()
+	if err != nil {
+		return fmt.Errorf("failed to build the OpenAPI specification: %v", err)
+	}
+	tempFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create the OpenAPI specification file: %v", err)
+	}
+	defer os.Remove(tempFile.Name())
+	if _, err := tempFile.Write(spec); err != nil {
+		tempFile.Close()
+		return fmt.Errorf("failed to write the OpenAPI specification: %v", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("failed to write the OpenAPI specification: %v", err)
+	}
+	if err := os.Rename(tempFile.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace the OpenAPI specification: %v", err)
+	}
+	return nil
+}
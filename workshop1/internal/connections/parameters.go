@@ -0,0 +1,167 @@
+package connections
+
+import (
+	"fmt"
+	"net/http"
+)
+
+const (
+	// maxParametersPerEndpoint bounds the distinct query parameters, headers and cookies we keep per endpoint.
+	maxParametersPerEndpoint = 64
+)
+
+// ParameterStats aggregates the observations of a single query parameter or header of an endpoint. Values are never
+// kept, only their schema.
+type ParameterStats struct {
+	// count is the number of transactions that held the parameter.
+	count  uint64
+	schema *Schema
+}
+
+func (stats *ParameterStats) String() string {
+	return fmt.Sprintf("count=%d schema=%s", stats.count, stats.schema)
+}
+
+// addParameter records an observation of a parameter, unless the endpoint already holds too many parameters.
+func addParameter(parameters map[string]*ParameterStats, name string, values []string) {
+	stats, ok := parameters[name]
+	if !ok {
+		if len(parameters) >= maxParametersPerEndpoint {
+			return
+		}
+		stats = &ParameterStats{}
+		parameters[name] = stats
+	}
+	stats.count++
+	for _, value := range values {
+		stats.schema = mergeSchemas(stats.schema, inferScalarSchema(value))
+	}
+}
+
+func mergeParameters(current map[string]*ParameterStats, other map[string]*ParameterStats) {
+	for name, otherStats := range other {
+		stats, ok := current[name]
+		if !ok {
+			if len(current) < maxParametersPerEndpoint {
+				current[name] = &ParameterStats{count: otherStats.count, schema: otherStats.schema.clone()}
+			}
+			continue
+		}
+		stats.count += otherStats.count
+		stats.schema = mergeSchemas(stats.schema, otherStats.schema.clone())
+	}
+}
+
+// CookieStats aggregates the observations of a single cookie of an endpoint. The attributes are the ones of the last
+// Set-Cookie header that set the cookie.
+type CookieStats struct {
+	// sent is the number of requests that sent the cookie, and set is the number of responses that set it.
+	sent       uint64
+	set        uint64
+	secure     bool
+	httpOnly   bool
+	sameSite   string
+	path       string
+	domain     string
+	persistent bool
+}
+
+func (stats *CookieStats) String() string {
+	if stats.set == 0 {
+		return fmt.Sprintf("sent=%d", stats.sent)
+	}
+	return fmt.Sprintf("sent=%d set=%d secure=%v httpOnly=%v sameSite=%s path=%s domain=%s persistent=%v",
+		stats.sent, stats.set, stats.secure, stats.httpOnly, stats.sameSite, stats.path, stats.domain, stats.persistent)
+}
+
+func sameSiteName(sameSite http.SameSite) string {
+	switch sameSite {
+	case http.SameSiteLaxMode:
+		return "Lax"
+	case http.SameSiteStrictMode:
+		return "Strict"
+	case http.SameSiteNoneMode:
+		return "None"
+	default:
+		return ""
+	}
+}
+
+func (schema *ApiSchema) cookie(name string) *CookieStats {
+	stats, ok := schema.cookies[name]
+	if !ok {
+		if len(schema.cookies) >= maxParametersPerEndpoint {
+			return nil
+		}
+		stats = &CookieStats{}
+		schema.cookies[name] = stats
+	}
+	return stats
+}
+
+// addParameters records the path parameters, query parameters, headers and cookies of another request of the
+// endpoint.
+func (schema *ApiSchema) addParameters(req *http.Request, pathParameters []PathParameter) {
+	schema.addPathParameters(pathParameters)
+
+	schema.mutex.Lock()
+	defer schema.mutex.Unlock()
+	schema.requests++
+	for name, values := range req.URL.Query() {
+		addParameter(schema.queryParameters, name, values)
+	}
+	for name, values := range req.Header {
+		addParameter(schema.headers, name, values)
+	}
+	// A cookie sent twice in a request is counted once.
+	sent := make(map[string]struct{})
+	for _, cookie := range req.Cookies() {
+		if _, ok := sent[cookie.Name]; ok {
+			continue
+		}
+		sent[cookie.Name] = struct{}{}
+		if stats := schema.cookie(cookie.Name); stats != nil {
+			stats.sent++
+		}
+	}
+}
+
+// addResponseHeaders records the headers and the cookies set by another response of the endpoint.
+func (schema *ApiSchema) addResponseHeaders(res *http.Response) {
+	schema.mutex.Lock()
+	defer schema.mutex.Unlock()
+	for name, values := range res.Header {
+		addParameter(schema.responseHeaders, name, values)
+	}
+	for _, cookie := range res.Cookies() {
+		stats := schema.cookie(cookie.Name)
+		if stats == nil {
+			continue
+		}
+		stats.set++
+		stats.secure = cookie.Secure
+		stats.httpOnly = cookie.HttpOnly
+		stats.sameSite = sameSiteName(cookie.SameSite)
+		stats.path = cookie.Path
+		stats.domain = cookie.Domain
+		stats.persistent = cookie.MaxAge > 0 || !cookie.Expires.IsZero()
+	}
+}
+
+func mergeCookies(current map[string]*CookieStats, other map[string]*CookieStats) {
+	for name, otherStats := range other {
+		stats, ok := current[name]
+		if !ok {
+			if len(current) < maxParametersPerEndpoint {
+				copied := *otherStats
+				current[name] = &copied
+			}
+			continue
+		}
+		sent, set := stats.sent+otherStats.sent, stats.set+otherStats.set
+		if otherStats.set > 0 {
+			*stats = *otherStats
+		}
+		stats.sent, stats.set = sent, set
+	}
+}
@@ -0,0 +1,223 @@
+package connections
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	pathParameterInteger = "integer"
+	pathParameterUUID    = "uuid"
+	pathParameterHash    = "hash"
+	pathParameterString  = "string"
+
+	// defaultCardinalityThreshold is the number of distinct values after which a path segment is considered variable.
+	defaultCardinalityThreshold = 50
+	// maxPathPositions bounds the templated prefixes whose segments we learn, so paths made of random segments do not
+	// grow them without bound. Beyond it, only the positions learned so far keep learning.
+	maxPathPositions = 10000
+	// minHashLength is the minimal length of hex segments we consider hashes (or object ids) rather than words.
+	minHashLength = 16
+	// minTokenLength is the minimal length of mixed alphanumeric segments we consider random tokens.
+	minTokenLength = 20
+)
+
+var (
+	integerPattern = regexp.MustCompile(`^[0-9]+$`)
+	hexPattern     = regexp.MustCompile(`^[0-9a-fA-F]+$`)
+	tokenPattern   = regexp.MustCompile(`^[0-9a-zA-Z_\-]+$`)
+)
+
+// PathParameter is a variable segment of a templated path.
+type PathParameter struct {
+	name string
+	// parameterType is one of integer, uuid, hash or string.
+	parameterType string
+}
+
+func (parameter PathParameter) String() string {
+	return parameter.name + ":" + parameter.parameterType
+}
+
+// classifyPathSegment returns the type of the segments that hold identifiers, or an empty string for literal segments.
+// The segments that hold PII are classified by the given classifier.
+func classifyPathSegment(segment string, classifier *PIIClassifier) string {
+	switch {
+	case integerPattern.MatchString(segment):
+		return pathParameterInteger
+	case uuidPattern.MatchString(segment):
+		return pathParameterUUID
+	case len(segment) >= minHashLength && hexPattern.MatchString(segment) && strings.ContainsAny(segment, "0123456789"):
+		return pathParameterHash
+	case len(segment) >= minTokenLength && tokenPattern.MatchString(segment) &&
+		strings.ContainsAny(segment, "0123456789") && strings.ContainsAny(strings.ToLower(segment), "abcdefghijklmnopqrstuvwxyz"):
+		return pathParameterString
+	case len(segment) <= maxPIIValueLength && classifier.holdsPII(segment):
+		// Personal data, such as the email of a user, is not part of the endpoint.
+		return pathParameterString
+	default:
+		return ""
+	}
+}
+
+// mergePathParameters merges the parameters of two samples of the same template. Parameters observed with different
+// types are typed as strings.
+func mergePathParameters(current []PathParameter, sample []PathParameter) []PathParameter {
+	if len(current) != len(sample) {
+		return sample
+	}
+	for i := range current {
+		if current[i].parameterType != sample[i].parameterType {
+			current[i].parameterType = pathParameterString
+		}
+	}
+	return current
+}
+
+// pathPosition holds what we learned about the segments that follow a templated prefix.
+type pathPosition struct {
+	values   map[string]struct{}
+	variable bool
+}
+
+// PathNormalizer templates the paths of the requests, collapsing the segments that hold identifiers into parameters.
+// Besides the segments that look like identifiers, it learns the positions that hold too many distinct values.
+type PathNormalizer struct {
+	// positions is keyed by the templated prefix that precedes the position.
+	positions            map[string]*pathPosition
+	cardinalityThreshold int
+	// pii classifies the segments that hold personal data, it is replaced when the PII rules are reloaded.
+	pii *PIIClassifier
+}
+
+// NewPathNormalizer creates a new instance of the path normalizer.
+func NewPathNormalizer(cardinalityThreshold int, classifier *PIIClassifier) *PathNormalizer {
+	return &PathNormalizer{
+		positions:            make(map[string]*pathPosition),
+		cardinalityThreshold: cardinalityThreshold,
+		pii:                  classifier,
+	}
+}
+
+// Normalize returns the template of the path (without the query string) and its parameters. It also returns whether
+// a new variable position was learned from the path, in which case templates returned earlier may be outdated.
+func (normalizer *PathNormalizer) Normalize(path string) (string, []PathParameter, bool) {
+	return normalizer.template(path, true)
+}
+
+// Template returns the template of the path, without learning from it.
+func (normalizer *PathNormalizer) Template(path string) (string, []PathParameter) {
+	template, parameters, _ := normalizer.template(path, false)
+	return template, parameters
+}
+
+func (normalizer *PathNormalizer) template(path string, learn bool) (string, []PathParameter, bool) {
+	if index := strings.IndexByte(path, '?'); index != -1 {
+		path = path[:index]
+	}
+	segments := strings.Split(path, "/")
+	parameters := make([]PathParameter, 0)
+	learned := false
+	prefix := ""
+	for i, segment := range segments {
+		if i == 0 || segment == "" {
+			prefix += "/"
+			continue
+		}
+
+		parameterType := classifyPathSegment(segment, normalizer.pii)
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			// An already templated path, we keep its parameters as strings.
+			parameterType = pathParameterString
+		}
+		position, ok := normalizer.positions[prefix]
+		if !ok && learn && len(normalizer.positions) < maxPathPositions {
+			position = &pathPosition{values: make(map[string]struct{})}
+			normalizer.positions[prefix] = position
+		}
+		if parameterType == "" && position != nil {
+			if position.variable {
+				parameterType = pathParameterString
+			} else if learn {
+				position.values[segment] = struct{}{}
+				if len(position.values) > normalizer.cardinalityThreshold {
+					position.variable = true
+					position.values = nil
+					learned = true
+					normalizer.forgetLiterals(prefix)
+					parameterType = pathParameterString
+				}
+			}
+		}
+
+		if parameterType != "" {
+			name := "id"
+			if len(parameters) > 0 {
+				name = fmt.Sprintf("id%d", len(parameters)+1)
+			}
+			parameters = append(parameters, PathParameter{name: name, parameterType: parameterType})
+			segment = "{" + name + "}"
+		}
+		segments[i] = segment
+		prefix = strings.Join(segments[:i+1], "/") + "/"
+	}
+	return strings.Join(segments, "/"), parameters, learned
+}
+
+// forgetLiterals drops the positions that follow the literal values of a position that turned variable. The paths that
+// reached them are now templated through the parameter, so they would never be looked up again.
+func (normalizer *PathNormalizer) forgetLiterals(prefix string) {
+	for key := range normalizer.positions {
+		if len(key) > len(prefix) && strings.HasPrefix(key, prefix) && !strings.HasPrefix(key[len(prefix):], "{") {
+			delete(normalizer.positions, key)
+		}
+	}
+}
+
+// endpointPath templates the path of the request. When a new variable position is learned, the endpoints recorded
+// before are templated again, so they collapse into the new template.
+func (factory *Factory) endpointPath(path string) (string, []PathParameter) {
+	template, parameters, learned := factory.paths.Normalize(path)
+	if learned {
+		factory.templateInventory()
+	}
+	return template, parameters
+}
+
+// templateInventory templates the paths of the recorded endpoints again, merging the endpoints that share a template.
+func (factory *Factory) templateInventory() {
+	for key, schema := range factory.apiInventory {
+		template, parameters := factory.paths.Template(schema.uri)
+		if template == schema.uri {
+			continue
+		}
+		// The parameters that were already templated keep the type they were observed with.
+		previousTypes := make(map[string]string, len(schema.pathParameters))
+		for _, parameter := range schema.pathParameters {
+			previousTypes["{"+parameter.name+"}"] = parameter.parameterType
+		}
+		previousSegments := strings.Split(schema.uri, "/")
+		parameterIndex := 0
+		for i, segment := range strings.Split(template, "/") {
+			if !strings.HasPrefix(segment, "{") {
+				continue
+			}
+			if previousType, ok := previousTypes[previousSegments[i]]; ok {
+				parameters[parameterIndex].parameterType = previousType
+			}
+			parameterIndex++
+		}
+
+		delete(factory.apiInventory, key)
+		schema.uri = template
+		schema.pathParameters = parameters
+		if existing, ok := factory.apiInventory[schema.inventoryKey()]; ok {
+			existing.merge(schema)
+			factory.markDriftChanged(existing)
+			continue
+		}
+		factory.apiInventory[schema.inventoryKey()] = schema
+		factory.markDriftChanged(schema)
+	}
+}
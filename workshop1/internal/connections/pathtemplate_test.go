@@ -0,0 +1,144 @@
+package connections
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClassifyPathSegment(t *testing.T) {
+	rulesPath := filepath.Join(t.TempDir(), "pii-rules.yaml")
+	rules := "rules:\n  - category: customer_number\n    valuePattern: '^CUST-[0-9]{6}$'\n"
+	if err := os.WriteFile(rulesPath, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	withRules, err := LoadPIIRules(rulesPath)
+	if err != nil {
+		t.Fatalf("LoadPIIRules() error = %v", err)
+	}
+
+	tests := []struct {
+		segment    string
+		classifier *PIIClassifier
+		want       string
+	}{
+		{"users", nil, ""},
+		{"v2", nil, ""},
+		{"12345", nil, pathParameterInteger},
+		{"3f2504e0-4f89-11d3-9a0c-0305e82c3301", nil, pathParameterUUID},
+		{"5f8d0d55b54764421b7156c3", nil, pathParameterHash},
+		{"deadbeefdeadbeef", nil, ""},
+		{"aB3dE5gH7jK9mN1pQ3sT5", nil, pathParameterString},
+		{"health-check-endpoint", nil, ""},
+		{"jane.doe@example.com", nil, pathParameterString},
+		{"CUST-004211", nil, ""},
+		{"CUST-004211", withRules, pathParameterString},
+		{"jane.doe@example.com", withRules, pathParameterString},
+	}
+	for _, test := range tests {
+		classifier := test.classifier
+		if classifier == nil {
+			classifier = NewPIIClassifier()
+		}
+		if got := classifyPathSegment(test.segment, classifier); got != test.want {
+			t.Errorf("classifyPathSegment(%q) = %q, want %q", test.segment, got, test.want)
+		}
+	}
+
+	// The rules reloaded into the factory template the paths as well.
+	factory := NewFactory(time.Minute)
+	factory.SetPIIClassifier(withRules)
+	if template, _ := factory.paths.Template("/customers/CUST-004211"); template != "/customers/{id}" {
+		t.Errorf("Template(\"/customers/CUST-004211\") = %q, want \"/customers/{id}\"", template)
+	}
+}
+
+func TestPathNormalizerLearnsCardinality(t *testing.T) {
+	normalizer := NewPathNormalizer(3, NewPIIClassifier())
+	tests := []struct {
+		path     string
+		template string
+		learned  bool
+	}{
+		{"/users/1/profile", "/users/{id}/profile", false},
+		{"/users/alice/posts", "/users/alice/posts", false},
+		{"/users/bob/posts?page=2", "/users/bob/posts", false},
+		{"/users/carol", "/users/carol", false},
+		{"/users/dave/posts", "/users/{id}/posts", true},
+		{"/users/erin", "/users/{id}", false},
+		{"/orders/{orderId}/items", "/orders/{id}/items", false},
+	}
+	for _, test := range tests {
+		template, _, learned := normalizer.Normalize(test.path)
+		if template != test.template || learned != test.learned {
+			t.Errorf("Normalize(%q) = %q %v, want %q %v", test.path, template, learned, test.template, test.learned)
+		}
+	}
+	// Templating does not learn, and the paths seen before the position turned variable are templated as well.
+	if template, parameters := normalizer.Template("/users/alice/posts"); template != "/users/{id}/posts" ||
+		!reflect.DeepEqual(parameters, []PathParameter{{"id", pathParameterString}}) {
+		t.Errorf("Template(\"/users/alice/posts\") = %q %v, want \"/users/{id}/posts\" [id:string]", template, parameters)
+	}
+	for prefix := range normalizer.positions {
+		if strings.HasPrefix(prefix, "/users/alice") || strings.HasPrefix(prefix, "/users/bob") {
+			t.Errorf("Normalize() kept the position %q that follows a literal of a variable position", prefix)
+		}
+	}
+}
+
+func TestPathNormalizerBoundsPositions(t *testing.T) {
+	normalizer := NewPathNormalizer(defaultCardinalityThreshold, NewPIIClassifier())
+	normalizer.Normalize("/seed/s0")
+	for i := 0; len(normalizer.positions) < maxPathPositions; i++ {
+		normalizer.positions[fmt.Sprintf("/filler/%d/", i)] = &pathPosition{values: make(map[string]struct{})}
+	}
+	normalizer.Normalize("/new/path/segments")
+	if len(normalizer.positions) != maxPathPositions {
+		t.Errorf("Normalize() learned %d positions, want at most %d", len(normalizer.positions), maxPathPositions)
+	}
+	// The positions learned so far keep learning.
+	for i := 1; i <= defaultCardinalityThreshold; i++ {
+		normalizer.Normalize(fmt.Sprintf("/seed/s%d", i))
+	}
+	if template, _ := normalizer.Template("/seed/s1"); template != "/seed/{id}" {
+		t.Errorf("Template(\"/seed/s1\") = %q, want \"/seed/{id}\"", template)
+	}
+}
+
+func TestTemplateInventory(t *testing.T) {
+	factory := NewFactory(time.Minute)
+	factory.SetEventSink(NewEventSink(&strings.Builder{}))
+	factory.paths = NewPathNormalizer(2, factory.pii)
+	for _, path := range []string{"/files/1/alpha", "/files/2/beta", "/health"} {
+		factory.addHTTPTransaction(newTestTransaction("GET", path, "", http.StatusOK, "", ""))
+	}
+	if len(factory.apiInventory) != 3 {
+		t.Fatalf("addHTTPTransaction() added %d entries, want 3", len(factory.apiInventory))
+	}
+
+	// The third distinct value turns the position variable, and re-keys the entries recorded before.
+	factory.addHTTPTransaction(newTestTransaction("GET", "/files/3/gamma", "", http.StatusNotFound, "", ""))
+	keys := make([]string, 0)
+	for key := range factory.apiInventory {
+		keys = append(keys, key)
+	}
+	if !sameStrings(keys, []string{"GET_/files/{id}/{id2}", "GET_/health"}) {
+		t.Fatalf("templateInventory() = %v, want [GET_/files/{id}/{id2} GET_/health]", keys)
+	}
+	schema := factory.apiInventory["GET_/files/{id}/{id2}"]
+	if schema.uri != "/files/{id}/{id2}" || schema.statusCodes[http.StatusOK] != 2 ||
+		schema.statusCodes[http.StatusNotFound] != 1 || schema.requests != 3 {
+		t.Errorf("templateInventory() merged %q with status codes %v and %d requests, want 2 200, 1 404 and 3 requests",
+			schema.uri, schema.statusCodes, schema.requests)
+	}
+	// The parameter templated before keeps the type it was observed with.
+	want := []PathParameter{{"id", pathParameterInteger}, {"id2", pathParameterString}}
+	if !reflect.DeepEqual(schema.pathParameters, want) {
+		t.Errorf("templateInventory() parameters = %v, want %v", schema.pathParameters, want)
+	}
+}
@@ -0,0 +1,718 @@
+package connections
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	piiCategoryEmail       = "email"
+	piiCategoryPhone       = "phone"
+	piiCategoryCreditCard  = "credit_card"
+	piiCategoryNationalID  = "national_id"
+	piiCategoryIBAN        = "iban"
+	piiCategoryIPAddress   = "ip_address"
+	piiCategoryDateOfBirth = "date_of_birth"
+	piiCategoryName        = "name"
+
+	piiLocationPath           = "path"
+	piiLocationQuery          = "query"
+	piiLocationRequestHeader  = "request_header"
+	piiLocationCookie         = "cookie"
+	piiLocationRequestBody    = "request_body"
+	piiLocationResponseHeader = "response_header"
+	piiLocationSetCookie      = "set_cookie"
+	piiLocationResponseBody   = "response_body"
+
+	piiEventCategory = "pii"
+	piiEventField    = "pii_field"
+
+	// minPIIConfidence is the confidence from which a field is reported as holding PII.
+	minPIIConfidence = 0.5
+	// piiMatchConfidence is the confidence of fields whose name and value both match a category.
+	piiMatchConfidence = 0.95
+	// maxPIIFieldsPerEndpoint bounds the distinct PII fields we keep per endpoint.
+	maxPIIFieldsPerEndpoint = 128
+	// maxPIIValueLength bounds the length of the values we validate, longer values are free text.
+	maxPIIValueLength = 256
+)
+
+var (
+	ssnPattern   = regexp.MustCompile(`^(\d{3})-(\d{2})-(\d{4})$`)
+	ibanPattern  = regexp.MustCompile(`^[A-Z]{2}[0-9]{2}[A-Z0-9]{11,30}$`)
+	phonePattern = regexp.MustCompile(`^\+?[0-9 ()-]+$`)
+	// The letters of UK national insurance numbers exclude D, F, I, Q, U and V, and O as the second letter.
+	ninoPattern = regexp.MustCompile(`^([A-CEGHJ-PR-TW-Z][A-CEGHJ-NPR-TW-Z])\d{6}[A-D]$`)
+	// Spanish DNI numbers, and NIE numbers of foreigners, end with a check letter.
+	dniPattern = regexp.MustCompile(`^(?:\d{8}|[XYZ]\d{7})[A-Z]$`)
+	// Canadian social insurance numbers are only matched as they are printed, as other identifiers have 9 digits too.
+	sinPattern = regexp.MustCompile(`^\d{3}([ -])\d{3}([ -])\d{3}$`)
+
+	// unallocatedNINOPrefixes are the prefixes that are never issued as UK national insurance numbers.
+	unallocatedNINOPrefixes = map[string]struct{}{"BG": {}, "GB": {}, "KN": {}, "NK": {}, "NT": {}, "TN": {}, "ZZ": {}}
+	dniCheckLetters         = "TRWAGMYFPDXBNJZSQVHLCKE"
+
+	// identifierFieldSuffixes are the names of fields that hold identifiers, such as order ids, whose values pass the
+	// checks of card numbers and IBANs by chance.
+	identifierFieldSuffixes = []string{"id", "ids", "uuid", "guid", "ref", "reference", "key", "hash", "nonce", "version",
+		"sequence", "timestamp"}
+
+	dateOfBirthLayouts = []string{"2006-01-02", "2006/01/02", "02/01/2006", "01/02/2006", "02.01.2006", time.RFC3339}
+)
+
+// piiDetector detects a category of PII by the name and the value of fields.
+type piiDetector struct {
+	category string
+	severity string
+	// names are the normalized field names of the category, suffixes also match names that end with them, such as
+	// userEmail. namePatterns are the field name patterns of user defined rules.
+	names        []string
+	suffixes     []string
+	namePatterns []*regexp.Regexp
+	// validate checks whether a value belongs to the category, it is nil for categories detected by name only.
+	validate func(value string) bool
+	// excludedSuffixes are the names of fields whose values are not matched by value only.
+	excludedSuffixes []string
+	// nameConfidence is the confidence of fields that match by name only, and valueConfidence of fields that match by
+	// value only. A zero confidence does not report the match.
+	nameConfidence  float64
+	valueConfidence float64
+}
+
+var builtinPIIDetectors = []piiDetector{
+	{
+		category:        piiCategoryEmail,
+		severity:        eventSeverityWarning,
+		names:           []string{"email", "mail", "emailaddress"},
+		suffixes:        []string{"email", "emailaddress"},
+		validate:        isEmail,
+		nameConfidence:  0.6,
+		valueConfidence: 0.9,
+	},
+	{
+		category:        piiCategoryPhone,
+		severity:        eventSeverityWarning,
+		names:           []string{"phone", "mobile", "tel", "telephone", "msisdn", "cellphone", "phonenumber", "mobilenumber"},
+		suffixes:        []string{"phone", "phonenumber", "mobilenumber"},
+		validate:        isPhoneNumber,
+		nameConfidence:  0.7,
+		valueConfidence: 0.6,
+	},
+	{
+		category:         piiCategoryCreditCard,
+		severity:         eventSeverityHigh,
+		names:            []string{"pan", "card", "cardnumber", "creditcard", "creditcardnumber", "ccnumber", "cc"},
+		suffixes:         []string{"cardnumber", "creditcard"},
+		validate:         isCreditCardNumber,
+		excludedSuffixes: identifierFieldSuffixes,
+		nameConfidence:   0.7,
+		valueConfidence:  0.9,
+	},
+	{
+		category: piiCategoryNationalID,
+		severity: eventSeverityHigh,
+		names: []string{"ssn", "socialsecuritynumber", "nationalid", "nationalidentifier", "nin", "nino", "taxid", "tin",
+			"passportnumber", "personalnumber", "nationalinsurancenumber", "dni", "nie", "sin", "socialinsurancenumber"},
+		suffixes:         []string{"ssn", "nationalid", "passportnumber", "nationalinsurancenumber"},
+		validate:         isNationalID,
+		excludedSuffixes: identifierFieldSuffixes,
+		nameConfidence:   0.7,
+		valueConfidence:  0.8,
+	},
+	{
+		category:         piiCategoryIBAN,
+		severity:         eventSeverityHigh,
+		names:            []string{"iban", "bankaccount", "accountnumber"},
+		suffixes:         []string{"iban"},
+		validate:         isIBAN,
+		excludedSuffixes: identifierFieldSuffixes,
+		nameConfidence:   0.7,
+		valueConfidence:  0.9,
+	},
+	{
+		// Version numbers look like IP addresses, so addresses are only reported in fields named like them.
+		category:       piiCategoryIPAddress,
+		severity:       eventSeverityInfo,
+		names:          []string{"ip", "ipaddress", "clientip", "remoteip", "remoteaddr", "userip"},
+		suffixes:       []string{"ipaddress"},
+		validate:       isIPAddress,
+		nameConfidence: 0.6,
+	},
+	{
+		// Dates are too common to hold a date of birth by value only.
+		category:       piiCategoryDateOfBirth,
+		severity:       eventSeverityWarning,
+		names:          []string{"dob", "birthdate", "dateofbirth", "birthday", "birthdt"},
+		suffixes:       []string{"birthdate", "dateofbirth", "birthday"},
+		validate:       isDateOfBirth,
+		nameConfidence: 0.6,
+	},
+	{
+		category: piiCategoryName,
+		severity: eventSeverityWarning,
+		names: []string{"firstname", "lastname", "fullname", "surname", "givenname", "familyname", "middlename",
+			"forename"},
+		suffixes:       []string{"firstname", "lastname", "fullname", "surname"},
+		nameConfidence: 0.8,
+	},
+}
+
+// PIIFinding reports that a field of an endpoint holds a category of PII. Values are never kept.
+type PIIFinding struct {
+	// location is the part of the transaction that holds the field, such as the response body.
+	location string
+	// field is the JSON path of body fields, array items are denoted by []. It is the name of parameters, headers and
+	// cookies, and the template segment of path segments.
+	field    string
+	category string
+	severity string
+	// confidence is the highest confidence the field was classified with, between 0 and 1.
+	confidence float64
+	count      uint64
+}
+
+func (finding *PIIFinding) String() string {
+	return fmt.Sprintf("%s %s:%s severity=%s confidence=%.2f count=%d",
+		finding.location, finding.field, finding.category, finding.severity, finding.confidence, finding.count)
+}
+
+func (finding *PIIFinding) key() string {
+	return finding.location + "|" + finding.field + "|" + finding.category
+}
+
+// PIIClassifier classifies the fields of payloads into PII categories, by their name and their value.
+type PIIClassifier struct {
+	detectors []piiDetector
+}
+
+// NewPIIClassifier creates a new instance of the classifier, with the built-in detectors only.
+func NewPIIClassifier() *PIIClassifier {
+	return &PIIClassifier{detectors: builtinPIIDetectors}
+}
+
+// normalizeFieldName lowercases a field name and drops its separators, so first_name, first-name and firstName match.
+func normalizeFieldName(name string) string {
+	var builder strings.Builder
+	for _, r := range name {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			builder.WriteRune(unicode.ToLower(r))
+		}
+	}
+	return builder.String()
+}
+
+func (detector *piiDetector) matchesName(name string, normalizedName string) bool {
+	if normalizedName == "" {
+		return false
+	}
+	for _, pattern := range detector.namePatterns {
+		if pattern.MatchString(name) || pattern.MatchString(normalizedName) {
+			return true
+		}
+	}
+	name = normalizedName
+	for _, candidate := range detector.names {
+		// Plural names, such as emails, hold the same category.
+		if name == candidate || name == candidate+"s" {
+			return true
+		}
+	}
+	for _, suffix := range detector.suffixes {
+		if strings.HasSuffix(name, suffix) || strings.HasSuffix(name, suffix+"s") {
+			return true
+		}
+	}
+	return false
+}
+
+// holdsPII checks whether a value holds PII by itself, whatever the name of the field that holds it, by the detectors
+// of the classifier, including the user defined rules.
+func (classifier *PIIClassifier) holdsPII(value string) bool {
+	for i := range classifier.detectors {
+		detector := &classifier.detectors[i]
+		if detector.validate != nil && detector.valueConfidence >= minPIIConfidence && detector.validate(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyField returns the detector and the confidence of the most likely category of a field, or false if the field
+// holds no PII.
+func (classifier *PIIClassifier) classifyField(name string, value string) (*piiDetector, float64, bool) {
+	normalizedName := normalizeFieldName(name)
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, 0, false
+	}
+	var best *piiDetector
+	bestConfidence := 0.0
+	for i := range classifier.detectors {
+		detector := &classifier.detectors[i]
+		nameMatch := detector.matchesName(name, normalizedName)
+		valueMatch := detector.validate != nil && len(value) <= maxPIIValueLength && detector.validate(value)
+		if valueMatch && !nameMatch && hasSuffix(normalizedName, detector.excludedSuffixes) {
+			valueMatch = false
+		}
+		var confidence float64
+		switch {
+		case nameMatch && valueMatch:
+			confidence = piiMatchConfidence
+		case nameMatch:
+			confidence = detector.nameConfidence
+		case valueMatch:
+			confidence = detector.valueConfidence
+		}
+		if confidence > bestConfidence {
+			best, bestConfidence = detector, confidence
+		}
+	}
+	if bestConfidence < minPIIConfidence {
+		return nil, 0, false
+	}
+	return best, bestConfidence, true
+}
+
+// piiCollector gathers the findings of a payload, a field is reported once per payload.
+type piiCollector struct {
+	classifier *PIIClassifier
+	location   string
+	findings   map[string]*PIIFinding
+}
+
+func newPIICollector(classifier *PIIClassifier, location string) *piiCollector {
+	return &piiCollector{classifier: classifier, location: location, findings: make(map[string]*PIIFinding)}
+}
+
+func (collector *piiCollector) add(field string, name string, value string) {
+	detector, confidence, ok := collector.classifier.classifyField(name, value)
+	if !ok {
+		return
+	}
+	finding := &PIIFinding{
+		location:   collector.location,
+		field:      field,
+		category:   detector.category,
+		severity:   detector.severity,
+		confidence: confidence,
+		count:      1,
+	}
+	if current, ok := collector.findings[finding.key()]; ok {
+		if confidence > current.confidence {
+			current.confidence = confidence
+		}
+		return
+	}
+	collector.findings[finding.key()] = finding
+}
+
+// addValue classifies the fields of a decoded JSON value.
+func (collector *piiCollector) addValue(field string, name string, value interface{}, depth int) {
+	if depth > maxSchemaDepth {
+		return
+	}
+	switch typedValue := value.(type) {
+	case string:
+		collector.add(field, name, typedValue)
+	case json.Number:
+		// Card and phone numbers are sometimes sent as numbers.
+		collector.add(field, name, typedValue.String())
+	case []interface{}:
+		for _, item := range typedValue {
+			collector.addValue(field+"[]", name, item, depth+1)
+		}
+	case map[string]interface{}:
+		for key, property := range typedValue {
+			collector.addValue(field+"."+key, key, property, depth+1)
+		}
+	}
+}
+
+// addXMLElement classifies the attributes and the text of an XML element and its children.
+func (collector *piiCollector) addXMLElement(field string, element *xmlElement, depth int) {
+	if depth > maxSchemaDepth {
+		return
+	}
+	field += "." + element.name
+	for _, attribute := range element.attributes {
+		if isNamespaceDeclaration(attribute) {
+			continue
+		}
+		collector.add(field+"."+xmlAttributePrefix+attribute.Name.Local, attribute.Name.Local, attribute.Value)
+	}
+	for _, child := range element.children {
+		collector.addXMLElement(field, child, depth+1)
+	}
+	if len(element.children) == 0 {
+		collector.add(field, element.name, element.text.String())
+	}
+}
+
+func (collector *piiCollector) result() []*PIIFinding {
+	return sortedPIIFindings(collector.findings)
+}
+
+// classifyBody classifies the fields of a body by its media type, the same media types we infer the schema of.
+func (classifier *PIIClassifier) classifyBody(location string, mediaType string, params map[string]string, body []byte) []*PIIFinding {
+	collector := newPIICollector(classifier, location)
+	if len(bytes.TrimSpace(body)) == 0 {
+		return collector.result()
+	}
+	switch {
+	case mediaType == "" || isJSONMediaType(mediaType):
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		var value interface{}
+		if err := decoder.Decode(&value); err == nil {
+			collector.addValue("$", "", value, 0)
+		}
+	case mediaType == mediaTypeForm:
+		form, err := url.ParseQuery(string(bytes.TrimSpace(body)))
+		if err != nil {
+			break
+		}
+		for name, values := range form {
+			for _, value := range values {
+				collector.add("$."+name, name, value)
+			}
+		}
+	case mediaType == mediaTypeMultipart:
+		for _, part := range readMultipartParts(params["boundary"], body) {
+			if part.fileName == "" {
+				collector.add("$."+part.name, part.name, string(part.value))
+			}
+		}
+	case isXMLMediaType(mediaType):
+		if root := parseXMLDocument(body); root != nil {
+			collector.addXMLElement("$", root, 0)
+		}
+	}
+	return collector.result()
+}
+
+// classifyParameters classifies the path segments, the query parameters, the headers and the cookies of a
+// transaction. The segments of the path are named by the segments of its template, so /users/jane@example.com is
+// reported under {id} once the position is templated.
+func (classifier *PIIClassifier) classifyParameters(req *http.Request, res *http.Response, template string) []*PIIFinding {
+	findings := make([]*PIIFinding, 0)
+
+	path := newPIICollector(classifier, piiLocationPath)
+	segments, templateSegments := strings.Split(req.URL.Path, "/"), strings.Split(template, "/")
+	if len(segments) == len(templateSegments) {
+		for i, segment := range segments {
+			// Literal segments are classified by their value only, as they name themselves.
+			name := ""
+			if strings.HasPrefix(templateSegments[i], "{") {
+				name = strings.Trim(templateSegments[i], "{}")
+			}
+			path.add(templateSegments[i], name, segment)
+		}
+	}
+	findings = append(findings, path.result()...)
+
+	query := newPIICollector(classifier, piiLocationQuery)
+	for name, values := range req.URL.Query() {
+		for _, value := range values {
+			query.add(name, name, value)
+		}
+	}
+	findings = append(findings, query.result()...)
+
+	findings = append(findings, classifier.classifyHeaders(piiLocationRequestHeader, req.Header)...)
+	cookies := newPIICollector(classifier, piiLocationCookie)
+	for _, cookie := range req.Cookies() {
+		cookies.add(cookie.Name, cookie.Name, cookie.Value)
+	}
+	findings = append(findings, cookies.result()...)
+
+	if res == nil {
+		return findings
+	}
+	findings = append(findings, classifier.classifyHeaders(piiLocationResponseHeader, res.Header)...)
+	setCookies := newPIICollector(classifier, piiLocationSetCookie)
+	for _, cookie := range res.Cookies() {
+		setCookies.add(cookie.Name, cookie.Name, cookie.Value)
+	}
+	return append(findings, setCookies.result()...)
+}
+
+// classifyHeaders classifies the values of headers. Cookies are classified by their own names, so the headers that
+// carry them are skipped.
+func (classifier *PIIClassifier) classifyHeaders(location string, header http.Header) []*PIIFinding {
+	collector := newPIICollector(classifier, location)
+	for name, values := range header {
+		if name == "Cookie" || name == "Set-Cookie" {
+			continue
+		}
+		for _, value := range values {
+			collector.add(name, name, value)
+		}
+	}
+	return collector.result()
+}
+
+// isPhoneNumber checks whether a value is a formatted phone number, either in the international format or with
+// separators. Plain digit strings are too common to be taken for phone numbers.
+func isPhoneNumber(value string) bool {
+	if !phonePattern.MatchString(value) || strings.LastIndex(value, "+") > 0 {
+		return false
+	}
+	if !strings.HasPrefix(value, "+") && !strings.ContainsAny(value, " ()-") {
+		return false
+	}
+	if isDate(value) || ssnPattern.MatchString(value) {
+		return false
+	}
+	digits := 0
+	for _, r := range value {
+		if r >= '0' && r <= '9' {
+			digits++
+		}
+	}
+	return digits >= 8 && digits <= 15
+}
+
+// hasSuffix checks whether a normalized field name ends with one of the suffixes.
+func hasSuffix(name string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// cardIssuerRange is a range of issuer prefixes of a payment card network, with the lengths of its card numbers.
+type cardIssuerRange struct {
+	prefixLength int
+	low          int
+	high         int
+	minLength    int
+	maxLength    int
+}
+
+var cardIssuerRanges = []cardIssuerRange{
+	{1, 4, 4, 13, 19},       // Visa
+	{2, 51, 55, 16, 16},     // Mastercard
+	{4, 2221, 2720, 16, 16}, // Mastercard
+	{2, 34, 34, 15, 15},     // American Express
+	{2, 37, 37, 15, 15},     // American Express
+	{4, 6011, 6011, 16, 19}, // Discover
+	{3, 644, 649, 16, 19},   // Discover
+	{2, 65, 65, 16, 19},     // Discover
+	{4, 3528, 3589, 16, 19}, // JCB
+	{3, 300, 305, 14, 19},   // Diners Club
+	{2, 36, 36, 14, 19},     // Diners Club
+	{2, 38, 39, 14, 19},     // Diners Club
+	{2, 62, 62, 16, 19},     // UnionPay
+}
+
+// isCreditCardNumber checks whether a value is a payment card number, by its issuer prefix and length, and its Luhn
+// check digit.
+func isCreditCardNumber(value string) bool {
+	digits := strings.NewReplacer(" ", "", "-", "").Replace(value)
+	if len(digits) < 13 || len(digits) > 19 || !integerPattern.MatchString(digits) {
+		return false
+	}
+	for _, issuer := range cardIssuerRanges {
+		prefix, _ := strconv.Atoi(digits[:issuer.prefixLength])
+		if prefix >= issuer.low && prefix <= issuer.high && len(digits) >= issuer.minLength &&
+			len(digits) <= issuer.maxLength {
+			return isLuhnNumber(digits)
+		}
+	}
+	return false
+}
+
+// isLuhnNumber checks whether a value is a number with a valid Luhn check digit.
+func isLuhnNumber(digits string) bool {
+	if !integerPattern.MatchString(digits) {
+		return false
+	}
+	sum := 0
+	for i := 0; i < len(digits); i++ {
+		digit := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 1 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+	}
+	return sum%10 == 0
+}
+
+// isSocialSecurityNumber checks whether a value is a US social security number, excluding the numbers that are never
+// issued.
+func isSocialSecurityNumber(value string) bool {
+	match := ssnPattern.FindStringSubmatch(value)
+	if match == nil {
+		return false
+	}
+	area, group, serial := match[1], match[2], match[3]
+	return area != "000" && area != "666" && area[0] != '9' && group != "00" && serial != "0000"
+}
+
+// isNationalID checks whether a value is a national identification number: a US social security number, a UK national
+// insurance number, a Spanish DNI or NIE, or a Canadian social insurance number.
+func isNationalID(value string) bool {
+	return isSocialSecurityNumber(value) || isNationalInsuranceNumber(value) || isSpanishIdentityNumber(value) ||
+		isSocialInsuranceNumber(value)
+}
+
+// isNationalInsuranceNumber checks whether a value is a UK national insurance number, excluding the prefixes that are
+// never issued.
+func isNationalInsuranceNumber(value string) bool {
+	nino := strings.ToUpper(strings.Replace(value, " ", "", -1))
+	match := ninoPattern.FindStringSubmatch(nino)
+	if match == nil {
+		return false
+	}
+	_, unallocated := unallocatedNINOPrefixes[match[1]]
+	return !unallocated
+}
+
+// isSpanishIdentityNumber checks whether a value is a Spanish DNI or NIE, by its check letter.
+func isSpanishIdentityNumber(value string) bool {
+	id := strings.ToUpper(strings.Replace(value, "-", "", -1))
+	if !dniPattern.MatchString(id) {
+		return false
+	}
+	// The prefix of a NIE stands for a leading digit.
+	number, err := strconv.Atoi(strings.NewReplacer("X", "0", "Y", "1", "Z", "2").Replace(id[:8]))
+	return err == nil && id[8] == dniCheckLetters[number%len(dniCheckLetters)]
+}
+
+// isSocialInsuranceNumber checks whether a value is a Canadian social insurance number, by its Luhn check digit. The
+// numbers starting with 0 or 8 are never issued.
+func isSocialInsuranceNumber(value string) bool {
+	match := sinPattern.FindStringSubmatch(value)
+	if match == nil || match[1] != match[2] || value[0] == '0' || value[0] == '8' {
+		return false
+	}
+	return isLuhnNumber(strings.Replace(value, match[1], "", -1))
+}
+
+// isIBAN checks whether a value is an international bank account number, by its ISO 7064 mod 97 check digits.
+func isIBAN(value string) bool {
+	iban := strings.ToUpper(strings.Replace(value, " ", "", -1))
+	if !ibanPattern.MatchString(iban) {
+		return false
+	}
+	var numeric strings.Builder
+	for _, r := range iban[4:] + iban[:4] {
+		if r >= 'A' && r <= 'Z' {
+			numeric.WriteString(fmt.Sprint(r - 'A' + 10))
+		} else {
+			numeric.WriteRune(r)
+		}
+	}
+	number, ok := new(big.Int).SetString(numeric.String(), 10)
+	return ok && new(big.Int).Mod(number, big.NewInt(97)).Int64() == 1
+}
+
+func isIPAddress(value string) bool {
+	return strings.ContainsAny(value, ".:") && net.ParseIP(value) != nil
+}
+
+func parseDate(value string) (time.Time, bool) {
+	for _, layout := range dateOfBirthLayouts {
+		if date, err := time.Parse(layout, value); err == nil {
+			return date, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func isDate(value string) bool {
+	_, ok := parseDate(value)
+	return ok
+}
+
+// isDateOfBirth checks whether a value is a date in the lifetime of a living person.
+func isDateOfBirth(value string) bool {
+	date, ok := parseDate(value)
+	if !ok {
+		return false
+	}
+	now := time.Now()
+	return date.Before(now) && date.After(now.AddDate(-130, 0, 0))
+}
+
+// addPIIFindings merges the PII findings of another transaction into the findings of the endpoint. It returns the
+// fields that were not known to hold PII before.
+func (schema *ApiSchema) addPIIFindings(findings []*PIIFinding) []*PIIFinding {
+	if len(findings) == 0 {
+		return nil
+	}
+	schema.mutex.Lock()
+	defer schema.mutex.Unlock()
+	schema.containsPII = true
+	return mergePIIFindings(schema.piiFindings, findings)
+}
+
+func mergePIIFindings(current map[string]*PIIFinding, findings []*PIIFinding) []*PIIFinding {
+	added := make([]*PIIFinding, 0)
+	for _, finding := range findings {
+		key := finding.key()
+		existing, ok := current[key]
+		if !ok {
+			if len(current) < maxPIIFieldsPerEndpoint {
+				copied := *finding
+				current[key] = &copied
+				added = append(added, finding)
+			}
+			continue
+		}
+		existing.count += finding.count
+		if finding.confidence > existing.confidence {
+			existing.confidence = finding.confidence
+		}
+	}
+	return added
+}
+
+// addPIIFindings records the PII findings of a transaction of the endpoint, and reports the fields that were not known
+// to hold PII before.
+func (factory *Factory) addPIIFindings(schema *ApiSchema, findings []*PIIFinding) {
+	for _, finding := range schema.addPIIFindings(findings) {
+		factory.events.Emit(Event{
+			Category: piiEventCategory,
+			Type:     piiEventField,
+			Severity: finding.severity,
+			Method:   schema.method,
+			Path:     schema.uri,
+			Message:  fmt.Sprintf("%s %s holds %s", finding.location, finding.field, finding.category),
+			Details: map[string]interface{}{
+				"location":   finding.location,
+				"field":      finding.field,
+				"category":   finding.category,
+				"confidence": finding.confidence,
+			},
+		})
+	}
+}
+
+// sortedPIIFindings returns the findings of an endpoint ordered by location and field.
+func sortedPIIFindings(findings map[string]*PIIFinding) []*PIIFinding {
+	sorted := make([]*PIIFinding, 0, len(findings))
+	for _, finding := range findings {
+		sorted = append(sorted, finding)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].key() < sorted[j].key()
+	})
+	return sorted
+}
@@ -0,0 +1,215 @@
+package connections
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsLuhnNumber(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"79927398713", true},
+		{"79927398710", false},
+		{"4111111111111111", true},
+		{"4111111111111112", false},
+		{"0", true},
+		{"", false},
+		{"4111-1111-1111-1111", false},
+		{"41111111111111a1", false},
+	}
+	for _, test := range tests {
+		if got := isLuhnNumber(test.value); got != test.want {
+			t.Errorf("isLuhnNumber(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestIsCreditCardNumber(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"4111111111111111", true},
+		{"4111 1111 1111 1111", true},
+		{"4111-1111-1111-1111", true},
+		{"5555555555554444", true},
+		{"2223003122003222", true},
+		{"378282246310005", true},
+		{"6011111111111117", true},
+		{"3530111333300000", true},
+		{"4111111111111112", false},
+		// A Luhn valid number without an issuer prefix.
+		{"1234567812345670", false},
+		// Amex numbers have 15 digits.
+		{"3782822463100050", false},
+		{"411111111111", false},
+		{"4111x11111111111", false},
+	}
+	for _, test := range tests {
+		if got := isCreditCardNumber(test.value); got != test.want {
+			t.Errorf("isCreditCardNumber(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestIsIBAN(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"GB82WEST12345698765432", true},
+		{"GB82 WEST 1234 5698 7654 32", true},
+		{"gb82west12345698765432", true},
+		{"DE89370400440532013000", true},
+		{"FR1420041010050500013M02606", true},
+		{"GB82WEST12345698765433", false},
+		{"GB83WEST12345698765432", false},
+		{"GB82WEST", false},
+		{"1282WEST12345698765432", false},
+	}
+	for _, test := range tests {
+		if got := isIBAN(test.value); got != test.want {
+			t.Errorf("isIBAN(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestIsSocialSecurityNumber(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"123-45-6789", true},
+		{"078-05-1120", true},
+		{"000-12-3456", false},
+		{"666-12-3456", false},
+		{"912-34-5678", false},
+		{"123-00-4567", false},
+		{"123-45-0000", false},
+		{"123456789", false},
+		{"123-456-789", false},
+	}
+	for _, test := range tests {
+		if got := isSocialSecurityNumber(test.value); got != test.want {
+			t.Errorf("isSocialSecurityNumber(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestIsNationalID(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"123-45-6789", true},
+		{"AB123456C", true},
+		{"AB 12 34 56 C", true},
+		{"QQ123456C", false},
+		{"AO123456C", false},
+		{"GB123456A", false},
+		{"AB123456E", false},
+		{"12345678Z", true},
+		{"12345678-Z", true},
+		{"X1234567L", true},
+		{"12345678A", false},
+		{"X1234567A", false},
+		{"130 692 544", true},
+		{"130-692-544", true},
+		{"130 692 545", false},
+		{"130-692 544", false},
+		{"046 454 286", false},
+		{"130692544", false},
+	}
+	for _, test := range tests {
+		if got := isNationalID(test.value); got != test.want {
+			t.Errorf("isNationalID(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestIsPhoneNumber(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"+14155552671", true},
+		{"+1 415 555 2671", true},
+		{"(415) 555-2671", true},
+		{"+44 20 7946 0958", true},
+		{"4155552671", false},
+		{"+1234", false},
+		{"+1 415 555 2671 1234 5678", false},
+		{"1+415 555 2671", false},
+		{"2023-01-02", false},
+		{"123-45-6789", false},
+		{"415-555-CALL", false},
+	}
+	for _, test := range tests {
+		if got := isPhoneNumber(test.value); got != test.want {
+			t.Errorf("isPhoneNumber(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestIsDateOfBirth(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"1990-05-17", true},
+		{"1990/05/17", true},
+		{"17.05.1990", true},
+		{"1990-05-17T00:00:00Z", true},
+		{time.Now().AddDate(1, 0, 0).Format("2006-01-02"), false},
+		{"1800-01-01", false},
+		{"1990-13-40", false},
+		{"not a date", false},
+	}
+	for _, test := range tests {
+		if got := isDateOfBirth(test.value); got != test.want {
+			t.Errorf("isDateOfBirth(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestClassifyField(t *testing.T) {
+	tests := []struct {
+		name       string
+		value      string
+		category   string
+		confidence float64
+	}{
+		{"email", "jane@example.com", piiCategoryEmail, piiMatchConfidence},
+		{"contact", "jane@example.com", piiCategoryEmail, 0.9},
+		// Version numbers look like IP addresses.
+		{"version", "1.2.3.4", "", 0},
+		{"metadata", "1.2.3.4", "", 0},
+		{"clientIp", "1.2.3.4", piiCategoryIPAddress, piiMatchConfidence},
+		// Identifiers pass the Luhn check by chance.
+		{"orderId", "4111111111111111", "", 0},
+		{"order_ids", "4111111111111111", "", 0},
+		{"payment", "4111111111111111", piiCategoryCreditCard, 0.9},
+		{"cardNumber", "4111111111111111", piiCategoryCreditCard, piiMatchConfidence},
+		{"transferRef", "GB82WEST12345698765432", "", 0},
+		{"beneficiary", "GB82WEST12345698765432", piiCategoryIBAN, 0.9},
+		{"nino", "AB123456C", piiCategoryNationalID, piiMatchConfidence},
+		{"holder", "X1234567L", piiCategoryNationalID, 0.8},
+		{"first_name", "Jane", piiCategoryName, 0.8},
+		{"createdAt", "1990-05-17", "", 0},
+		{"status", "active", "", 0},
+	}
+	classifier := NewPIIClassifier()
+	for _, test := range tests {
+		detector, confidence, ok := classifier.classifyField(test.name, test.value)
+		category := ""
+		if ok {
+			category = detector.category
+		}
+		if category != test.category || confidence != test.confidence {
+			t.Errorf("classifyField(%q, %q) = %q %.2f, want %q %.2f", test.name, test.value, category, confidence,
+				test.category, test.confidence)
+		}
+	}
+}
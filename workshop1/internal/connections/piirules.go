@@ -0,0 +1,132 @@
+package connections
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// defaultPIIRuleConfidence is the confidence of the matches of rules that do not set one.
+	defaultPIIRuleConfidence = 0.8
+)
+
+// piiValidators are the built-in value validators rules can refer to by name.
+var piiValidators = map[string]func(value string) bool{
+	"email":         isEmail,
+	"phone":         isPhoneNumber,
+	"credit_card":   isCreditCardNumber,
+	"luhn":          isLuhnNumber,
+	"ssn":           isSocialSecurityNumber,
+	"national_id":   isNationalID,
+	"iban":          isIBAN,
+	"ip_address":    isIPAddress,
+	"date_of_birth": isDateOfBirth,
+}
+
+// piiRule is a user defined detector of sensitive data, such as customer identifiers or internal account numbers.
+type piiRule struct {
+	Category string `json:"category" yaml:"category"`
+	Severity string `json:"severity" yaml:"severity"`
+	// FieldNames are regular expressions, matched case-insensitively against the field names as they are and as they
+	// are normalized (lowercased, without separators).
+	FieldNames []string `json:"fieldNames" yaml:"fieldNames"`
+	// ValuePattern is a regular expression the values must match, and Validator names a built-in validator the values
+	// must pass. When both are set, values must satisfy both.
+	ValuePattern string  `json:"valuePattern" yaml:"valuePattern"`
+	Validator    string  `json:"validator" yaml:"validator"`
+	Confidence   float64 `json:"confidence" yaml:"confidence"`
+}
+
+type piiRuleFile struct {
+	Rules []piiRule `json:"rules" yaml:"rules"`
+}
+
+// detector compiles the rule into a detector. Fields that match either by name or by value are reported with the
+// confidence of the rule.
+func (rule *piiRule) detector() (piiDetector, error) {
+	detector := piiDetector{category: rule.Category, severity: rule.Severity}
+	if rule.Category == "" {
+		return detector, fmt.Errorf("rule has no category")
+	}
+	switch rule.Severity {
+	case "":
+		detector.severity = eventSeverityWarning
+	case eventSeverityInfo, eventSeverityWarning, eventSeverityHigh:
+	default:
+		return detector, fmt.Errorf("rule %s has an unknown severity %q", rule.Category, rule.Severity)
+	}
+	if len(rule.FieldNames) == 0 && rule.ValuePattern == "" && rule.Validator == "" {
+		return detector, fmt.Errorf("rule %s matches neither field names nor values", rule.Category)
+	}
+	for _, fieldName := range rule.FieldNames {
+		pattern, err := regexp.Compile("(?i)" + fieldName)
+		if err != nil {
+			return detector, fmt.Errorf("rule %s has an invalid field name pattern: %v", rule.Category, err)
+		}
+		detector.namePatterns = append(detector.namePatterns, pattern)
+	}
+
+	var valuePattern *regexp.Regexp
+	if rule.ValuePattern != "" {
+		var err error
+		if valuePattern, err = regexp.Compile(rule.ValuePattern); err != nil {
+			return detector, fmt.Errorf("rule %s has an invalid value pattern: %v", rule.Category, err)
+		}
+	}
+	var validator func(value string) bool
+	if rule.Validator != "" {
+		var ok bool
+		if validator, ok = piiValidators[rule.Validator]; !ok {
+			return detector, fmt.Errorf("rule %s has an unknown validator %q", rule.Category, rule.Validator)
+		}
+	}
+	if valuePattern != nil || validator != nil {
+		detector.validate = func(value string) bool {
+			return (valuePattern == nil || valuePattern.MatchString(value)) && (validator == nil || validator(value))
+		}
+	}
+
+	confidence := rule.Confidence
+	if confidence == 0 {
+		confidence = defaultPIIRuleConfidence
+	}
+	if confidence < 0 || confidence > 1 {
+		return detector, fmt.Errorf("rule %s has a confidence out of [0, 1]", rule.Category)
+	}
+	detector.nameConfidence, detector.valueConfidence = confidence, confidence
+	return detector, nil
+}
+
+// LoadPIIRules reads a rules file (JSON or YAML) and returns a classifier that evaluates its rules on top of the
+// built-in detectors. Rules take precedence over the built-in detectors that match a field with the same confidence.
+func LoadPIIRules(path string) (*PIIClassifier, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the PII rules: %v", err)
+	}
+	var file piiRuleFile
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte("{")) {
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&file)
+	} else {
+		err = yaml.UnmarshalStrict(content, &file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the PII rules: %v", err)
+	}
+	detectors := make([]piiDetector, 0, len(file.Rules)+len(builtinPIIDetectors))
+	for i := range file.Rules {
+		detector, err := file.Rules[i].detector()
+		if err != nil {
+			return nil, fmt.Errorf("invalid PII rule #%d in %s: %v", i+1, path, err)
+		}
+		detectors = append(detectors, detector)
+	}
+	return &PIIClassifier{detectors: append(detectors, builtinPIIDetectors...)}, nil
+}
@@ -0,0 +1,361 @@
+package connections
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	// RedactionNone prints the payloads as they were captured.
+	RedactionNone = "none"
+	// RedactionMask replaces the sensitive values with a placeholder.
+	RedactionMask = "mask"
+	// RedactionHash replaces the sensitive values with a salted hash, so equal values can still be correlated.
+	RedactionHash = "hash"
+	// RedactionDropBody masks the sensitive headers and drops the bodies.
+	RedactionDropBody = "drop-body"
+	// RedactionHeadersOnly masks the sensitive headers and prints neither the bodies nor their placeholders.
+	RedactionHeadersOnly = "headers-only"
+
+	redactedValue = "[REDACTED]"
+	// redactionSaltSize is the size of the salt drawn when hashing without a configured salt.
+	redactionSaltSize = 16
+)
+
+var (
+	// textFieldPattern matches the name: value and name=value pairs of free text, such as error messages. Unquoted values
+	// end at the separators of query strings, so the pairs of URLs are matched one by one.
+	textFieldPattern = regexp.MustCompile(`([\w.$-]+)\s*[:=]\s*("(?:[^"\\]|\\.)*"|'[^']*'|[^\s"',;{}()\[\]?&]+)`)
+	// textTokenPattern matches the words of free text.
+	textTokenPattern = regexp.MustCompile(`[^\s"',;{}()\[\]]+`)
+)
+
+// defaultRedactedHeaders are the headers whose values are redacted in every mode but none.
+var defaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// sensitiveFieldNames and sensitiveFieldSuffixes are the normalized names of credentials, which are redacted along with
+// the fields classified as PII.
+var (
+	sensitiveFieldNames = map[string]struct{}{
+		"pwd": {}, "passwd": {}, "otp": {}, "pin": {}, "cvv": {}, "cvc": {}, "sessionid": {}, "authorization": {},
+	}
+	sensitiveFieldSuffixes = []string{"password", "secret", "token", "apikey", "privatekey"}
+)
+
+// Redactor removes the sensitive values of the payloads before they are printed.
+type Redactor struct {
+	mode    string
+	salt    []byte
+	headers map[string]struct{}
+}
+
+// NewRedactor creates a new instance of the redactor. The given headers are redacted on top of the default ones. When
+// hashing without a salt, a random salt is drawn, so hashes can only be correlated within a run.
+func NewRedactor(mode string, salt string, headers []string) (*Redactor, error) {
+	switch mode {
+	case RedactionNone, RedactionMask, RedactionHash, RedactionDropBody, RedactionHeadersOnly:
+	default:
+		return nil, fmt.Errorf("unknown redaction mode %q", mode)
+	}
+	redactor := &Redactor{mode: mode, salt: []byte(salt), headers: make(map[string]struct{})}
+	if mode == RedactionHash && salt == "" {
+		redactor.salt = make([]byte, redactionSaltSize)
+		if _, err := rand.Read(redactor.salt); err != nil {
+			return nil, fmt.Errorf("failed to draw a redaction salt: %v", err)
+		}
+	}
+	for _, header := range append(defaultRedactedHeaders, headers...) {
+		if header = strings.TrimSpace(header); header != "" {
+			redactor.headers[http.CanonicalHeaderKey(header)] = struct{}{}
+		}
+	}
+	return redactor, nil
+}
+
+func isSensitiveFieldName(name string) bool {
+	normalizedName := normalizeFieldName(name)
+	if _, ok := sensitiveFieldNames[normalizedName]; ok {
+		return true
+	}
+	for _, suffix := range sensitiveFieldSuffixes {
+		if strings.HasSuffix(normalizedName, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactValue replaces a sensitive value, by a placeholder or by its salted hash.
+func (redactor *Redactor) redactValue(value string) string {
+	if redactor.mode != RedactionHash {
+		return redactedValue
+	}
+	mac := hmac.New(sha256.New, redactor.salt)
+	mac.Write([]byte(value))
+	return "[sha256:" + hex.EncodeToString(mac.Sum(nil))[:16] + "]"
+}
+
+// sensitive checks whether a field holds a credential, a secret or PII.
+func (redactor *Redactor) sensitive(classifier *PIIClassifier, name string, value string) bool {
+	if isSensitiveFieldName(name) || containsSecret(name, value) {
+		return true
+	}
+	_, _, ok := classifier.classifyField(name, value)
+	return ok
+}
+
+// redactHeaderValue redacts the value of a header. The names of cookies and the scheme of credentials are kept.
+func (redactor *Redactor) redactHeaderValue(classifier *PIIClassifier, name string, value string) string {
+	if _, ok := redactor.headers[name]; !ok {
+		if redactor.sensitive(classifier, name, value) {
+			return redactor.redactValue(value)
+		}
+		return value
+	}
+	switch name {
+	case "Cookie":
+		cookies := strings.Split(value, ";")
+		for i, cookie := range cookies {
+			if index := strings.IndexByte(cookie, '='); index != -1 {
+				cookies[i] = cookie[:index+1] + redactor.redactValue(cookie[index+1:])
+			}
+		}
+		return strings.Join(cookies, ";")
+	case "Set-Cookie":
+		// The attributes follow the first semicolon.
+		end := strings.IndexByte(value, ';')
+		if end == -1 {
+			end = len(value)
+		}
+		if index := strings.IndexByte(value[:end], '='); index != -1 {
+			return value[:index+1] + redactor.redactValue(value[index+1:end]) + value[end:]
+		}
+	case "Authorization", "Proxy-Authorization":
+		if index := strings.IndexByte(value, ' '); index != -1 {
+			return value[:index+1] + redactor.redactValue(value[index+1:])
+		}
+	}
+	return redactor.redactValue(value)
+}
+
+func (redactor *Redactor) redactHeaders(classifier *PIIClassifier, header http.Header) http.Header {
+	redacted := make(http.Header, len(header))
+	for name, values := range header {
+		for _, value := range values {
+			redacted[name] = append(redacted[name], redactor.redactHeaderValue(classifier, name, value))
+		}
+	}
+	return redacted
+}
+
+// redactRequestURI redacts the path segments that hold PII, and the values of the sensitive query parameters.
+func (redactor *Redactor) redactRequestURI(classifier *PIIClassifier, requestURL *url.URL) string {
+	if redactor.mode == RedactionNone {
+		return requestURL.RequestURI()
+	}
+	segments := strings.Split(requestURL.EscapedPath(), "/")
+	for i, segment := range segments {
+		value, err := url.PathUnescape(segment)
+		if err != nil || value == "" {
+			continue
+		}
+		if _, _, ok := classifier.classifyField("", value); ok {
+			segments[i] = redactor.redactValue(value)
+		}
+	}
+	uri := strings.Join(segments, "/")
+	if requestURL.RawQuery == "" {
+		return uri
+	}
+	pairs := strings.Split(requestURL.RawQuery, "&")
+	for i, pair := range pairs {
+		index := strings.IndexByte(pair, '=')
+		if index == -1 {
+			continue
+		}
+		name, nameErr := url.QueryUnescape(pair[:index])
+		value, valueErr := url.QueryUnescape(pair[index+1:])
+		if nameErr != nil || valueErr != nil || redactor.sensitive(classifier, name, value) {
+			pairs[i] = pair[:index+1] + redactor.redactValue(value)
+		}
+	}
+	return uri + "?" + strings.Join(pairs, "&")
+}
+
+// redactText redacts the sensitive values of free text, such as the error messages of databases: the values of the
+// name: value pairs whose name or value is sensitive, and the words that hold PII.
+func (redactor *Redactor) redactText(classifier *PIIClassifier, text string) string {
+	if redactor.mode == RedactionNone {
+		return text
+	}
+	redacted := textFieldPattern.ReplaceAllStringFunc(text, func(pair string) string {
+		match := textFieldPattern.FindStringSubmatch(pair)
+		value, quote := match[2], ""
+		if strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "'") {
+			value, quote = value[1:len(value)-1], value[:1]
+		}
+		if !redactor.sensitive(classifier, match[1], value) {
+			return pair
+		}
+		return pair[:len(pair)-len(match[2])] + quote + redactor.redactValue(value) + quote
+	})
+	return textTokenPattern.ReplaceAllStringFunc(redacted, func(word string) string {
+		if _, _, ok := classifier.classifyField("", word); ok {
+			return redactor.redactValue(word)
+		}
+		return word
+	})
+}
+
+// redactJSONValue redacts the sensitive fields of a decoded JSON value in place.
+func (redactor *Redactor) redactJSONValue(classifier *PIIClassifier, name string, value interface{}, depth int) interface{} {
+	if depth > maxSchemaDepth {
+		return redactedValue
+	}
+	switch typedValue := value.(type) {
+	case string:
+		if redactor.sensitive(classifier, name, typedValue) {
+			return redactor.redactValue(typedValue)
+		}
+	case json.Number:
+		if redactor.sensitive(classifier, name, typedValue.String()) {
+			return redactor.redactValue(typedValue.String())
+		}
+	case []interface{}:
+		for i, item := range typedValue {
+			typedValue[i] = redactor.redactJSONValue(classifier, name, item, depth+1)
+		}
+	case map[string]interface{}:
+		for key, property := range typedValue {
+			typedValue[key] = redactor.redactJSONValue(classifier, key, property, depth+1)
+		}
+	}
+	return value
+}
+
+// redactBody redacts a body by the redaction mode. Sensitive fields are redacted from JSON and URL encoded bodies, the
+// bodies of other media types are dropped, as their sensitive values cannot be told apart.
+func (redactor *Redactor) redactBody(classifier *PIIClassifier, mediaType string, body []byte) string {
+	if redactor.mode == RedactionNone || len(body) == 0 {
+		return string(body)
+	}
+	dropped := fmt.Sprintf("[%d bytes dropped]", len(body))
+	if redactor.mode == RedactionDropBody {
+		return dropped
+	}
+	switch {
+	case mediaType == "" || isJSONMediaType(mediaType):
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			break
+		}
+		redacted, err := json.Marshal(redactor.redactJSONValue(classifier, "", value, 0))
+		if err != nil {
+			break
+		}
+		return string(redacted)
+	case mediaType == mediaTypeForm:
+		pairs := strings.Split(string(bytes.TrimSpace(body)), "&")
+		for i, pair := range pairs {
+			index := strings.IndexByte(pair, '=')
+			if index == -1 {
+				continue
+			}
+			name, nameErr := url.QueryUnescape(pair[:index])
+			value, valueErr := url.QueryUnescape(pair[index+1:])
+			if nameErr != nil || valueErr != nil || redactor.sensitive(classifier, name, value) {
+				pairs[i] = pair[:index+1] + url.QueryEscape(redactor.redactValue(value))
+			}
+		}
+		return strings.Join(pairs, "&")
+	}
+	return dropped
+}
+
+// formatMessage formats the start line, the headers and the body of a message.
+func (redactor *Redactor) formatMessage(classifier *PIIClassifier, startLine string, header http.Header, mediaType string, body []byte) string {
+	var builder strings.Builder
+	builder.WriteString(startLine + "\r\n")
+	if redactor.mode != RedactionNone {
+		header = redactor.redactHeaders(classifier, header)
+	}
+	_ = header.Write(&builder)
+	if redactor.mode != RedactionHeadersOnly {
+		builder.WriteString("\r\n" + redactor.redactBody(classifier, mediaType, body))
+	}
+	return builder.String()
+}
+
+// formatRequest formats a request with its (decoded) body, redacted by the redaction mode.
+func (redactor *Redactor) formatRequest(classifier *PIIClassifier, req *http.Request, body []byte) string {
+	uri := redactor.redactRequestURI(classifier, req.URL)
+	header := req.Header.Clone()
+	// The parser moves the host out of the headers.
+	if req.Host != "" {
+		header.Set("Host", req.Host)
+	}
+	mediaType, _ := parseContentType(req.Header)
+	return redactor.formatMessage(classifier, fmt.Sprintf("%s %s %s", req.Method, uri, req.Proto), header, mediaType, body)
+}
+
+// formatResponse formats a response with its (decoded) body, redacted by the redaction mode.
+func (redactor *Redactor) formatResponse(classifier *PIIClassifier, res *http.Response, body []byte) string {
+	return redactor.formatMessage(classifier, res.Proto+" "+res.Status, res.Header, responseMediaType(res), body)
+}
+
+// redactStartLine redacts the target of a request line the way the URIs of parsed requests are. Status lines are
+// kept, and lines that are neither are dropped.
+func (redactor *Redactor) redactStartLine(classifier *PIIClassifier, line string) string {
+	parts := strings.Split(line, " ")
+	if len(parts) == 3 && strings.HasPrefix(parts[2], "HTTP/") {
+		if requestURL, err := url.ParseRequestURI(parts[1]); err == nil {
+			return parts[0] + " " + redactor.redactRequestURI(classifier, requestURL) + " " + parts[2]
+		}
+	}
+	if strings.HasPrefix(line, "HTTP/") {
+		return line
+	}
+	return fmt.Sprintf("[%d bytes dropped]", len(line))
+}
+
+// formatUnparsed formats a payload that could not be parsed as HTTP. Its header lines are redacted as far as they can
+// be told apart, and the rest is dropped.
+func (redactor *Redactor) formatUnparsed(classifier *PIIClassifier, payload []byte) string {
+	if redactor.mode == RedactionNone {
+		return string(payload)
+	}
+	head, rest := payload, []byte(nil)
+	if index := bytes.Index(payload, []byte("\r\n\r\n")); index != -1 {
+		head, rest = payload[:index], payload[index+4:]
+	}
+	lines := strings.Split(string(head), "\r\n")
+	for i, line := range lines {
+		if i == 0 {
+			lines[i] = redactor.redactStartLine(classifier, line)
+			continue
+		}
+		index := strings.IndexByte(line, ':')
+		if index == -1 {
+			lines[i] = fmt.Sprintf("[%d bytes dropped]", len(line))
+			continue
+		}
+		name := http.CanonicalHeaderKey(strings.TrimSpace(line[:index]))
+		lines[i] = line[:index+1] + " " + redactor.redactHeaderValue(classifier, name, strings.TrimSpace(line[index+1:]))
+	}
+	formatted := strings.Join(lines, "\r\n")
+	if len(rest) > 0 && redactor.mode != RedactionHeadersOnly {
+		formatted += fmt.Sprintf("\r\n\r\n[%d bytes dropped]", len(rest))
+	}
+	return formatted
+}
@@ -0,0 +1,255 @@
+package connections
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	schemaTypeString  = "string"
+	schemaTypeNumber  = "number"
+	schemaTypeInteger = "integer"
+	schemaTypeBoolean = "boolean"
+	schemaTypeNull    = "null"
+	schemaTypeObject  = "object"
+	schemaTypeArray   = "array"
+
+	schemaFormatDateTime = "date-time"
+	schemaFormatUUID     = "uuid"
+	schemaFormatEmail    = "email"
+
+	// maxSchemaDepth bounds the nesting we walk into, deeper values are described as typeless.
+	maxSchemaDepth = 32
+)
+
+var (
+	uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+)
+
+// Schema describes the structure of a JSON value, in the JSON Schema vocabulary. Schemas are merged across samples,
+// so values observed with conflicting types are described by a union (OneOf) of the observed variants, and object
+// properties missing from some of the samples are left out of Required.
+type Schema struct {
+	Type       string             `json:"type,omitempty"`
+	Format     string             `json:"format,omitempty"`
+	Properties map[string]*Schema `json:"properties,omitempty"`
+	Required   []string           `json:"required,omitempty"`
+	Items      *Schema            `json:"items,omitempty"`
+	OneOf      []*Schema          `json:"oneOf,omitempty"`
+	// ContentMediaType is the media type of binary strings, such as files uploaded in multipart forms.
+	ContentMediaType string `json:"contentMediaType,omitempty"`
+	// SampleCount is the number of times the value was observed.
+	SampleCount uint64 `json:"x-sample-count,omitempty"`
+	// Presence is the ratio of the samples of the parent object that hold this property.
+	Presence float64 `json:"x-presence,omitempty"`
+}
+
+func (schema *Schema) String() string {
+	if schema == nil {
+		return ""
+	}
+	schemaBytes, _ := json.Marshal(schema)
+	return string(schemaBytes)
+}
+
+// clone returns a deep copy of the schema, so it can be merged without changing the original.
+func (schema *Schema) clone() *Schema {
+	if schema == nil {
+		return nil
+	}
+	copied := *schema
+	if schema.Properties != nil {
+		copied.Properties = make(map[string]*Schema, len(schema.Properties))
+		for key, property := range schema.Properties {
+			copied.Properties[key] = property.clone()
+		}
+	}
+	copied.Required = append([]string(nil), schema.Required...)
+	copied.Items = schema.Items.clone()
+	if schema.OneOf != nil {
+		copied.OneOf = make([]*Schema, len(schema.OneOf))
+		for i, variant := range schema.OneOf {
+			copied.OneOf[i] = variant.clone()
+		}
+	}
+	return &copied
+}
+
+// inferSchema infers the schema of a JSON payload. It returns nil for empty or invalid payloads.
+func inferSchema(payload []byte) *Schema {
+	if len(bytes.TrimSpace(payload)) == 0 {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	// Keeping the numbers as written, so we can tell integers apart.
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil
+	}
+	return inferValueSchema(value, 0)
+}
+
+func inferValueSchema(value interface{}, depth int) *Schema {
+	schema := &Schema{SampleCount: 1}
+	if depth > maxSchemaDepth {
+		return schema
+	}
+	switch typedValue := value.(type) {
+	case nil:
+		schema.Type = schemaTypeNull
+	case bool:
+		schema.Type = schemaTypeBoolean
+	case json.Number:
+		schema.Type = schemaTypeInteger
+		if strings.ContainsAny(typedValue.String(), ".eE") {
+			schema.Type = schemaTypeNumber
+		}
+	case string:
+		schema.Type = schemaTypeString
+		schema.Format = inferStringFormat(typedValue)
+	case []interface{}:
+		schema.Type = schemaTypeArray
+		for _, item := range typedValue {
+			schema.Items = mergeSchemas(schema.Items, inferValueSchema(item, depth+1))
+		}
+	case map[string]interface{}:
+		schema.Type = schemaTypeObject
+		schema.Properties = make(map[string]*Schema, len(typedValue))
+		for key, property := range typedValue {
+			schema.Properties[key] = inferValueSchema(property, depth+1)
+		}
+		schema.updateRequired()
+	}
+	return schema
+}
+
+// inferStringFormat detects the well known formats of string values.
+func inferStringFormat(value string) string {
+	switch {
+	case uuidPattern.MatchString(value):
+		return schemaFormatUUID
+	case isDateTime(value):
+		return schemaFormatDateTime
+	case isEmail(value):
+		return schemaFormatEmail
+	default:
+		return ""
+	}
+}
+
+func isDateTime(value string) bool {
+	_, err := time.Parse(time.RFC3339Nano, value)
+	return err == nil
+}
+
+func isEmail(value string) bool {
+	if !strings.Contains(value, "@") || strings.ContainsAny(value, " <>") {
+		return false
+	}
+	address, err := mail.ParseAddress(value)
+	return err == nil && address.Address == value
+}
+
+// mergeSchemas merges the schema of a new sample into the current schema, and returns the merged schema. The current
+// schema is updated in place.
+func mergeSchemas(current *Schema, sample *Schema) *Schema {
+	if current == nil {
+		return sample
+	}
+	if sample == nil {
+		return current
+	}
+
+	if len(current.OneOf) == 0 && len(sample.OneOf) == 0 && mergeableTypes(current.Type, sample.Type) {
+		mergeSameType(current, sample)
+		return current
+	}
+
+	// Conflicting types, each variant is merged into the variant of its type.
+	variants := current.variants()
+	for _, sampleVariant := range sample.variants() {
+		merged := false
+		for _, variant := range variants {
+			if mergeableTypes(variant.Type, sampleVariant.Type) {
+				mergeSameType(variant, sampleVariant)
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			variants = append(variants, sampleVariant)
+		}
+	}
+	for _, variant := range variants {
+		variant.Presence = 0
+	}
+	return &Schema{
+		OneOf:       variants,
+		SampleCount: current.SampleCount + sample.SampleCount,
+		Presence:    current.Presence,
+	}
+}
+
+// variants returns the variants of a union, or the schema itself.
+func (schema *Schema) variants() []*Schema {
+	if len(schema.OneOf) > 0 {
+		return schema.OneOf
+	}
+	return []*Schema{schema}
+}
+
+// mergeableTypes checks whether values of the two types are described by a single schema. Integers are widened into
+// numbers rather than forming a union.
+func mergeableTypes(first string, second string) bool {
+	if first == second {
+		return true
+	}
+	isNumeric := func(schemaType string) bool {
+		return schemaType == schemaTypeInteger || schemaType == schemaTypeNumber
+	}
+	return isNumeric(first) && isNumeric(second)
+}
+
+func mergeSameType(current *Schema, sample *Schema) {
+	if current.Type != sample.Type {
+		current.Type = schemaTypeNumber
+	}
+	if current.Format != sample.Format {
+		current.Format = ""
+	}
+	if current.ContentMediaType != sample.ContentMediaType {
+		current.ContentMediaType = ""
+	}
+	current.SampleCount += sample.SampleCount
+	switch current.Type {
+	case schemaTypeObject:
+		if current.Properties == nil {
+			current.Properties = make(map[string]*Schema, len(sample.Properties))
+		}
+		for key, property := range sample.Properties {
+			current.Properties[key] = mergeSchemas(current.Properties[key], property)
+		}
+		current.updateRequired()
+	case schemaTypeArray:
+		current.Items = mergeSchemas(current.Items, sample.Items)
+	}
+}
+
+// updateRequired recalculates the presence ratio of the properties of an object, and marks the properties present in
+// every sample as required.
+func (schema *Schema) updateRequired() {
+	schema.Required = schema.Required[:0]
+	for key, property := range schema.Properties {
+		property.Presence = float64(property.SampleCount) / float64(schema.SampleCount)
+		if property.SampleCount >= schema.SampleCount {
+			schema.Required = append(schema.Required, key)
+		}
+	}
+	sort.Strings(schema.Required)
+}
@@ -21,6 +21,7 @@ package connections
 import (
 	structs2 "github.com/kiran-sama/ebpf-training/workshop1/internal/structs"
 	"log"
+	"sort"
 	"sync"
 	"time"
 )
@@ -29,6 +30,32 @@ const (
 	maxBufferSize = 100 * 1024 // 100KB
 )
 
+// dataSegment marks where a single data event starts in the buffer, and when it was captured. The timestamp of the
+// event measures the latencies, and the wall-clock time it was received at is the time the transaction happened at.
+type dataSegment struct {
+	offset        int
+	timestampNano uint64
+	capturedAt    time.Time
+}
+
+// timestampAt returns the capture time of the data event that holds the byte at the given offset.
+func timestampAt(segments []dataSegment, offset int) uint64 {
+	index := sort.Search(len(segments), func(i int) bool { return segments[i].offset > offset })
+	if index == 0 {
+		return 0
+	}
+	return segments[index-1].timestampNano
+}
+
+// capturedAt returns the wall-clock time the data event that holds the byte at the given offset was received at.
+func capturedAt(segments []dataSegment, offset int) time.Time {
+	index := sort.Search(len(segments), func(i int) bool { return segments[i].offset > offset })
+	if index == 0 {
+		return time.Time{}
+	}
+	return segments[index-1].capturedAt
+}
+
 type Tracker struct {
 	connID structs2.ConnID
 
@@ -45,7 +72,16 @@ type Tracker struct {
 
 	recvBuf []byte
 	sentBuf []byte
-	mutex   sync.RWMutex
+	// The data events that compose the buffers, used to time the messages in them.
+	recvSegments []dataSegment
+	sentSegments []dataSegment
+	// mongo is set once the connection is identified as MongoDB. Its buffers are then decoded as they fill, as pooled
+	// connections live long, and the requests still waiting for their responses are kept aside.
+	mongo         bool
+	mongoRequests map[int32]mongoMessage
+	// webSocket is set once the connection is upgraded to WebSocket, and its frames are then decoded as they arrive.
+	webSocket *webSocketConnection
+	mutex     sync.RWMutex
 }
 
 func NewTracker(connID structs2.ConnID) *Tracker {
@@ -63,6 +99,53 @@ func (conn *Tracker) ToBytes() ([]byte, []byte) {
 	return conn.recvBuf, conn.sentBuf
 }
 
+// snapshot returns the buffers and their data events as they are now. Data events added later do not change them.
+func (conn *Tracker) snapshot() ([]byte, []dataSegment, []byte, []dataSegment) {
+	conn.mutex.RLock()
+	defer conn.mutex.RUnlock()
+	return conn.recvBuf, conn.recvSegments, conn.sentBuf, conn.sentSegments
+}
+
+// consume drops the bytes that were analyzed from the start of the buffers, along with their data events.
+func (conn *Tracker) consume(recvCount int, sentCount int) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.recvBuf, conn.recvSegments = consumeBuffer(conn.recvBuf, conn.recvSegments, recvCount)
+	conn.sentBuf, conn.sentSegments = consumeBuffer(conn.sentBuf, conn.sentSegments, sentCount)
+}
+
+func consumeBuffer(buf []byte, segments []dataSegment, count int) ([]byte, []dataSegment) {
+	if count <= 0 {
+		return buf, segments
+	}
+	// The data event that holds the first byte left is kept, so the byte keeps its capture time.
+	index := sort.Search(len(segments), func(i int) bool { return segments[i].offset > count })
+	if index > 0 {
+		index--
+	}
+	remaining := make([]dataSegment, 0, len(segments)-index)
+	for _, segment := range segments[index:] {
+		segment.offset -= count
+		if segment.offset < 0 {
+			segment.offset = 0
+		}
+		remaining = append(remaining, segment)
+	}
+	// The buffer is copied, so the bytes that were consumed can be released.
+	return append(make([]byte, 0, maxBufferSize), buf[count:]...), remaining
+}
+
+// isMongo checks whether the connection was identified as MongoDB, by the header of the first message of a buffer.
+func (conn *Tracker) isMongo() bool {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if !conn.mongo && (isMongoMessage(conn.recvBuf) || isMongoMessage(conn.sentBuf)) {
+		conn.mongo = true
+		conn.mongoRequests = make(map[int32]mongoMessage)
+	}
+	return conn.mongo
+}
+
 func (conn *Tracker) IsInactive(duration time.Duration) bool {
 	conn.mutex.RLock()
 	defer conn.mutex.RUnlock()
@@ -90,11 +173,14 @@ func (conn *Tracker) AddDataEvent(event structs2.SocketDataEvent) {
 	defer conn.mutex.Unlock()
 	conn.updateTimestamps()
 
+	now := time.Now()
 	switch event.Attr.Direction {
 	case structs2.EgressTraffic:
+		conn.sentSegments = append(conn.sentSegments, dataSegment{offset: len(conn.sentBuf), timestampNano: event.Attr.TimestampNano, capturedAt: now})
 		conn.sentBuf = append(conn.sentBuf, event.Msg[:event.Attr.MsgSize]...)
 		conn.sentBytes += uint64(event.Attr.MsgSize)
 	case structs2.IngressTraffic:
+		conn.recvSegments = append(conn.recvSegments, dataSegment{offset: len(conn.recvBuf), timestampNano: event.Attr.TimestampNano, capturedAt: now})
 		conn.recvBuf = append(conn.recvBuf, event.Msg[:event.Attr.MsgSize]...)
 		conn.recvBytes += uint64(event.Attr.MsgSize)
 	default:
@@ -0,0 +1,470 @@
+package connections
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	webSocketOpContinuation = 0x0
+	webSocketOpText         = 0x1
+	webSocketOpBinary       = 0x2
+	webSocketOpClose        = 0x8
+	webSocketOpPing         = 0x9
+	webSocketOpPong         = 0xA
+
+	// maxWebSocketMessageSize bounds the size of a (decompressed) message we keep in memory.
+	maxWebSocketMessageSize = 1024 * 1024 // 1MB
+	// webSocketDeflateWindowSize is the LZ77 window shared between messages when the context is taken over.
+	webSocketDeflateWindowSize = 32 * 1024
+	// maxWebSocketSchemas bounds the distinct message schemas we keep per direction.
+	maxWebSocketSchemas = 20
+	// webSocketSchemaSampleRate is the rate of messages we infer the schema of, on each connection.
+	webSocketSchemaSampleRate = 10
+)
+
+var (
+	errWebSocketFrameTruncated = errors.New("websocket frame is truncated")
+	errWebSocketFrameTooLarge  = errors.New("websocket frame is too large")
+	// errWebSocketFrameInvalid is returned for headers that break the protocol, such as the ones decoded from the middle
+	// of a frame after data was lost.
+	errWebSocketFrameInvalid = errors.New("websocket frame is invalid")
+	// webSocketDeflateTail is the empty block trailer removed from every compressed message (RFC 7692).
+	webSocketDeflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+)
+
+// isWebSocketUpgrade checks whether the response accepts an upgrade of the connection to WebSocket.
+func isWebSocketUpgrade(res *http.Response) bool {
+	return res.StatusCode == http.StatusSwitchingProtocols && strings.EqualFold(res.Header.Get("Upgrade"), "websocket")
+}
+
+type webSocketFrame struct {
+	fin        bool
+	compressed bool
+	opcode     byte
+	payload    []byte
+}
+
+// parseWebSocketFrames decodes the consecutive frames in the buffer, unmasking their payloads. Decoding stops at the
+// first frame that is truncated, invalid or larger than maxWebSocketMessageSize. It also returns the size of the frames
+// that were decoded.
+func parseWebSocketFrames(buf []byte) ([]webSocketFrame, int, error) {
+	frames := make([]webSocketFrame, 0)
+	offset := 0
+	for offset < len(buf) {
+		start := offset
+		if offset+2 > len(buf) {
+			return frames, start, errWebSocketFrameTruncated
+		}
+		frame := webSocketFrame{
+			fin:        buf[offset]&0x80 != 0,
+			compressed: buf[offset]&0x40 != 0,
+			opcode:     buf[offset] & 0x0f,
+		}
+		if buf[offset]&0x30 != 0 || (frame.opcode > webSocketOpBinary && frame.opcode < webSocketOpClose) ||
+			frame.opcode > webSocketOpPong {
+			// Reserved bits and opcodes, no extension we decode uses them.
+			return frames, start, errWebSocketFrameInvalid
+		}
+		masked := buf[offset+1]&0x80 != 0
+		length := uint64(buf[offset+1] & 0x7f)
+		offset += 2
+
+		switch length {
+		case 126:
+			if offset+2 > len(buf) {
+				return frames, start, errWebSocketFrameTruncated
+			}
+			length = uint64(binary.BigEndian.Uint16(buf[offset : offset+2]))
+			offset += 2
+		case 127:
+			if offset+8 > len(buf) {
+				return frames, start, errWebSocketFrameTruncated
+			}
+			length = binary.BigEndian.Uint64(buf[offset : offset+8])
+			offset += 8
+			if length>>63 != 0 {
+				return frames, start, errWebSocketFrameInvalid
+			}
+		}
+		if frame.opcode >= webSocketOpClose && (length > 125 || !frame.fin) {
+			return frames, start, errWebSocketFrameInvalid
+		}
+		if length > maxWebSocketMessageSize {
+			return frames, start, errWebSocketFrameTooLarge
+		}
+
+		var maskingKey []byte
+		if masked {
+			if offset+4 > len(buf) {
+				return frames, start, errWebSocketFrameTruncated
+			}
+			maskingKey = buf[offset : offset+4]
+			offset += 4
+		}
+		if length > uint64(len(buf)-offset) {
+			return frames, start, errWebSocketFrameTruncated
+		}
+
+		frame.payload = make([]byte, length)
+		copy(frame.payload, buf[offset:offset+int(length)])
+		if masked {
+			for i := range frame.payload {
+				frame.payload[i] ^= maskingKey[i%4]
+			}
+		}
+		offset += int(length)
+		frames = append(frames, frame)
+	}
+	return frames, offset, nil
+}
+
+type webSocketMessage struct {
+	opcode  byte
+	payload []byte
+	// undecodable is set for compressed messages we failed to decompress.
+	undecodable bool
+	// oversized is set for messages larger than maxWebSocketMessageSize, whose payload is not kept.
+	oversized bool
+}
+
+// webSocketInflater decompresses the messages of a single direction of a permessage-deflate connection.
+type webSocketInflater struct {
+	// window is the tail of the previous messages, used as a dictionary when the context is taken over.
+	window          []byte
+	contextTakeover bool
+}
+
+// inflate decompresses a message, it returns a nil message when the message decompresses to more than
+// maxWebSocketMessageSize.
+func (inflater *webSocketInflater) inflate(payload []byte) ([]byte, error) {
+	data := make([]byte, 0, len(payload)+len(webSocketDeflateTail))
+	data = append(append(data, payload...), webSocketDeflateTail...)
+	reader := flate.NewReaderDict(bytes.NewReader(data), inflater.window)
+	defer reader.Close()
+	message, err := io.ReadAll(io.LimitReader(reader, maxWebSocketMessageSize+1))
+	// The trailer we append is a sync flush rather than a final block, so the reader ends with an unexpected EOF.
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if len(message) > maxWebSocketMessageSize {
+		// The rest of the message is not decompressed, so the window of the messages that follow is lost as well.
+		inflater.window = nil
+		return nil, nil
+	}
+	if inflater.contextTakeover {
+		inflater.window = append(inflater.window, message...)
+		if len(inflater.window) > webSocketDeflateWindowSize {
+			inflater.window = inflater.window[len(inflater.window)-webSocketDeflateWindowSize:]
+		}
+	}
+	return message, nil
+}
+
+// webSocketDirection is the state of a single direction of a WebSocket connection, kept between the times its frames
+// are decoded.
+type webSocketDirection struct {
+	// inflater is nil when compression was not negotiated.
+	inflater *webSocketInflater
+	// current is the message whose fragments are being assembled.
+	current    *webSocketMessage
+	compressed bool
+	// sampled counts the text messages, to sample the ones we infer the schema of.
+	sampled int
+	// lost is set once a frame could not be decoded. The frame boundaries are lost along with it, so the rest of the
+	// direction is dropped rather than decoded.
+	lost bool
+}
+
+// webSocketConnection is the state of a connection that was upgraded to WebSocket. WebSocket connections live long,
+// so their frames are decoded as they arrive, and added to the endpoint of the handshake.
+type webSocketConnection struct {
+	method string
+	path   string
+	client webSocketDirection
+	server webSocketDirection
+}
+
+func newWebSocketConnection(req *http.Request, res *http.Response) *webSocketConnection {
+	connection := &webSocketConnection{method: req.Method, path: req.URL.Path}
+	extensions := strings.ToLower(res.Header.Get("Sec-WebSocket-Extensions"))
+	if strings.Contains(extensions, "permessage-deflate") {
+		connection.client.inflater = &webSocketInflater{contextTakeover: !strings.Contains(extensions, "client_no_context_takeover")}
+		connection.server.inflater = &webSocketInflater{contextTakeover: !strings.Contains(extensions, "server_no_context_takeover")}
+	}
+	return connection
+}
+
+// assembleWebSocketMessages joins fragmented frames into messages. Control frames, which may be interleaved with the
+// fragments, are returned as messages of their own. A message whose last fragment did not arrive yet is kept in the
+// direction, and completed by the frames that follow.
+func assembleWebSocketMessages(frames []webSocketFrame, direction *webSocketDirection) []webSocketMessage {
+	messages := make([]webSocketMessage, 0, len(frames))
+	for _, frame := range frames {
+		if frame.opcode >= webSocketOpClose {
+			messages = append(messages, webSocketMessage{opcode: frame.opcode, payload: frame.payload})
+			continue
+		}
+		if frame.opcode != webSocketOpContinuation {
+			direction.current = &webSocketMessage{opcode: frame.opcode}
+			direction.compressed = frame.compressed && direction.inflater != nil
+		}
+		current := direction.current
+		if current == nil {
+			// A continuation of a message that started before the capture.
+			continue
+		}
+		if current.oversized || len(current.payload)+len(frame.payload) > maxWebSocketMessageSize {
+			current.oversized = true
+			current.payload = nil
+		} else {
+			current.payload = append(current.payload, frame.payload...)
+		}
+		if !frame.fin {
+			continue
+		}
+		if direction.compressed && !current.oversized {
+			payload, err := direction.inflater.inflate(current.payload)
+			if err != nil {
+				current.undecodable = true
+			} else if payload == nil {
+				current.oversized = true
+				current.payload = nil
+			} else {
+				current.payload = payload
+			}
+		}
+		messages = append(messages, *current)
+		direction.current = nil
+	}
+	return messages
+}
+
+// webSocketDirectionStats aggregates the messages sent in a single direction of the WebSocket connections.
+type webSocketDirectionStats struct {
+	messages       uint64
+	textMessages   uint64
+	binaryMessages uint64
+	controlFrames  uint64
+	bytes          uint64
+	maxMessageSize uint64
+	// oversizedMessages counts the messages larger than maxWebSocketMessageSize, which are not analyzed.
+	oversizedMessages uint64
+	// lostStreams counts the connections whose frames could no longer be decoded in this direction.
+	lostStreams uint64
+	// schemas counts the sampled JSON messages per schema.
+	schemas map[string]uint64
+}
+
+// WebSocketStats aggregates the WebSocket connections of a single endpoint.
+type WebSocketStats struct {
+	connections uint64
+	client      webSocketDirectionStats
+	server      webSocketDirectionStats
+	closeCodes  map[uint16]uint64
+}
+
+func NewWebSocketStats() *WebSocketStats {
+	return &WebSocketStats{
+		client:     webSocketDirectionStats{schemas: make(map[string]uint64)},
+		server:     webSocketDirectionStats{schemas: make(map[string]uint64)},
+		closeCodes: make(map[uint16]uint64),
+	}
+}
+
+func (stats *webSocketDirectionStats) merge(other *webSocketDirectionStats) {
+	stats.messages += other.messages
+	stats.textMessages += other.textMessages
+	stats.binaryMessages += other.binaryMessages
+	stats.controlFrames += other.controlFrames
+	stats.bytes += other.bytes
+	stats.oversizedMessages += other.oversizedMessages
+	stats.lostStreams += other.lostStreams
+	if other.maxMessageSize > stats.maxMessageSize {
+		stats.maxMessageSize = other.maxMessageSize
+	}
+	for schema, count := range other.schemas {
+		if _, ok := stats.schemas[schema]; ok || len(stats.schemas) < maxWebSocketSchemas {
+			stats.schemas[schema] += count
+		}
+	}
+}
+
+func (stats *WebSocketStats) merge(other *WebSocketStats) {
+	stats.connections += other.connections
+	stats.client.merge(&other.client)
+	stats.server.merge(&other.server)
+	for code, count := range other.closeCodes {
+		stats.closeCodes[code] += count
+	}
+}
+
+func (stats *WebSocketStats) String() string {
+	return fmt.Sprintf("connections=%d client(messages=%d text=%d binary=%d bytes=%d max=%d oversized=%d lost=%d) server(messages=%d text=%d binary=%d bytes=%d max=%d oversized=%d lost=%d) closeCodes=%v\nClientMessageSchemas:%v\nServerMessageSchemas:%v",
+		stats.connections,
+		stats.client.messages, stats.client.textMessages, stats.client.binaryMessages, stats.client.bytes, stats.client.maxMessageSize, stats.client.oversizedMessages, stats.client.lostStreams,
+		stats.server.messages, stats.server.textMessages, stats.server.binaryMessages, stats.server.bytes, stats.server.maxMessageSize, stats.server.oversizedMessages, stats.server.lostStreams,
+		stats.closeCodes, stats.client.schemas, stats.server.schemas,
+	)
+}
+
+func (factory *Factory) addWebSocketMessages(stats *WebSocketStats, directionStats *webSocketDirectionStats, direction *webSocketDirection, messages []webSocketMessage) {
+	for _, message := range messages {
+		switch message.opcode {
+		case webSocketOpText, webSocketOpBinary:
+		case webSocketOpClose:
+			directionStats.controlFrames++
+			if len(message.payload) >= 2 {
+				stats.closeCodes[binary.BigEndian.Uint16(message.payload[:2])]++
+			}
+			continue
+		case webSocketOpPing, webSocketOpPong:
+			directionStats.controlFrames++
+			continue
+		default:
+			// Reserved opcodes.
+			continue
+		}
+		if message.oversized {
+			directionStats.oversizedMessages++
+			continue
+		}
+
+		directionStats.messages++
+		directionStats.bytes += uint64(len(message.payload))
+		if uint64(len(message.payload)) > directionStats.maxMessageSize {
+			directionStats.maxMessageSize = uint64(len(message.payload))
+		}
+		if message.opcode == webSocketOpBinary || message.undecodable {
+			directionStats.binaryMessages++
+			continue
+		}
+		directionStats.textMessages++
+
+		direction.sampled++
+		if (direction.sampled-1)%webSocketSchemaSampleRate != 0 || !json.Valid(message.payload) {
+			continue
+		}
+		schema := inferSchema(message.payload).String()
+		if _, ok := directionStats.schemas[schema]; ok || len(directionStats.schemas) < maxWebSocketSchemas {
+			directionStats.schemas[schema]++
+		}
+	}
+}
+
+// upgradeWebSocket records the handshake of a connection upgraded to WebSocket, and consumes it from the buffers, so
+// the frames that follow it are decoded as they arrive.
+func (factory *Factory) upgradeWebSocket(tracker *Tracker, req *http.Request, res *http.Response, timing transactionTiming, requestEnd int, responseEnd int) {
+	// The rest of the stream holds WebSocket frames rather than HTTP, so we print only the handshake.
+	fmt.Printf("========================>\nFound WebSocket upgrade\nPeer->%s\nRequest->\n%s\n\nResponse->\n%s\n\n<========================\n", factory.peerName(tracker.addr),
+		factory.redactor.formatRequest(factory.pii, req, nil), factory.redactor.formatResponse(factory.pii, res, nil))
+	path, parameters := factory.endpointPath(req.URL.Path)
+	schema, ok := factory.apiInventory[req.Method+"_"+path]
+	if !ok {
+		fmt.Println("New URI found, adding to api inventory")
+		schema = NewApiSchema(req.Method, path, nil, nil, false)
+		factory.apiInventory[req.Method+"_"+path] = schema
+	}
+	schema.addParameters(req, parameters)
+	transaction := &httpTransaction{req: req, res: res, timing: timing, pid: tracker.connID.TGID, peer: tracker.addr}
+	factory.detectAttacks(transaction)
+	factory.analyzeTransaction(schema, transaction, nil, nil)
+	schema.addResponse(res, nil)
+	schema.addLatency(timing)
+	if schema.websocket == nil {
+		schema.websocket = NewWebSocketStats()
+	}
+	schema.websocket.connections++
+
+	tracker.webSocket = newWebSocketConnection(req, res)
+	tracker.consume(requestEnd, responseEnd)
+}
+
+// detectWebSocketUpgrade checks whether an open connection was upgraded to WebSocket by its first transaction, so its
+// frames are decoded before the connection is closed.
+func (factory *Factory) detectWebSocketUpgrade(tracker *Tracker) bool {
+	recvBuf, _, sentBuf, _ := tracker.snapshot()
+	if !bytes.HasPrefix(sentBuf, []byte("HTTP/1.1 101 ")) {
+		return false
+	}
+	recvReader := bytes.NewReader(recvBuf)
+	reqReader := bufio.NewReader(recvReader)
+	sentReader := bytes.NewReader(sentBuf)
+	resReader := bufio.NewReader(sentReader)
+	req, err := http.ReadRequest(reqReader)
+	if err != nil {
+		return false
+	}
+	res, err := http.ReadResponse(resReader, req)
+	if err != nil || !isWebSocketUpgrade(res) {
+		return false
+	}
+	requestEnd := len(recvBuf) - recvReader.Len() - reqReader.Buffered()
+	responseEnd := len(sentBuf) - sentReader.Len() - resReader.Buffered()
+	// Data events are added to open connections concurrently.
+	tracker.mutex.RLock()
+	timing := newTransactionTiming(tracker, 0, requestEnd, 0, responseEnd)
+	tracker.mutex.RUnlock()
+	factory.upgradeWebSocket(tracker, req, res, timing, requestEnd, responseEnd)
+	return true
+}
+
+// webSocketSchema returns the endpoint of the handshake of a WebSocket connection. Endpoints are merged as their paths
+// are templated, so the endpoint is looked up every time the frames are decoded.
+func (factory *Factory) webSocketSchema(connection *webSocketConnection) *ApiSchema {
+	path, _ := factory.paths.Template(connection.path)
+	schema, ok := factory.apiInventory[connection.method+"_"+path]
+	if !ok {
+		schema = NewApiSchema(connection.method, path, nil, nil, false)
+		factory.apiInventory[connection.method+"_"+path] = schema
+	}
+	if schema.websocket == nil {
+		schema.websocket = NewWebSocketStats()
+	}
+	return schema
+}
+
+// handleWebSocketFrames decodes the complete frames of both directions of a WebSocket connection, and adds them to the
+// WebSocket stats of the endpoint. The decoded frames are consumed from the buffers, and the frames truncated by the
+// end of the capture are dropped along with the tracker.
+func (factory *Factory) handleWebSocketFrames(tracker *Tracker) {
+	connection := tracker.webSocket
+	recvBuf, _, sentBuf, _ := tracker.snapshot()
+	stats := factory.webSocketSchema(connection).websocket
+	clientMessages, clientSize := decodeWebSocketDirection(recvBuf, &connection.client, &stats.client)
+	serverMessages, serverSize := decodeWebSocketDirection(sentBuf, &connection.server, &stats.server)
+	tracker.consume(clientSize, serverSize)
+
+	factory.addWebSocketMessages(stats, &stats.client, &connection.client, clientMessages)
+	factory.addWebSocketMessages(stats, &stats.server, &connection.server, serverMessages)
+}
+
+// decodeWebSocketDirection decodes the complete frames of a single direction into messages, and returns the size of
+// the buffer to consume. Only a truncated frame is kept in the buffer, and frames are bounded by
+// maxWebSocketMessageSize, so the buffer is bounded as well. Once a frame is invalid or too large, the direction is
+// lost and its data is dropped as it arrives.
+func decodeWebSocketDirection(buf []byte, direction *webSocketDirection, stats *webSocketDirectionStats) ([]webSocketMessage, int) {
+	if direction.lost {
+		return nil, len(buf)
+	}
+	frames, size, err := parseWebSocketFrames(buf)
+	messages := assembleWebSocketMessages(frames, direction)
+	if err == nil || err == errWebSocketFrameTruncated {
+		return messages, size
+	}
+	if err == errWebSocketFrameTooLarge {
+		stats.oversizedMessages++
+	}
+	stats.lostStreams++
+	direction.lost = true
+	direction.current = nil
+	return messages, len(buf)
+}
@@ -0,0 +1,229 @@
+package connections
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kiran-sama/ebpf-training/workshop1/internal/structs"
+)
+
+// encodeWebSocketFrame encodes a frame, masking its payload when a masking key is given.
+func encodeWebSocketFrame(fin bool, compressed bool, opcode byte, payload []byte, maskingKey []byte) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	if compressed {
+		first |= 0x40
+	}
+	frame := []byte{first, 0}
+	switch {
+	case len(payload) < 126:
+		frame[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		frame[1] = 126
+		frame = append(frame, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:4], uint16(len(payload)))
+	default:
+		frame[1] = 127
+		frame = append(frame, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(frame[2:10], uint64(len(payload)))
+	}
+	if maskingKey == nil {
+		return append(frame, payload...)
+	}
+	frame[1] |= 0x80
+	frame = append(frame, maskingKey...)
+	for i, b := range payload {
+		frame = append(frame, b^maskingKey[i%4])
+	}
+	return frame
+}
+
+// deflateWebSocketMessages compresses consecutive messages with a shared context, as permessage-deflate does.
+func deflateWebSocketMessages(messages ...string) [][]byte {
+	var buf bytes.Buffer
+	writer, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	compressed := make([][]byte, 0, len(messages))
+	for _, message := range messages {
+		writer.Write([]byte(message))
+		writer.Flush()
+		compressed = append(compressed, append([]byte{}, bytes.TrimSuffix(buf.Bytes(), webSocketDeflateTail)...))
+		buf.Reset()
+	}
+	return compressed
+}
+
+func TestParseWebSocketFrames(t *testing.T) {
+	maskingKey := []byte{0x12, 0x34, 0x56, 0x78}
+	medium := bytes.Repeat([]byte("a"), 300)
+	large := bytes.Repeat([]byte("b"), 70000)
+	hugeLength := []byte{0x82, 127, 0x80, 0, 0, 0, 0, 0, 0, 0}
+	tooLarge := []byte{0x82, 127, 0, 0, 0, 0, 0, 0x20, 0, 0}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		payloads []string
+		consumed int
+		err      error
+	}{
+		{"masked", encodeWebSocketFrame(true, false, webSocketOpText, []byte("hello"), maskingKey), []string{"hello"},
+			11, nil},
+		{"unmasked", encodeWebSocketFrame(true, false, webSocketOpText, []byte("hi"), nil), []string{"hi"}, 4, nil},
+		{"16 bit length", encodeWebSocketFrame(true, false, webSocketOpBinary, medium, maskingKey), []string{string(medium)},
+			308, nil},
+		{"64 bit length", encodeWebSocketFrame(true, false, webSocketOpBinary, large, nil), []string{string(large)},
+			70010, nil},
+		{"truncated payload", concat(encodeWebSocketFrame(true, false, webSocketOpText, []byte("a"), nil),
+			encodeWebSocketFrame(true, false, webSocketOpText, []byte("hello"), maskingKey)[:8]), []string{"a"}, 3,
+			errWebSocketFrameTruncated},
+		{"truncated length", []byte{0x81, 126, 0}, nil, 0, errWebSocketFrameTruncated},
+		{"truncated masking key", []byte{0x81, 0x85, 1, 2}, nil, 0, errWebSocketFrameTruncated},
+		{"length with the high bit", hugeLength, nil, 0, errWebSocketFrameInvalid},
+		{"too large", tooLarge, nil, 0, errWebSocketFrameTooLarge},
+		{"reserved bits", []byte{0x91, 0}, nil, 0, errWebSocketFrameInvalid},
+		{"reserved opcode", []byte{0x83, 0}, nil, 0, errWebSocketFrameInvalid},
+		{"fragmented control frame", []byte{0x09, 0}, nil, 0, errWebSocketFrameInvalid},
+		{"long control frame", encodeWebSocketFrame(true, false, webSocketOpPing, medium, nil), nil, 0,
+			errWebSocketFrameInvalid},
+	}
+	for _, test := range tests {
+		frames, consumed, err := parseWebSocketFrames(test.data)
+		payloads := make([]string, 0)
+		for _, frame := range frames {
+			payloads = append(payloads, string(frame.payload))
+		}
+		if err != test.err || consumed != test.consumed || !equalStrings(payloads, test.payloads) {
+			t.Errorf("%s: parseWebSocketFrames() = %d frames %d %v, want %d frames %d %v", test.name, len(payloads),
+				consumed, err, len(test.payloads), test.consumed, test.err)
+		}
+	}
+}
+
+func TestAssembleWebSocketMessages(t *testing.T) {
+	compressed := deflateWebSocketMessages(`{"type":"subscribe"}`, `{"type":"subscribe"}`)
+	oversized := bytes.Repeat([]byte("c"), maxWebSocketMessageSize/2+1)
+
+	tests := []struct {
+		name       string
+		frames     []webSocketFrame
+		inflater   *webSocketInflater
+		payloads   []string
+		oversized  []bool
+		inProgress bool
+	}{
+		{"fragmented", []webSocketFrame{
+			{fin: false, opcode: webSocketOpText, payload: []byte("hel")},
+			{fin: false, opcode: webSocketOpContinuation, payload: []byte("lo ")},
+			{fin: true, opcode: webSocketOpContinuation, payload: []byte("world")},
+		}, nil, []string{"hello world"}, []bool{false}, false},
+		{"control frame between fragments", []webSocketFrame{
+			{fin: false, opcode: webSocketOpText, payload: []byte("a")},
+			{fin: true, opcode: webSocketOpPing, payload: []byte("ping")},
+			{fin: true, opcode: webSocketOpContinuation, payload: []byte("b")},
+		}, nil, []string{"ping", "ab"}, []bool{false, false}, false},
+		{"last fragment pending", []webSocketFrame{
+			{fin: true, opcode: webSocketOpText, payload: []byte("done")},
+			{fin: false, opcode: webSocketOpText, payload: []byte("pending")},
+		}, nil, []string{"done"}, []bool{false}, true},
+		{"continuation without start", []webSocketFrame{
+			{fin: true, opcode: webSocketOpContinuation, payload: []byte("tail")},
+		}, nil, []string{}, []bool{}, false},
+		// The second message refers to the first one, and is decoded only with the context taken over.
+		{"compressed with context takeover", []webSocketFrame{
+			{fin: true, compressed: true, opcode: webSocketOpText, payload: compressed[0]},
+			{fin: true, compressed: true, opcode: webSocketOpText, payload: compressed[1]},
+		}, &webSocketInflater{contextTakeover: true}, []string{`{"type":"subscribe"}`, `{"type":"subscribe"}`},
+			[]bool{false, false}, false},
+		{"compressed fragments", []webSocketFrame{
+			{fin: false, compressed: true, opcode: webSocketOpText, payload: compressed[0][:3]},
+			{fin: true, opcode: webSocketOpContinuation, payload: compressed[0][3:]},
+		}, &webSocketInflater{}, []string{`{"type":"subscribe"}`}, []bool{false}, false},
+		{"compression not negotiated", []webSocketFrame{
+			{fin: true, compressed: true, opcode: webSocketOpBinary, payload: []byte("raw")},
+		}, nil, []string{"raw"}, []bool{false}, false},
+		{"oversized fragments", []webSocketFrame{
+			{fin: false, opcode: webSocketOpBinary, payload: oversized},
+			{fin: false, opcode: webSocketOpContinuation, payload: oversized},
+			{fin: true, opcode: webSocketOpContinuation, payload: []byte("end")},
+			{fin: true, opcode: webSocketOpText, payload: []byte("next")},
+		}, nil, []string{"", "next"}, []bool{true, false}, false},
+	}
+	for _, test := range tests {
+		direction := &webSocketDirection{inflater: test.inflater}
+		messages := assembleWebSocketMessages(test.frames, direction)
+		payloads := make([]string, 0)
+		oversizedMessages := make([]bool, 0)
+		for _, message := range messages {
+			if message.undecodable {
+				t.Errorf("%s: assembleWebSocketMessages() failed to decompress %q", test.name, message.payload)
+			}
+			payloads = append(payloads, string(message.payload))
+			oversizedMessages = append(oversizedMessages, message.oversized)
+		}
+		if !equalStrings(payloads, test.payloads) || !reflect.DeepEqual(oversizedMessages, test.oversized) ||
+			(direction.current != nil) != test.inProgress {
+			t.Errorf("%s: assembleWebSocketMessages() = %q oversized %v in progress %v, want %q oversized %v in progress %v",
+				test.name, payloads, oversizedMessages, direction.current != nil, test.payloads, test.oversized,
+				test.inProgress)
+		}
+	}
+}
+
+func TestWebSocketInflaterOversized(t *testing.T) {
+	compressed := deflateWebSocketMessages(string(bytes.Repeat([]byte("z"), maxWebSocketMessageSize+1)))
+	inflater := &webSocketInflater{contextTakeover: true}
+	message, err := inflater.inflate(compressed[0])
+	if err != nil || message != nil || inflater.window != nil {
+		t.Errorf("inflate() = %d bytes %v with a window of %d bytes, want an oversized message",
+			len(message), err, len(inflater.window))
+	}
+}
+
+func TestHandleWebSocketFrames(t *testing.T) {
+	factory := NewFactory(time.Minute)
+	tracker := NewTracker(structs.ConnID{})
+	req := &http.Request{Method: "GET", URL: &url.URL{Path: "/ws"}}
+	res := &http.Response{StatusCode: http.StatusSwitchingProtocols, Header: http.Header{}}
+	tracker.webSocket = newWebSocketConnection(req, res)
+	maskingKey := []byte{1, 2, 3, 4}
+
+	// A complete message and the start of the next one, split in the middle of its header.
+	next := encodeWebSocketFrame(true, false, webSocketOpText, []byte(`{"id":2}`), maskingKey)
+	tracker.recvBuf = concat(encodeWebSocketFrame(true, false, webSocketOpText, []byte(`{"id":1}`), maskingKey),
+		next[:3])
+	tracker.sentBuf = encodeWebSocketFrame(true, false, webSocketOpBinary, []byte{1, 2, 3}, nil)
+	factory.handleWebSocketFrames(tracker)
+	stats := factory.webSocketSchema(tracker.webSocket).websocket
+	if stats.client.textMessages != 1 || stats.server.binaryMessages != 1 || !bytes.Equal(tracker.recvBuf, next[:3]) ||
+		len(tracker.sentBuf) != 0 {
+		t.Fatalf("handleWebSocketFrames() = client %+v server %+v, buffers of %d and %d bytes", stats.client,
+			stats.server, len(tracker.recvBuf), len(tracker.sentBuf))
+	}
+
+	// The rest of the frame, followed by data decoded from the middle of a frame after a part of the stream was lost.
+	tracker.recvBuf = concat(tracker.recvBuf, next[3:], []byte{0x82, 127, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0x00})
+	factory.handleWebSocketFrames(tracker)
+	tracker.recvBuf = append(tracker.recvBuf, encodeWebSocketFrame(true, false, webSocketOpText, []byte("{}"), nil)...)
+	factory.handleWebSocketFrames(tracker)
+	if stats.client.textMessages != 2 || stats.client.lostStreams != 1 || len(tracker.recvBuf) != 0 {
+		t.Errorf("handleWebSocketFrames() = client %+v with a buffer of %d bytes, want 2 text messages, 1 lost stream "+
+			"and an empty buffer", stats.client, len(tracker.recvBuf))
+	}
+
+	// Frames larger than the messages we keep are not buffered.
+	tracker.sentBuf = []byte{0x82, 127, 0, 0, 0, 0, 0, 0x20, 0, 0}
+	factory.handleWebSocketFrames(tracker)
+	if stats.server.oversizedMessages != 1 || stats.server.lostStreams != 1 || len(tracker.sentBuf) != 0 {
+		t.Errorf("handleWebSocketFrames() = server %+v with a buffer of %d bytes, want 1 oversized message, 1 lost "+
+			"stream and an empty buffer", stats.server, len(tracker.sentBuf))
+	}
+}
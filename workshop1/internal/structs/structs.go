@@ -18,6 +18,23 @@
 
 package structs
 
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"unsafe"
+)
+
+// hostByteOrder is the byte order the BPF structs are decoded with.
+var hostByteOrder binary.ByteOrder = binary.BigEndian
+
+func init() {
+	probe := uint16(1)
+	if *(*byte)(unsafe.Pointer(&probe)) == 1 {
+		hostByteOrder = binary.LittleEndian
+	}
+}
+
 // ConnID is a conversion of the following C-Struct into GO.
 // struct conn_id_t {
 //    uint32_t tgid;
@@ -46,6 +63,25 @@ type SockAddrIn struct {
 	SinZero   [8]byte
 }
 
+// IP returns the IPv4 address. SinAddr holds the address in network byte order, but was decoded as a host order integer.
+func (addr SockAddrIn) IP() net.IP {
+	ip := make(net.IP, net.IPv4len)
+	hostByteOrder.PutUint32(ip, addr.SinAddr)
+	return ip
+}
+
+// Port returns the port in host byte order.
+func (addr SockAddrIn) Port() uint16 {
+	port := make([]byte, 2)
+	hostByteOrder.PutUint16(port, addr.SinPort)
+	return binary.BigEndian.Uint16(port)
+}
+
+// String returns the address in the ip:port form.
+func (addr SockAddrIn) String() string {
+	return fmt.Sprintf("%s:%d", addr.IP(), addr.Port())
+}
+
 // SocketDataEventAttr is a conversion of the following C-Struct into GO.
 // struct attr_t {
 //     uint64_t timestamp_ns;
@@ -101,3 +137,35 @@ type SocketCloseEvent struct {
 	WrittenBytes  int64
 	ReadBytes     int64
 }
+
+const (
+	DNSMessageMaxSize = 1232
+)
+
+// DNSEventAttr is a conversion of the following C-Struct into GO.
+// struct dns_attr_t {
+//     uint64_t timestamp_ns;
+//     uint32_t pid;
+//     int32_t fd;
+//     enum traffic_direction_t direction;
+//     uint32_t msg_size;
+//     struct sockaddr_in addr;
+// };.
+type DNSEventAttr struct {
+	TimestampNano uint64
+	PID           uint32
+	FD            int32
+	Direction     TrafficDirectionEnum
+	MsgSize       uint32
+	Addr          SockAddrIn
+}
+
+// DNSEvent is a conversion of the following C-Struct into GO.
+// struct dns_event_t {
+//    struct dns_attr_t attr;
+//    char msg[1232];
+// };.
+type DNSEvent struct {
+	Attr DNSEventAttr
+	Msg  [DNSMessageMaxSize]byte
+}